@@ -32,6 +32,61 @@ func main() {
 			Value: "1",
 			Usage: "Indicate the Server node num",
 		},
+		cli.StringFlag{
+			Name:  "store",
+			Value: "consul",
+			Usage: "Datastore backend: consul, bolt (single node) or memory (single node, not persisted)",
+		},
+		cli.StringFlag{
+			Name:  "consul-addr",
+			Value: "localhost:8500",
+			Usage: "Address of the consul agent http api, also the port the embedded agent serves it on",
+		},
+		cli.StringFlag{
+			Name:  "consul-scheme",
+			Value: "http",
+			Usage: "Scheme of the consul agent http api: http or https",
+		},
+		cli.StringFlag{
+			Name:  "consul-ca",
+			Usage: "CA file to verify consul agents with",
+		},
+		cli.StringFlag{
+			Name:  "consul-cert",
+			Usage: "Certificate file presented to consul agents",
+		},
+		cli.StringFlag{
+			Name:  "consul-key",
+			Usage: "Key file of the consul certificate",
+		},
+		cli.StringFlag{
+			Name:   "consul-token",
+			EnvVar: "CONSUL_HTTP_TOKEN",
+			Usage:  "Consul ACL token",
+		},
+		cli.StringFlag{
+			Name:  "consul-acl-dc",
+			Usage: "Consul ACL datacenter, enables ACLs in the embedded agent",
+		},
+		cli.StringFlag{
+			Name:   "encrypt",
+			EnvVar: "CXY_SDN_ENCRYPT",
+			Usage:  "Gossip encryption key, 16 bytes base64 encoded, ignored once the agent has a keyring",
+		},
+		cli.StringFlag{
+			Name:   "vni-reserved",
+			EnvVar: "CXY_SDN_VNI_RESERVED",
+			Usage:  "VNI ranges only given to networks asking for them, like 1000-1999,4000, the same on every node",
+		},
+		cli.StringFlag{
+			Name:  "subnet-pool",
+			Usage: "Supernet the subnets of networks created without one are carved from, like 10.128.0.0/9, the same on every node",
+		},
+		cli.IntFlag{
+			Name:  "subnet-prefix",
+			Value: 24,
+			Usage: "Prefix length of the subnets carved from the subnet pool",
+		},
 	}
 
 	app.Action = func(c *cli.Context) {
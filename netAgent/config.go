@@ -0,0 +1,225 @@
+package netAgent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Config tells netAgent how to reach the consul agent and how to start
+// the embedded one
+type Config struct {
+	Address  string // host:port of the agent http api
+	Scheme   string // http or https
+	CAFile   string // CA used to verify the agent, and the agent to verify its peers
+	CertFile string // client certificate, also used by the embedded agent
+	KeyFile  string
+	Token    string // ACL token sent with every request, default token of the agent
+
+	// datacenter authoritative for ACLs, enables ACL enforcement
+	// in the embedded agent when set
+	ACLDatacenter string
+
+	// gossip encryption key the embedded agent starts with, only used
+	// until the agent has a keyring in its data dir
+	Encrypt string
+	RPCAddr string // agent RPC address used for keyring operations
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Address: "localhost:8500",
+		Scheme:  "http",
+		RPCAddr: "127.0.0.1:8400",
+	}
+}
+
+var config = DefaultConfig()
+var httpClient = &http.Client{}
+
+// SetConfig validates c and uses it for every following request
+func SetConfig(c *Config) error {
+	if c.Address == "" {
+		c.Address = DefaultConfig().Address
+	}
+	if c.Scheme == "" {
+		c.Scheme = DefaultConfig().Scheme
+	}
+	if c.RPCAddr == "" {
+		c.RPCAddr = DefaultConfig().RPCAddr
+	}
+	if c.Encrypt != "" {
+		if err := ValidateKey(c.Encrypt); err != nil {
+			return err
+		}
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return errors.New("consul scheme must be http or https")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return err
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	config = c
+	httpClient = client
+	return nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.Scheme != "https" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func baseURL() string {
+	return config.Scheme + "://" + config.Address + "/v1/"
+}
+
+func kvBaseURL() string {
+	return baseURL() + "kv/"
+}
+
+func catalogBaseURL() string {
+	return baseURL() + "catalog/"
+}
+
+// new http request to the agent carrying the ACL token
+func newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if config.Token != "" {
+		req.Header.Set("X-Consul-Token", config.Token)
+	}
+	return req, nil
+}
+
+func httpGet(url string) (*http.Response, error) {
+	req, err := newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// consul api client using the same address, TLS and token
+func apiClient() (*api.Client, error) {
+	return api.NewClient(&api.Config{
+		Address:    config.Address,
+		Scheme:     config.Scheme,
+		HttpClient: httpClient,
+		Token:      config.Token,
+	})
+}
+
+// the agent options that only exist in a consul config file
+type agentConfigFile struct {
+	Ports          map[string]int `json:"ports,omitempty"`
+	CAFile         string         `json:"ca_file,omitempty"`
+	CertFile       string         `json:"cert_file,omitempty"`
+	KeyFile        string         `json:"key_file,omitempty"`
+	VerifyIncoming bool           `json:"verify_incoming,omitempty"`
+	VerifyOutgoing bool           `json:"verify_outgoing,omitempty"`
+	ACLToken       string         `json:"acl_token,omitempty"`
+	ACLDatacenter  string         `json:"acl_datacenter,omitempty"`
+}
+
+// agentArgs returns the extra `agent` command arguments for the config,
+// TLS and ACL settings are written to a config file in dataDir
+func agentArgs(dataDir string) ([]string, error) {
+	_, portStr, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	file := agentConfigFile{
+		CAFile:         config.CAFile,
+		CertFile:       config.CertFile,
+		KeyFile:        config.KeyFile,
+		VerifyOutgoing: config.CAFile != "",
+		VerifyIncoming: config.CAFile != "" && config.CertFile != "",
+		ACLToken:       config.Token,
+		ACLDatacenter:  config.ACLDatacenter,
+	}
+
+	if config.Scheme == "https" {
+		// serve the api on the configured port over https only
+		file.Ports = map[string]int{"https": port, "http": -1}
+	} else if port != 8500 {
+		file.Ports = map[string]int{"http": port}
+	}
+
+	var args []string
+	if config.Encrypt != "" {
+		args = append(args, "-encrypt", config.Encrypt)
+	}
+
+	if file.Ports == nil && config.CAFile == "" && config.CertFile == "" &&
+		config.KeyFile == "" && config.Token == "" && config.ACLDatacenter == "" {
+		// defaults, nothing to tell the agent
+		return args, nil
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dataDir, "cxy-sdn-agent.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return append(args, "-config-file", path), nil
+}
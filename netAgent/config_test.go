@@ -0,0 +1,169 @@
+package netAgent
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigInvalid(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+
+	if err := SetConfig(&Config{Scheme: "ftp"}); err == nil {
+		t.Fatal("scheme ftp must be rejected")
+	}
+
+	if err := SetConfig(&Config{Address: "localhost"}); err == nil {
+		t.Fatal("address without port must be rejected")
+	}
+
+	if err := SetConfig(&Config{Scheme: "https", CAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Fatal("missing CA file must be rejected")
+	}
+
+	if err := SetConfig(&Config{Encrypt: "not a key"}); err == nil {
+		t.Fatal("bad gossip key must be rejected")
+	}
+
+	if err := SetConfig(&Config{}); err != nil || config.Address != "localhost:8500" {
+		t.Fatal("empty config must fall back to the defaults", err)
+	}
+}
+
+// consul store talking https with a custom CA, every request carries the token
+func TestConsulStoreTLSToken(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+
+	var tokens []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		if r.URL.Path != "/v1/kv/haha/test" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"ModifyIndex":7,"Key":"haha/test","Value":"MTkyLjE2OC4xLjE="}]`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "cxy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetConfig(&Config{
+		Address: strings.TrimPrefix(ts.URL, "https://"),
+		Scheme:  "https",
+		CAFile:  caFile,
+		Token:   "secret",
+	})
+	if err != nil {
+		t.Fatal("SetConfig failed", err)
+	}
+
+	s := NewConsulStore()
+	val, index, ok := s.Get("haha", "test")
+	if !ok || string(val) != "192.168.1.1" || index != 7 {
+		t.Fatal("Get over https failed", string(val), index, ok)
+	}
+
+	if pairs, ok := s.List("empty"); !ok || len(pairs) != 0 {
+		t.Fatal("List of a missing prefix must be empty", pairs)
+	}
+
+	for _, token := range tokens {
+		if token != "secret" {
+			t.Fatal("request without ACL token", tokens)
+		}
+	}
+}
+
+func TestAgentArgs(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+
+	dir, err := ioutil.TempDir("", "cxy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args, err := agentArgs(dir)
+	if err != nil || len(args) != 0 {
+		t.Fatal("default config needs no agent args", args, err)
+	}
+
+	key, _ := GenerateKey()
+	config = &Config{Address: "localhost:8500", Scheme: "http", Encrypt: key}
+
+	args, err = agentArgs(dir)
+	if err != nil || len(args) != 2 || args[0] != "-encrypt" || args[1] != key {
+		t.Fatal("expected -encrypt arg only", args, err)
+	}
+
+	// CA file is only read by SetConfig for https
+	config = &Config{
+		Address:       "127.0.0.1:8501",
+		Scheme:        "https",
+		CAFile:        "ca.pem",
+		CertFile:      "cert.pem",
+		KeyFile:       "key.pem",
+		Token:         "secret",
+		ACLDatacenter: "dc1",
+	}
+
+	args, err = agentArgs(dir)
+	if err != nil || len(args) != 2 || args[0] != "-config-file" {
+		t.Fatal("expected -config-file arg", args, err)
+	}
+
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file agentConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Ports["https"] != 8501 || file.Ports["http"] != -1 {
+		t.Fatal("agent must serve https only on the configured port", file.Ports)
+	}
+
+	if !file.VerifyIncoming || !file.VerifyOutgoing || file.CAFile != "ca.pem" ||
+		file.ACLToken != "secret" || file.ACLDatacenter != "dc1" {
+		t.Fatal("agent config is wrong", string(data))
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateKey(key); err != nil {
+		t.Fatal("generated key must be valid", key, err)
+	}
+
+	// 8 bytes
+	if err := ValidateKey("AAAAAAAAAAA="); err == nil {
+		t.Fatal("short key must be rejected")
+	}
+
+	if err := ValidateKey("!!!"); err == nil {
+		t.Fatal("non base64 key must be rejected")
+	}
+}
@@ -26,6 +26,9 @@ func (e Listener) NotifyKeyUpdate(Type netAgent.NotifyUpdateType, key string, va
 }
 func (e Listener) NotifyStoreUpdate(Type netAgent.NotifyUpdateType, store string, data map[string][]byte) {
 
+}
+func (e Listener) NotifyEvent(event netAgent.Event) {
+	log.Println("Event", event.Type, event.Origin, string(event.Payload))
 }
 func main() {
 	isBootstrap := flag.Bool("b", false, "bootstrap")
@@ -0,0 +1,190 @@
+package netAgent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/consul/api"
+)
+
+// Cluster events
+// a small pub/sub on top of consul user events, every event carries a type
+// and a JSON payload. Consul delivers an event at least once and keeps
+// replaying its recent events, so listeners get each event ID only once
+
+// consul user event name used for all cxy-sdn events
+const eventName = "cxy-sdn"
+
+// consul drops user events with a bigger payload
+const maxEventSize = 512
+
+// how many event IDs are remembered per type for dedup
+const eventDedupSize = 1024
+
+type Event struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Origin  string          `json:"origin"` // node the event was published on
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the payload into v
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Publish sends an event of eventType with payload, marshalled as JSON, to
+// every node listening for eventType
+func Publish(eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	origin, _ := os.Hostname()
+	event := Event{Type: eventType, Origin: origin, Payload: data}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxEventSize {
+		return errors.New("event payload too big")
+	}
+
+	// single node, nobody else to tell
+	if _, ok := kvStore.(localWatcher); ok {
+		event.ID, err = newEventID()
+		if err != nil {
+			return err
+		}
+		go notifyEventListeners(event)
+		return nil
+	}
+
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = client.Event().Fire(&api.UserEvent{Name: eventName, Payload: body}, nil)
+	return err
+}
+
+func newEventID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// remembers the last eventDedupSize IDs
+type eventDedup struct {
+	sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+// true the first time id is passed
+func (d *eventDedup) firstSeen(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	if d.seen[id] {
+		return false
+	}
+
+	d.seen[id] = true
+	d.order = append(d.order, id)
+	if len(d.order) > eventDedupSize {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	return true
+}
+
+var eventDedupsLock sync.Mutex
+var eventDedups = make(map[string]*eventDedup)
+
+func getEventDedup(eventType string) *eventDedup {
+	eventDedupsLock.Lock()
+	defer eventDedupsLock.Unlock()
+
+	d, ok := eventDedups[eventType]
+	if !ok {
+		d = &eventDedup{}
+		eventDedups[eventType] = d
+	}
+	return d
+}
+
+func notifyEventListeners(event Event) {
+	if !getEventDedup(event.Type).firstSeen(event.ID) {
+		return
+	}
+
+	for _, listener := range getListeners(WATCH_TYPE_EVENT, event.Type) {
+		listener.NotifyEvent(event)
+	}
+}
+
+func eventsWatch(client *api.Client, index uint64) (uint64, interface{}, error) {
+	events, meta, err := client.Event().List(eventName, &api.QueryOptions{WaitIndex: index})
+	if err != nil {
+		return 0, nil, err
+	}
+	return meta.LastIndex, events, nil
+}
+
+func registerForEvents(eventType string) {
+	if _, ok := kvStore.(localWatcher); ok {
+		// Publish delivers locally
+		return
+	}
+
+	dedup := getEventDedup(eventType)
+	first := true
+
+	handler := func(idx uint64, data interface{}) {
+		userEvents, _ := data.([]*api.UserEvent)
+
+		for _, userEvent := range userEvents {
+			event := Event{}
+			if err := json.Unmarshal(userEvent.Payload, &event); err != nil {
+				glog.Errorf("Error (%v) decoding event %s", err, userEvent.ID)
+				continue
+			}
+			if event.Type != eventType {
+				continue
+			}
+			event.ID = userEvent.ID
+
+			// the first answer holds the events fired before we listened
+			if first {
+				dedup.firstSeen(event.ID)
+				continue
+			}
+			notifyEventListeners(event)
+		}
+		first = false
+	}
+	register(WATCH_TYPE_EVENT, "event "+eventType, eventsWatch, handler)
+}
+
+// listener gets a NotifyEvent for every event of eventType published on any
+// node after the registration, blocks while the consul watch runs
+func RegisterForEvents(eventType string, listener Listener) {
+	wc := addListener(WATCH_TYPE_EVENT, eventType, listener)
+	if wc {
+		registerForEvents(eventType)
+	}
+}
@@ -0,0 +1,137 @@
+package netAgent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventListener struct {
+	events chan Event
+}
+
+func (l eventListener) NotifyNodeUpdate(NotifyUpdateType, string) {}
+
+func (l eventListener) NotifyKeyUpdate(NotifyUpdateType, string, []byte) {}
+
+func (l eventListener) NotifyStoreUpdate(NotifyUpdateType, string, map[string][]byte) {}
+
+func (l eventListener) NotifyEvent(event Event) {
+	l.events <- event
+}
+
+func waitEvent(t *testing.T, l eventListener) Event {
+	select {
+	case event := <-l.events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	return Event{}
+}
+
+func noEvent(t *testing.T, l eventListener) {
+	select {
+	case event := <-l.events:
+		t.Fatal("unexpected event", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type testPayload struct {
+	Network string `json:"network"`
+}
+
+// with a local store events go straight to the listeners of this process
+func TestPublishLocal(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	l := eventListener{make(chan Event, 10)}
+	RegisterForEvents("local-test", l)
+
+	if err := Publish("local-test", testPayload{"net1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	event := waitEvent(t, l)
+	payload := testPayload{}
+	if err := event.Decode(&payload); err != nil || payload.Network != "net1" || event.ID == "" {
+		t.Fatal("wrong event", event, err)
+	}
+
+	// redelivery of the same ID is dropped
+	notifyEventListeners(event)
+	noEvent(t, l)
+
+	if err := Publish("local-test", strings.Repeat("x", maxEventSize)); err == nil {
+		t.Fatal("oversized event must be rejected")
+	}
+}
+
+// consul replays its recent events on every answer, each new event must
+// reach the listener once and old ones never
+func TestEventWatch(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+	defer SetStore(GetStore())
+
+	userEvent := func(id, eventType, network string) string {
+		payload := fmt.Sprintf(`{"type":%q,"origin":"node1","payload":{"network":%q}}`, eventType, network)
+		return fmt.Sprintf(`{"ID":%q,"Name":%q,"Payload":%q}`, id, eventName,
+			base64.StdEncoding.EncodeToString([]byte(payload)))
+	}
+	old := userEvent("11111111-0000-0000-0000-000000000001", "consul-test", "old")
+	fresh := userEvent("11111111-0000-0000-0000-000000000002", "consul-test", "fresh")
+	other := userEvent("11111111-0000-0000-0000-000000000003", "other", "other")
+
+	answers := []string{
+		"[" + old + "]",
+		"[" + old + "," + fresh + "]",
+		"[" + old + "," + fresh + "," + other + "]",
+	}
+
+	var lock sync.Mutex
+	calls := 0
+	done := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/event/list" || r.URL.Query().Get("name") != eventName {
+			http.NotFound(w, r)
+			return
+		}
+
+		lock.Lock()
+		call := calls
+		calls++
+		lock.Unlock()
+
+		if call >= len(answers) {
+			// nothing new, block like consul does
+			<-done
+			call = len(answers) - 1
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(call+1))
+		w.Write([]byte(answers[call]))
+	}))
+	defer ts.Close()
+	defer close(done)
+	defer stopWatches()
+
+	SetConfig(&Config{Address: strings.TrimPrefix(ts.URL, "http://")})
+	SetStore(NewConsulStore())
+
+	l := eventListener{make(chan Event, 10)}
+	go RegisterForEvents("consul-test", l)
+
+	event := waitEvent(t, l)
+	payload := testPayload{}
+	if err := event.Decode(&payload); err != nil || payload.Network != "fresh" || event.Origin != "node1" {
+		t.Fatal("wrong event", event, err)
+	}
+	noEvent(t, l)
+}
@@ -0,0 +1,157 @@
+package netAgent
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/command/agent"
+)
+
+// Gossip keyring
+// the keyring operations go through the agent RPC interface, the agent fans
+// them out to every member of the LAN and WAN pools
+
+// one key of the keyring and how many members of a pool have it installed
+type KeyStatus struct {
+	Key        string `json:"key"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Pool       string `json:"pool"`
+	Nodes      int    `json:"nodes"`
+	TotalNodes int    `json:"totalNodes"`
+}
+
+// check that key is a base64 encoded 16, 24 or 32 bytes AES key
+func ValidateKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("gossip key is not base64 encoded")
+	}
+	if l := len(raw); l != 16 && l != 24 && l != 32 {
+		return fmt.Errorf("gossip key must be 16, 24 or 32 bytes, got %d", l)
+	}
+	return nil
+}
+
+// GenerateKey returns a new random gossip key, like consul keygen
+func GenerateKey() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func rpcClient() (*agent.RPCClient, error) {
+	return agent.NewRPCClient(config.RPCAddr)
+}
+
+// keyringError collects the per node errors of a keyring operation
+func keyringError(infos []agent.KeyringInfo, messages []agent.KeyringMessage) error {
+	var errs []string
+
+	for _, info := range infos {
+		if info.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s %s: %s", info.Datacenter, info.Pool, info.Error))
+		}
+	}
+	for _, msg := range messages {
+		errs = append(errs, fmt.Sprintf("%s %s %s: %s", msg.Datacenter, msg.Pool, msg.Node, msg.Message))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// ListKeys returns every key installed in the LAN and WAN pools
+func ListKeys() ([]KeyStatus, error) {
+	client, err := rpcClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	resp, err := client.ListKeys(config.Token)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyringError(resp.Info, resp.Messages); err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int)
+	for _, info := range resp.Info {
+		totals[info.Datacenter+"/"+info.Pool] = info.NumNodes
+	}
+
+	keys := make([]KeyStatus, 0, len(resp.Keys))
+	for _, entry := range resp.Keys {
+		keys = append(keys, KeyStatus{
+			Key:        entry.Key,
+			Datacenter: entry.Datacenter,
+			Pool:       entry.Pool,
+			Nodes:      entry.Count,
+			TotalNodes: totals[entry.Datacenter+"/"+entry.Pool],
+		})
+	}
+	sort.Sort(byPoolKey(keys))
+	return keys, nil
+}
+
+// InstallKey adds key to the keyring of every member
+func InstallKey(key string) error {
+	return keyringOp(key, func(c *agent.RPCClient) ([]agent.KeyringInfo, []agent.KeyringMessage, error) {
+		resp, err := c.InstallKey(key, config.Token)
+		return resp.Info, resp.Messages, err
+	})
+}
+
+// UseKey makes the installed key the primary one used to encrypt
+func UseKey(key string) error {
+	return keyringOp(key, func(c *agent.RPCClient) ([]agent.KeyringInfo, []agent.KeyringMessage, error) {
+		resp, err := c.UseKey(key, config.Token)
+		return resp.Info, resp.Messages, err
+	})
+}
+
+// RemoveKey drops key from every member, the primary key can't be removed
+func RemoveKey(key string) error {
+	return keyringOp(key, func(c *agent.RPCClient) ([]agent.KeyringInfo, []agent.KeyringMessage, error) {
+		resp, err := c.RemoveKey(key, config.Token)
+		return resp.Info, resp.Messages, err
+	})
+}
+
+func keyringOp(key string, op func(c *agent.RPCClient) ([]agent.KeyringInfo, []agent.KeyringMessage, error)) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	client, err := rpcClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	infos, messages, err := op(client)
+	if err != nil {
+		return err
+	}
+	return keyringError(infos, messages)
+}
+
+type byPoolKey []KeyStatus
+
+func (s byPoolKey) Len() int { return len(s) }
+func (s byPoolKey) Less(i, j int) bool {
+	if s[i].Pool != s[j].Pool {
+		return s[i].Pool < s[j].Pool
+	}
+	return s[i].Key < s[j].Key
+}
+func (s byPoolKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,119 @@
+package netAgent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/consul/api"
+)
+
+// Leader election
+// the leader of a key holds a consul lock bound to a session of its agent,
+// when the node dies the session expires and another candidate gets the lock
+
+const (
+	leaderKeyPrefix     = "_cxy_leader/"
+	leaderSessionTTL    = "15s"
+	leaderRetryInterval = 5 * time.Second
+)
+
+var leadersLock sync.Mutex
+var leaders = make(map[string]bool)
+
+func setLeader(key string, leader bool) {
+	leadersLock.Lock()
+	defer leadersLock.Unlock()
+
+	leaders[key] = leader
+}
+
+// IsLeader tells if this node currently leads key
+func IsLeader(key string) bool {
+	leadersLock.Lock()
+	defer leadersLock.Unlock()
+
+	return leaders[key]
+}
+
+// RunForLeader campaigns for key until stopCh is closed. Every time this
+// node is elected, lead is called and must return soon after lostCh is
+// closed, which happens on lost leadership or on stop.
+// With a store living in this process there is only one node, it leads
+// right away
+func RunForLeader(key string, stopCh <-chan struct{}, lead func(lostCh <-chan struct{})) {
+	if _, ok := kvStore.(localWatcher); ok {
+		setLeader(key, true)
+		lead(stopCh)
+		setLeader(key, false)
+		return
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		if err := campaign(key, stopCh, lead); err != nil {
+			glog.Errorf("Error (%v) running for leader of %s, retry in %v", err, key, leaderRetryInterval)
+			select {
+			case <-time.After(leaderRetryInterval):
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
+
+// one term, blocks until the lock is acquired and lost again
+func campaign(key string, stopCh <-chan struct{}, lead func(lostCh <-chan struct{})) error {
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+
+	lock, err := client.LockOpts(&api.LockOptions{
+		Key:         leaderKeyPrefix + key,
+		SessionName: "cxy-sdn leader " + key,
+		SessionTTL:  leaderSessionTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	// fails until raft has a leader, the caller retries
+	lockLost, err := lock.Lock(stopCh)
+	if err != nil || lockLost == nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	glog.Infof("Elected leader of %s", key)
+
+	lostCh := make(chan struct{})
+	go func() {
+		select {
+		case <-lockLost:
+		case <-stopCh:
+		}
+		close(lostCh)
+	}()
+
+	setLeader(key, true)
+	lead(lostCh)
+	setLeader(key, false)
+
+	glog.Infof("Stepped down as leader of %s", key)
+	return nil
+}
+
+// ForceLeave moves a failed node to the left state, so the catalog drops it
+func ForceLeave(node string) error {
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	return client.Agent().ForceLeave(node)
+}
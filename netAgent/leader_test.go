@@ -0,0 +1,45 @@
+package netAgent
+
+import (
+	"testing"
+	"time"
+)
+
+// a store in this process means a single node, it leads right away
+func TestRunForLeaderLocal(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	stopCh := make(chan struct{})
+	elected := make(chan bool)
+	done := make(chan struct{})
+
+	go func() {
+		RunForLeader("test", stopCh, func(lostCh <-chan struct{}) {
+			elected <- IsLeader("test")
+			<-lostCh
+		})
+		close(done)
+	}()
+
+	select {
+	case leader := <-elected:
+		if !leader {
+			t.Fatal("IsLeader must be true while leading")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("never elected")
+	}
+
+	close(stopCh)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunForLeader did not return after stop")
+	}
+
+	if IsLeader("test") {
+		t.Fatal("IsLeader must be false after stop")
+	}
+}
@@ -3,26 +3,19 @@
 package netAgent
 
 import (
-	"bytes"
-	b64 "encoding/base64"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
-	"net/http"
 	"os"
 	"reflect"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/command"
-	"github.com/hashicorp/consul/watch"
 	"github.com/mitchellh/cli"
 )
 
@@ -50,11 +43,17 @@ func StartAgent(serverMode bool, expectServerNum string, bindInterface string, d
 
 	}
 
+	extraArgs, err := agentArgs(dataDir)
+	if err != nil {
+		glog.Errorf("Error writing agent config : %v", err)
+		return err
+	}
+
 	errChan := make(chan int)
 
 	watchForExistingRegisteredUpdates()
 
-	go startConsul(serverMode, expectServerNum, bindAddr, dataDir, errChan)
+	go startConsul(serverMode, expectServerNum, bindAddr, dataDir, extraArgs, errChan)
 
 	select {
 	case <-errChan:
@@ -64,7 +63,7 @@ func StartAgent(serverMode bool, expectServerNum string, bindInterface string, d
 	return nil
 }
 
-func startConsul(serverMode bool, expectServerNum string, bindAddress string, dataDir string, eCh chan int) {
+func startConsul(serverMode bool, expectServerNum string, bindAddress string, dataDir string, extraArgs []string, eCh chan int) {
 	args := []string{"agent", "-data-dir", dataDir}
 
 	if serverMode {
@@ -78,7 +77,7 @@ func startConsul(serverMode bool, expectServerNum string, bindAddress string, da
 		args = append(args, "-advertise")
 		args = append(args, bindAddress)
 	}
-	args = append(args)
+	args = append(args, extraArgs...)
 
 	ret := Execute(args...)
 
@@ -102,12 +101,35 @@ func Execute(args ...string) int {
 	return exitCode
 }
 
-const CONSUL_CATALOG_BASE_URL = "http://localhost:8500/v1/catalog/"
-
 // Node operation related
 type Node struct {
-	Name    string `json:"Name,omitempty"`
-	Address string `json:"Addr,ommitempty"`
+	Name    string `json:"Node,omitempty"`
+	Address string `json:"Address,omitempty"`
+}
+
+// serf member status
+const (
+	NODE_STATUS_NONE    = "none"
+	NODE_STATUS_ALIVE   = "alive"
+	NODE_STATUS_LEAVING = "leaving"
+	NODE_STATUS_LEFT    = "left"
+	NODE_STATUS_FAILED  = "failed"
+)
+
+var nodeStatus = []string{NODE_STATUS_NONE, NODE_STATUS_ALIVE, NODE_STATUS_LEAVING, NODE_STATUS_LEFT, NODE_STATUS_FAILED}
+
+const (
+	NODE_ROLE_SERVER = "server"
+	NODE_ROLE_CLIENT = "client"
+)
+
+// NodeInfo is one cluster member as seen by the local agent
+type NodeInfo struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Role    string `json:"role"`
+	Status  string `json:"status"`
+	Leader  bool   `json:"leader"`
 }
 
 func Join(addr string) error {
@@ -137,9 +159,9 @@ func Leave() error {
 }
 
 func getNodes() ([]Node, error) {
-	url := CONSUL_CATALOG_BASE_URL + "nodes"
+	url := catalogBaseURL() + "nodes"
 
-	resp, err := http.Get(url)
+	resp, err := httpGet(url)
 	if err != nil {
 		glog.Errorf("Error (%v) get %s", err, url)
 		return nil, errors.New("Get nodes failed")
@@ -149,9 +171,13 @@ func getNodes() ([]Node, error) {
 
 	glog.Infof("Get %s for %s\n", resp.Status, url)
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.New("Get nodes failed: " + resp.Status)
+	}
+
 	var nodes []Node
 
-	err = json.NewDecoder(resp.Body).Decode(nodes)
+	err = json.NewDecoder(resp.Body).Decode(&nodes)
 
 	if err != nil {
 		glog.Errorf("getNodes failed error decoding")
@@ -162,145 +188,71 @@ func getNodes() ([]Node, error) {
 
 }
 
-// K/V store
-
-const CONSUL_KV_BASE_URL = "http://localhost:8500/v1/kv/"
-
-type KVRespBody struct {
-	CreateIndex int    `json:"CreateIndex,omitempty"`
-	ModifyIndex int    `json:"ModifyIndex,omitempty"`
-	Key         string `json:"Key,omitempty"`
-	Flags       int    `json:"Flags,omitempty"`
-	Value       string `json:"Value,omitempty"`
-}
-
-// 1st return value as []byte
-// 2nd return its ModifyIndex
-// 3rd return ok or not
-func Get(store string, key string) ([]byte, int, bool) {
-	url := CONSUL_KV_BASE_URL + store + "/" + key
-
-	resp, err := http.Get(url)
-
+// ClusterNodes returns every node of the catalog and the gossip pool,
+// sorted by name, with its role, serf status and whether it is the raft leader
+func ClusterNodes() ([]NodeInfo, error) {
+	client, err := apiClient()
 	if err != nil {
-		glog.Errorf("Error (%v) in Get for %s\n", err, url)
-		return nil, 0, false
+		return nil, err
 	}
 
-	defer resp.Body.Close()
-
-	//glog.Infof("Status of Get %s for %s", resp.Status, url)
-
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		var jsonBody []KVRespBody
-
-		err = json.NewDecoder(resp.Body).Decode(&jsonBody)
-
-		existingValue, err := b64.StdEncoding.DecodeString(jsonBody[0].Value)
-
-		if err != nil {
-			return nil, jsonBody[0].ModifyIndex, false
-		}
-
-		return existingValue, jsonBody[0].ModifyIndex, true
-
+	members, err := client.Agent().Members(false)
+	if err != nil {
+		return nil, err
 	}
-	return nil, 0, false
-
-}
-
-// get all key-value pairs in one store from backend
-func GetAll(store string) ([][]byte, []int, bool) {
-	url := CONSUL_KV_BASE_URL + store + "?recurse"
 
-	resp, err := http.Get(url)
+	// no leader during an election, not an error
+	leader, _ := client.Status().Leader()
 
+	catalog, err := getNodes()
 	if err != nil {
-		glog.Infof("Error in Get all KV %v", store)
-		return nil, nil, false
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		var jsonBody []KVRespBody
-
-		values := make([][]byte, 0)
-		indexes := make([]int, 0)
 
-		err = json.NewDecoder(resp.Body).Decode(&jsonBody)
+	infos := make(map[string]*NodeInfo)
 
-		for _, body := range jsonBody {
-			existingVal, _ := b64.StdEncoding.DecodeString(body.Value)
-			values = append(values, existingVal)
-			indexes = append(indexes, body.ModifyIndex)
+	for _, node := range catalog {
+		infos[node.Name] = &NodeInfo{
+			Name:    node.Name,
+			Address: node.Address,
+			Role:    NODE_ROLE_CLIENT,
+			Status:  NODE_STATUS_NONE,
 		}
-
-		return values, indexes, true
 	}
-	return nil, nil, false
 
-}
-
-const (
-	OK = iota
-	OUTDATED
-	ERROR
-)
-
-// return val indicate the error type
-// need old val as 4-th param
-func Put(store string, key string, value []byte, oldVal []byte) int {
-
-	existingVal, casIndex, ok := Get(store, key)
-
-	if ok && !bytes.Equal(oldVal, existingVal) {
-		return OUTDATED
-	}
-
-	url := CONSUL_KV_BASE_URL + store + "/" + key + "?cas=" + strconv.Itoa(casIndex)
-	//glog.Infof("Updating KV pair for %s %s %s %d", url, key, value, casIndex)
-
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(value))
+	for _, m := range members {
+		info := &NodeInfo{
+			Name:    m.Name,
+			Address: m.Addr,
+			Role:    NODE_ROLE_CLIENT,
+			Status:  NODE_STATUS_NONE,
+		}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+		if m.Status >= 0 && m.Status < len(nodeStatus) {
+			info.Status = nodeStatus[m.Status]
+		}
 
-	if err != nil {
-		glog.Errorf("Error creating KV pair for %s", key)
-		return ERROR
+		// consul servers gossip with role "consul", clients with "node"
+		if m.Tags["role"] == "consul" {
+			info.Role = NODE_ROLE_SERVER
+			info.Leader = leader != "" && leader == net.JoinHostPort(m.Addr, m.Tags["port"])
+		}
+		infos[m.Name] = info
 	}
 
-	defer resp.Body.Close()
-
-	body, _ := ioutil.ReadAll(resp.Body)
-
-	if string(body) == "false" {
-		return ERROR
+	nodes := make([]NodeInfo, 0, len(infos))
+	for _, info := range infos {
+		nodes = append(nodes, *info)
 	}
-
-	return OK
-
+	sort.Sort(byName(nodes))
+	return nodes, nil
 }
 
-// return val indicate the error type
-func Delete(store string, key string) int {
-	url := fmt.Sprintf("%s%s/%s", CONSUL_KV_BASE_URL, store, key)
-
-	glog.Infof("Deleting KV pair for %s", url)
+type byName []NodeInfo
 
-	req, err := http.NewRequest("DELETE", url, nil)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	if err != nil {
-		glog.Errorf("Error deleting KV pair %s", key)
-		return ERROR
-	}
-
-	defer resp.Body.Close()
-	return OK
-}
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 // Watch related
 
@@ -323,15 +275,19 @@ type WatchType int
 
 type watchData struct {
 	listeners  map[string][]Listener
-	watchPlans []*watch.WatchPlan
+	watchPlans []*watchPlan
 }
 
 var watches map[WatchType]watchData = make(map[WatchType]watchData)
 
+// guards watches, listeners are added while watch handlers run
+var watchLock sync.RWMutex
+
 type Listener interface {
 	NotifyNodeUpdate(NotifyUpdateType, string)
 	NotifyKeyUpdate(NotifyUpdateType, string, []byte)
 	NotifyStoreUpdate(NotifyUpdateType, string, map[string][]byte)
+	NotifyEvent(Event)
 }
 
 func contains(wType WatchType, key string, elem interface{}) bool {
@@ -360,11 +316,14 @@ func contains(wType WatchType, key string, elem interface{}) bool {
 type watchconsul bool
 
 func addListener(wtype WatchType, key string, listener Listener) watchconsul {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
 	var wc watchconsul = false
-	if !contains(WATCH_TYPE_NODE, key, listener) {
+	if !contains(wtype, key, listener) {
 		ws, ok := watches[wtype]
 		if !ok {
-			watches[wtype] = watchData{make(map[string][]Listener), make([]*watch.WatchPlan, 0)}
+			watches[wtype] = watchData{make(map[string][]Listener), make([]*watchPlan, 0)}
 			ws = watches[wtype]
 		}
 
@@ -379,6 +338,9 @@ func addListener(wtype WatchType, key string, listener Listener) watchconsul {
 }
 
 func getListeners(wtype WatchType, key string) []Listener {
+	watchLock.RLock()
+	defer watchLock.RUnlock()
+
 	ws, ok := watches[wtype]
 	if !ok {
 		return nil
@@ -391,7 +353,10 @@ func getListeners(wtype WatchType, key string) []Listener {
 	return nil
 }
 
-func addWatchPlan(wtype WatchType, wp *watch.WatchPlan) {
+func addWatchPlan(wtype WatchType, wp *watchPlan) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
 	ws, ok := watches[wtype]
 	if !ok {
 		return
@@ -402,6 +367,9 @@ func addWatchPlan(wtype WatchType, wp *watch.WatchPlan) {
 }
 
 func stopWatches() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
 	for _, ws := range watches {
 		for _, wp := range ws.watchPlans {
 			wp.Stop()
@@ -410,20 +378,13 @@ func stopWatches() {
 	}
 }
 
-func register(wtype WatchType, params map[string]interface{}, handler watch.HandlerFunc) {
+func register(wtype WatchType, name string, fn watchFunc, handler watchHandler) {
 	// Create the watch
-	wp, err := watch.Parse(params)
-	if err != nil {
-		log.Printf("Register error : %s", err)
-		return
-	}
+	wp := newWatchPlan(name, fn, handler)
 	addWatchPlan(wtype, wp)
-	wp.Handler = handler
-	cmdFlags := flag.NewFlagSet("watch", flag.ContinueOnError)
-	httpAddr := command.HTTPAddrFlag(cmdFlags)
 	// Run the watch
-	if err := wp.Run(*httpAddr); err != nil {
-		log.Printf("Error querying Consul agent: %s", err)
+	if err := wp.Run(); err != nil {
+		glog.Errorf("Error querying Consul agent: %s", err)
 	}
 }
 
@@ -500,13 +461,10 @@ func updateKeyListeners(idx uint64, key string, data interface{}) {
 }
 
 func registerForNodeUpdates() {
-	// Compile the watch parameters
-	params := make(map[string]interface{})
-	params["type"] = "nodes"
 	handler := func(idx uint64, data interface{}) {
 		updateNodeListeners(data.([]*api.Node))
 	}
-	register(WATCH_TYPE_NODE, params, handler)
+	register(WATCH_TYPE_NODE, "nodes", nodesWatch, handler)
 }
 
 func RegisterForNodeUpdates(listener Listener) {
@@ -517,13 +475,10 @@ func RegisterForNodeUpdates(listener Listener) {
 }
 
 func registerForKeyUpdates(absKey string) {
-	params := make(map[string]interface{})
-	params["type"] = "key"
-	params["key"] = absKey
 	handler := func(idx uint64, data interface{}) {
 		updateKeyListeners(idx, absKey, data)
 	}
-	register(WATCH_TYPE_KEY, params, handler)
+	register(WATCH_TYPE_KEY, "key "+absKey, keyWatch(absKey), handler)
 }
 
 func RegisterForKeyUpdates(store string, key string, listener Listener) {
@@ -535,16 +490,29 @@ func RegisterForKeyUpdates(store string, key string, listener Listener) {
 }
 
 func registerForStoreUpdates(store string) {
-	// Compile the watch parameters
-	params := make(map[string]interface{})
-	params["type"] = "keyprefix"
-	params["prefix"] = store + "/"
+	if w, ok := kvStore.(localWatcher); ok {
+		registerForLocalStoreUpdates(w, store)
+		return
+	}
+
 	handler := func(idx uint64, data interface{}) {
-		log.Println("NOT IMPLEMENTED Store Update :", idx, data)
+		kvs, _ := data.(api.KVPairs)
+		pairs := make([]KVPair, 0, len(kvs))
+
+		for _, kv := range kvs {
+			pairs = append(pairs, KVPair{
+				Key:         strings.TrimPrefix(kv.Key, store+"/"),
+				Value:       kv.Value,
+				ModifyIndex: int(kv.ModifyIndex),
+			})
+		}
+		updateStoreListeners(store, pairs)
 	}
-	register(WATCH_TYPE_STORE, params, handler)
+	register(WATCH_TYPE_STORE, "keyprefix "+store, keyprefixWatch(store+"/"), handler)
 }
 
+// listener gets a NotifyStoreUpdate for every key added, modified or
+// deleted under store, blocks while the consul watch runs
 func RegisterForStoreUpdates(store string, listener Listener) {
 	wc := addListener(WATCH_TYPE_STORE, store, listener)
 	if wc {
@@ -554,9 +522,9 @@ func RegisterForStoreUpdates(store string, listener Listener) {
 
 func watchForExistingRegisteredUpdates() {
 	for wType, ws := range watches {
-		glog.Infof("watchForExistingRegisteredUpdates : ", wType)
+		glog.Infof("watchForExistingRegisteredUpdates : %v", wType)
 		for key, _ := range ws.listeners {
-			glog.Infof("key : ", key)
+			glog.Infof("key : %s", key)
 			switch wType {
 			case WATCH_TYPE_NODE:
 				go registerForNodeUpdates()
@@ -564,6 +532,8 @@ func watchForExistingRegisteredUpdates() {
 				go registerForKeyUpdates(key)
 			case WATCH_TYPE_STORE:
 				go registerForStoreUpdates(key)
+			case WATCH_TYPE_EVENT:
+				go registerForEvents(key)
 			}
 		}
 	}
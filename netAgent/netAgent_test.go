@@ -3,7 +3,10 @@ package netAgent
 import (
 	"bytes"
 	"flag"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -81,3 +84,48 @@ func TestCleanup(t *testing.T) {
 	Delete("haha", "test")
 	Leave()
 }
+
+// fake agent answering the catalog, members and leader queries
+func TestClusterNodes(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			w.Write([]byte(`[{"Node":"node1","Address":"10.0.0.1"},{"Node":"node2","Address":"10.0.0.2"},{"Node":"stale","Address":"10.0.0.9"}]`))
+		case "/v1/agent/members":
+			w.Write([]byte(`[{"Name":"node2","Addr":"10.0.0.2","Tags":{"role":"node"},"Status":4},
+				{"Name":"node1","Addr":"10.0.0.1","Tags":{"role":"consul","port":"8300"},"Status":1}]`))
+		case "/v1/status/leader":
+			w.Write([]byte(`"10.0.0.1:8300"`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	if err := SetConfig(&Config{Address: strings.TrimPrefix(ts.URL, "http://")}); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := getNodes()
+	if err != nil || len(catalog) != 3 || catalog[0].Name != "node1" || catalog[0].Address != "10.0.0.1" {
+		t.Fatal("getNodes decoded wrong", catalog, err)
+	}
+
+	nodes, err := ClusterNodes()
+	if err != nil || len(nodes) != 3 {
+		t.Fatal("ClusterNodes failed", nodes, err)
+	}
+
+	expected := []NodeInfo{
+		{"node1", "10.0.0.1", NODE_ROLE_SERVER, NODE_STATUS_ALIVE, true},
+		{"node2", "10.0.0.2", NODE_ROLE_CLIENT, NODE_STATUS_FAILED, false},
+		{"stale", "10.0.0.9", NODE_ROLE_CLIENT, NODE_STATUS_NONE, false},
+	}
+	for i := range expected {
+		if nodes[i] != expected[i] {
+			t.Fatalf("node %d: expected %+v, got %+v", i, expected[i], nodes[i])
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package netAgent
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// Service catalog
+// services are registered with the local agent, they show up in the catalog
+// and in consul DNS as name.service.consul
+
+// RegisterService registers id as an instance of service name on this node
+func RegisterService(id string, name string, address string, tags []string) error {
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+
+	return client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      id,
+		Name:    name,
+		Address: address,
+		Tags:    tags,
+	})
+}
+
+func DeregisterService(id string) error {
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	return client.Agent().ServiceDeregister(id)
+}
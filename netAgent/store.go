@@ -0,0 +1,146 @@
+package netAgent
+
+import "bytes"
+
+// K/V store
+// every store is a flat namespace of keys, the backend behind the
+// package level Get/GetAll/Put/Delete functions can be swapped with SetStore
+
+const (
+	OK = iota
+	OUTDATED
+	ERROR
+)
+
+// a single key/value pair of a store with its ModifyIndex
+type KVPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex int
+}
+
+// Store is the datastore backend used by the netAgent K/V functions
+type Store interface {
+	// 1st return value as []byte
+	// 2nd return its ModifyIndex
+	// 3rd return ok or not
+	Get(store string, key string) ([]byte, int, bool)
+
+	// like Get, but tells a missing key from a failed read: a missing key
+	// is OK with index 0, a failed read is ERROR
+	Lookup(store string, key string) ([]byte, int, int)
+
+	// return all key-value pairs in one store, keys are relative to the store
+	List(store string) ([]KVPair, bool)
+
+	// compare-and-swap, the value is only written when the key's
+	// ModifyIndex still equals index, index 0 means the key must not exist
+	// return val indicate the error type OK/OUTDATED/ERROR
+	CAS(store string, key string, value []byte, index int) int
+
+	// return val indicate the error type
+	Delete(store string, key string) int
+
+	// delete the key only when its ModifyIndex still equals index, a
+	// missing key is OK, OUTDATED when it was modified meanwhile
+	DeleteCAS(store string, key string, index int) int
+
+	// apply all ops or none of them, OUTDATED when any index check fails
+	Txn(ops []TxnOp) int
+}
+
+// one write of a transaction, every op is checked like CAS: the key's
+// ModifyIndex must equal Index, 0 means the key must not exist
+type TxnOp struct {
+	Store  string
+	Key    string
+	Value  []byte
+	Index  int
+	Delete bool // delete the key instead of writing Value
+}
+
+var kvStore Store = NewConsulStore()
+
+// SetStore replaces the backend used by Get/GetAll/Put/Delete
+func SetStore(s Store) {
+	kvStore = s
+}
+
+// GetStore returns the backend currently in use
+func GetStore() Store {
+	return kvStore
+}
+
+func Get(store string, key string) ([]byte, int, bool) {
+	return kvStore.Get(store, key)
+}
+
+// read a key, index 0 when it doesn't exist, ERROR when the store can't
+// be read
+func Lookup(store string, key string) ([]byte, int, int) {
+	return kvStore.Lookup(store, key)
+}
+
+// get all key-value pairs in one store from backend
+func GetAll(store string) ([][]byte, []int, bool) {
+	pairs, ok := kvStore.List(store)
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	values := make([][]byte, 0, len(pairs))
+	indexes := make([]int, 0, len(pairs))
+
+	for _, pair := range pairs {
+		values = append(values, pair.Value)
+		indexes = append(indexes, pair.ModifyIndex)
+	}
+	return values, indexes, true
+}
+
+// get all key-value pairs in one store together with their keys
+func List(store string) ([]KVPair, bool) {
+	return kvStore.List(store)
+}
+
+// return val indicate the error type
+// need old val as 4-th param
+// Put compares values, so a writer that read the key earlier may still
+// overwrite a concurrent update, use CAS with the index returned by Get
+// when that matters
+func Put(store string, key string, value []byte, oldVal []byte) int {
+	existingVal, index, ok := kvStore.Get(store, key)
+
+	if ok && !bytes.Equal(oldVal, existingVal) {
+		return OUTDATED
+	}
+
+	if !ok {
+		index = 0
+	}
+	return kvStore.CAS(store, key, value, index)
+}
+
+// write value only if the key was not modified since Get returned index,
+// OUTDATED means somebody else won the race and the caller should re-read
+func CAS(store string, key string, value []byte, index int) int {
+	return kvStore.CAS(store, key, value, index)
+}
+
+// return val indicate the error type
+func Delete(store string, key string) int {
+	return kvStore.Delete(store, key)
+}
+
+// delete the key only if it was not modified since Get returned index,
+// cheaper than a single op Txn
+func DeleteCAS(store string, key string, index int) int {
+	return kvStore.DeleteCAS(store, key, index)
+}
+
+// apply several CAS writes and deletes atomically, OUTDATED means one of
+// the keys was modified since it was read and nothing was written
+func Txn(ops ...TxnOp) int {
+	return kvStore.Txn(ops)
+}
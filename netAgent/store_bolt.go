@@ -0,0 +1,250 @@
+package netAgent
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// the bucket keeping the store wide modify index
+var boltMetaBucket = []byte("_cxy_meta")
+
+// boltStore keeps the K/V pairs in an embedded boltdb file, one bucket per
+// store. It lets a single node run without a consul agent
+type boltStore struct {
+	db      *bolt.DB
+	watches localWatches
+}
+
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// every value is stored as 8 bytes of ModifyIndex followed by the data
+func encodeBoltValue(index uint64, value []byte) []byte {
+	buf := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf, index)
+	copy(buf[8:], value)
+	return buf
+}
+
+func decodeBoltValue(raw []byte) ([]byte, int) {
+	if len(raw) < 8 {
+		return nil, 0
+	}
+	return copyBytes(raw[8:]), int(binary.BigEndian.Uint64(raw))
+}
+
+func (s *boltStore) Get(store string, key string) ([]byte, int, bool) {
+	value, index, result := s.Lookup(store, key)
+	if result != OK || index == 0 {
+		return nil, 0, false
+	}
+	return value, index, true
+}
+
+func (s *boltStore) Lookup(store string, key string) ([]byte, int, int) {
+	var value []byte
+	var index int
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(store))
+		if b == nil {
+			return nil
+		}
+		raw := b.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		value, index = decodeBoltValue(raw)
+		return nil
+	})
+
+	if err != nil {
+		glog.Errorf("Error (%v) in Get for %s/%s", err, store, key)
+		return nil, 0, ERROR
+	}
+	return value, index, OK
+}
+
+func (s *boltStore) List(store string) ([]KVPair, bool) {
+	pairs := make([]KVPair, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(store))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			value, index := decodeBoltValue(v)
+			pairs = append(pairs, KVPair{string(k), value, index})
+			return nil
+		})
+	})
+
+	if err != nil {
+		glog.Errorf("Error (%v) in Get all KV %s", err, store)
+		return nil, false
+	}
+	return pairs, true
+}
+
+var errBoltOutdated = errors.New("value outdated")
+
+func (s *boltStore) CAS(store string, key string, value []byte, index int) int {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(store))
+		if err != nil {
+			return err
+		}
+
+		existingIndex := 0
+		if raw := b.Get([]byte(key)); raw != nil {
+			_, existingIndex = decodeBoltValue(raw)
+		}
+		if existingIndex != index {
+			return errBoltOutdated
+		}
+
+		next, err := tx.Bucket(boltMetaBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), encodeBoltValue(next, value))
+	})
+
+	if err == errBoltOutdated {
+		return OUTDATED
+	}
+	if err != nil {
+		glog.Errorf("Error (%v) creating KV pair for %s/%s", err, store, key)
+		return ERROR
+	}
+
+	s.watches.notify(store)
+	return OK
+}
+
+func (s *boltStore) Delete(store string, key string) int {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(store))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+
+	if err != nil {
+		glog.Errorf("Error (%v) deleting KV pair %s/%s", err, store, key)
+		return ERROR
+	}
+
+	s.watches.notify(store)
+	return OK
+}
+
+func (s *boltStore) DeleteCAS(store string, key string, index int) int {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(store))
+		if b == nil {
+			return nil
+		}
+
+		raw := b.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		if _, existingIndex := decodeBoltValue(raw); existingIndex != index {
+			return errBoltOutdated
+		}
+		return b.Delete([]byte(key))
+	})
+
+	if err == errBoltOutdated {
+		return OUTDATED
+	}
+	if err != nil {
+		glog.Errorf("Error (%v) deleting KV pair %s/%s", err, store, key)
+		return ERROR
+	}
+
+	s.watches.notify(store)
+	return OK
+}
+
+// all ops run in one bolt transaction, a failed check rolls back the writes
+// done before it
+func (s *boltStore) Txn(ops []TxnOp) int {
+	touched := make(map[string]bool)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			b, err := tx.CreateBucketIfNotExists([]byte(op.Store))
+			if err != nil {
+				return err
+			}
+
+			existingIndex := 0
+			if raw := b.Get([]byte(op.Key)); raw != nil {
+				_, existingIndex = decodeBoltValue(raw)
+			}
+			if existingIndex != op.Index {
+				return errBoltOutdated
+			}
+
+			if op.Delete {
+				err = b.Delete([]byte(op.Key))
+			} else {
+				var next uint64
+				next, err = tx.Bucket(boltMetaBucket).NextSequence()
+				if err == nil {
+					err = b.Put([]byte(op.Key), encodeBoltValue(next, op.Value))
+				}
+			}
+			if err != nil {
+				return err
+			}
+			touched[op.Store] = true
+		}
+		return nil
+	})
+
+	if err == errBoltOutdated {
+		return OUTDATED
+	}
+	if err != nil {
+		glog.Errorf("Error (%v) in transaction", err)
+		return ERROR
+	}
+
+	for store := range touched {
+		s.watches.notify(store)
+	}
+	return OK
+}
+
+func (s *boltStore) watchStore(store string, handler func()) {
+	s.watches.watchStore(store, handler)
+}
+
+// Close releases the boltdb file lock
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
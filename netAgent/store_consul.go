@@ -0,0 +1,208 @@
+package netAgent
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+type KVRespBody struct {
+	CreateIndex int    `json:"CreateIndex,omitempty"`
+	ModifyIndex int    `json:"ModifyIndex,omitempty"`
+	Key         string `json:"Key,omitempty"`
+	Flags       int    `json:"Flags,omitempty"`
+	Value       string `json:"Value,omitempty"`
+}
+
+// consulStore keeps the K/V pairs in the consul agent started by StartAgent
+type consulStore struct{}
+
+func NewConsulStore() Store {
+	return &consulStore{}
+}
+
+func (s *consulStore) Get(store string, key string) ([]byte, int, bool) {
+	value, index, result := s.Lookup(store, key)
+	if result != OK || index == 0 {
+		return nil, 0, false
+	}
+	return value, index, true
+}
+
+func (s *consulStore) Lookup(store string, key string) ([]byte, int, int) {
+	url := kvBaseURL() + store + "/" + key
+
+	resp, err := httpGet(url)
+
+	if err != nil {
+		glog.Errorf("Error (%v) in Get for %s\n", err, url)
+		return nil, 0, ERROR
+	}
+
+	defer resp.Body.Close()
+
+	//glog.Infof("Status of Get %s for %s", resp.Status, url)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, OK
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var jsonBody []KVRespBody
+
+		err = json.NewDecoder(resp.Body).Decode(&jsonBody)
+
+		if err != nil || len(jsonBody) == 0 {
+			return nil, 0, ERROR
+		}
+
+		existingValue, err := b64.StdEncoding.DecodeString(jsonBody[0].Value)
+
+		if err != nil {
+			return nil, 0, ERROR
+		}
+
+		return existingValue, jsonBody[0].ModifyIndex, OK
+
+	}
+	return nil, 0, ERROR
+
+}
+
+func (s *consulStore) List(store string) ([]KVPair, bool) {
+	url := kvBaseURL() + store + "/?recurse"
+
+	resp, err := httpGet(url)
+
+	if err != nil {
+		glog.Infof("Error in Get all KV %v", store)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	// consul answers 404 for an empty prefix
+	if resp.StatusCode == http.StatusNotFound {
+		return []KVPair{}, true
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var jsonBody []KVRespBody
+
+		pairs := make([]KVPair, 0)
+
+		if err = json.NewDecoder(resp.Body).Decode(&jsonBody); err != nil {
+			return nil, false
+		}
+
+		for _, body := range jsonBody {
+			existingVal, _ := b64.StdEncoding.DecodeString(body.Value)
+			pairs = append(pairs, KVPair{
+				Key:         strings.TrimPrefix(body.Key, store+"/"),
+				Value:       existingVal,
+				ModifyIndex: body.ModifyIndex,
+			})
+		}
+
+		return pairs, true
+	}
+	return nil, false
+
+}
+
+func (s *consulStore) CAS(store string, key string, value []byte, index int) int {
+	url := kvBaseURL() + store + "/" + key + "?cas=" + strconv.Itoa(index)
+	//glog.Infof("Updating KV pair for %s %s %s %d", url, key, value, index)
+
+	req, err := newRequest("PUT", url, bytes.NewBuffer(value))
+	if err != nil {
+		glog.Errorf("Error creating KV pair for %s", key)
+		return ERROR
+	}
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		glog.Errorf("Error creating KV pair for %s", key)
+		return ERROR
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		glog.Errorf("Error (%s) creating KV pair for %s: %s", resp.Status, key, body)
+		return ERROR
+	}
+
+	// consul answers false when the ModifyIndex didn't match
+	if strings.TrimSpace(string(body)) == "false" {
+		return OUTDATED
+	}
+
+	return OK
+
+}
+
+func (s *consulStore) Delete(store string, key string) int {
+	url := fmt.Sprintf("%s%s/%s", kvBaseURL(), store, key)
+
+	glog.Infof("Deleting KV pair for %s", url)
+
+	req, err := newRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Errorf("Error deleting KV pair %s", key)
+		return ERROR
+	}
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		glog.Errorf("Error deleting KV pair %s", key)
+		return ERROR
+	}
+
+	defer resp.Body.Close()
+	return OK
+}
+
+// consul deletes with ?cas= only when the ModifyIndex matches, a missing key
+// counts as deleted
+func (s *consulStore) DeleteCAS(store string, key string, index int) int {
+	url := kvBaseURL() + store + "/" + key + "?cas=" + strconv.Itoa(index)
+
+	req, err := newRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Errorf("Error deleting KV pair %s", key)
+		return ERROR
+	}
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		glog.Errorf("Error deleting KV pair %s", key)
+		return ERROR
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		glog.Errorf("Error (%s) deleting KV pair %s: %s", resp.Status, key, body)
+		return ERROR
+	}
+
+	if strings.TrimSpace(string(body)) == "false" {
+		return OUTDATED
+	}
+
+	return OK
+}
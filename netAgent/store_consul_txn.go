@@ -0,0 +1,250 @@
+package netAgent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/consul/api"
+)
+
+// Consul transactions
+// consul 0.6 has no /v1/txn, so a transaction takes a cluster wide lock,
+// checks every index, writes an undo journal and then applies the ops one
+// by one with CAS. If an op fails the applied ones are undone, if the node
+// dies midway the next transaction finds the journal and undoes it.
+// The journal of a big transaction (a snapshot restore) does not fit in one
+// consul value, so it is split over _cxy_txn/journal/0, /1, ...
+
+const (
+	txnLockKey    = "_cxy_txn/lock"
+	txnJournalKey = "_cxy_txn/journal"
+	txnLockWait   = 10 * time.Second
+	// consul refuses values over 512KB
+	txnJournalChunk = 256 * 1024
+)
+
+// how to undo one op, Old/Existed is the state before, New/Deleted what the
+// op wrote
+type txnUndo struct {
+	Key     string `json:"key"`
+	Old     []byte `json:"old,omitempty"`
+	Existed bool   `json:"existed"`
+	New     []byte `json:"new,omitempty"`
+	Deleted bool   `json:"deleted"`
+}
+
+func (s *consulStore) Txn(ops []TxnOp) int {
+	client, err := apiClient()
+	if err != nil {
+		glog.Errorf("Error (%v) in transaction", err)
+		return ERROR
+	}
+
+	lock, err := client.LockOpts(&api.LockOptions{Key: txnLockKey, SessionName: "cxy-sdn txn"})
+	if err != nil {
+		glog.Errorf("Error (%v) creating transaction lock", err)
+		return ERROR
+	}
+
+	stopCh := make(chan struct{})
+	timer := time.AfterFunc(txnLockWait, func() { close(stopCh) })
+	lost, err := lock.Lock(stopCh)
+	timer.Stop()
+
+	if err != nil || lost == nil {
+		glog.Errorf("Error (%v) acquiring transaction lock", err)
+		return ERROR
+	}
+	defer lock.Unlock()
+
+	kv := client.KV()
+
+	if err := recoverTxn(kv); err != nil {
+		glog.Errorf("Error (%v) undoing interrupted transaction", err)
+		return ERROR
+	}
+
+	journal := make([]txnUndo, 0, len(ops))
+
+	for _, op := range ops {
+		key := op.Store + "/" + op.Key
+		pair, _, err := kv.Get(key, nil)
+		if err != nil {
+			glog.Errorf("Error (%v) in Get for %s", err, key)
+			return ERROR
+		}
+
+		undo := txnUndo{Key: key, New: op.Value, Deleted: op.Delete}
+		index := 0
+		if pair != nil {
+			undo.Old, undo.Existed = pair.Value, true
+			index = int(pair.ModifyIndex)
+		}
+		if index != op.Index {
+			return OUTDATED
+		}
+		journal = append(journal, undo)
+	}
+
+	chunks, err := journalChunks(journal)
+	if err != nil {
+		glog.Errorf("Error (%v) encoding transaction journal", err)
+		return ERROR
+	}
+	for i, data := range chunks {
+		if _, err := kv.Put(&api.KVPair{Key: fmt.Sprintf("%s/%d", txnJournalKey, i), Value: data}, nil); err != nil {
+			glog.Errorf("Error (%v) writing transaction journal", err)
+			// no op ran yet, a partial journal undoes nothing
+			kv.DeleteTree(txnJournalKey, nil)
+			return ERROR
+		}
+	}
+
+	for i, op := range ops {
+		pair := &api.KVPair{Key: journal[i].Key, Value: op.Value, ModifyIndex: uint64(op.Index)}
+
+		var ok bool
+		if op.Delete {
+			ok, _, err = kv.DeleteCAS(pair, nil)
+		} else {
+			ok, _, err = kv.CAS(pair, nil)
+		}
+
+		if err != nil || !ok {
+			// a writer outside of transactions got in between
+			if undoErr := undoTxn(kv, journal[:i]); undoErr != nil {
+				glog.Errorf("Error (%v) undoing transaction, journal kept", undoErr)
+				return ERROR
+			}
+			kv.DeleteTree(txnJournalKey, nil)
+
+			if err != nil {
+				glog.Errorf("Error (%v) in transaction for %s", err, pair.Key)
+				return ERROR
+			}
+			return OUTDATED
+		}
+	}
+
+	if _, err := kv.DeleteTree(txnJournalKey, nil); err != nil {
+		glog.Errorf("Error (%v) deleting transaction journal", err)
+	}
+	return OK
+}
+
+// encode the journal as json arrays of at most txnJournalChunk bytes each,
+// a single entry bigger than that gets a chunk of its own
+func journalChunks(journal []txnUndo) ([][]byte, error) {
+	var chunks [][]byte
+	var buf bytes.Buffer
+
+	for _, undo := range journal {
+		data, err := json.Marshal(undo)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 0 && buf.Len()+len(data)+2 > txnJournalChunk {
+			buf.WriteByte(']')
+			chunks = append(chunks, buf.Bytes())
+			buf = bytes.Buffer{}
+		}
+		if buf.Len() == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+	}
+	if buf.Len() > 0 {
+		buf.WriteByte(']')
+		chunks = append(chunks, buf.Bytes())
+	}
+	return chunks, nil
+}
+
+// decode the journal chunks in order, a journal written before it was
+// split sits at txnJournalKey itself and sorts first
+func decodeJournal(pairs api.KVPairs) ([]txnUndo, error) {
+	sort.Sort(byJournalSeq(pairs))
+
+	var journal []txnUndo
+	for _, pair := range pairs {
+		var chunk []txnUndo
+		if err := json.Unmarshal(pair.Value, &chunk); err != nil {
+			return nil, fmt.Errorf("journal %s: %v", pair.Key, err)
+		}
+		journal = append(journal, chunk...)
+	}
+	return journal, nil
+}
+
+func journalSeq(key string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(key, txnJournalKey+"/"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+type byJournalSeq api.KVPairs
+
+func (p byJournalSeq) Len() int           { return len(p) }
+func (p byJournalSeq) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byJournalSeq) Less(i, j int) bool { return journalSeq(p[i].Key) < journalSeq(p[j].Key) }
+
+// undo the journal left by a transaction that never finished
+func recoverTxn(kv *api.KV) error {
+	pairs, _, err := kv.List(txnJournalKey, nil)
+	if err != nil || len(pairs) == 0 {
+		return err
+	}
+
+	journal, err := decodeJournal(pairs)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Undoing interrupted transaction of %d ops", len(journal))
+
+	if err := undoTxn(kv, journal); err != nil {
+		return err
+	}
+
+	_, err = kv.DeleteTree(txnJournalKey, nil)
+	return err
+}
+
+// revert the ops in reverse order, a key is only reverted while it still
+// holds what the transaction wrote, so ops that never ran and later writes
+// by others are left alone
+func undoTxn(kv *api.KV, journal []txnUndo) error {
+	for i := len(journal) - 1; i >= 0; i-- {
+		undo := journal[i]
+
+		pair, _, err := kv.Get(undo.Key, nil)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case undo.Deleted && pair == nil && undo.Existed:
+			_, _, err = kv.CAS(&api.KVPair{Key: undo.Key, Value: undo.Old}, nil)
+		case !undo.Deleted && pair != nil && bytes.Equal(pair.Value, undo.New):
+			if undo.Existed {
+				_, _, err = kv.CAS(&api.KVPair{Key: undo.Key, Value: undo.Old, ModifyIndex: pair.ModifyIndex}, nil)
+			} else {
+				_, _, err = kv.DeleteCAS(&api.KVPair{Key: undo.Key, ModifyIndex: pair.ModifyIndex}, nil)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
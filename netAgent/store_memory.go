@@ -0,0 +1,160 @@
+package netAgent
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryEntry struct {
+	value       []byte
+	modifyIndex int
+}
+
+// memoryStore keeps the K/V pairs in process memory, it is meant for
+// single node setups and unit tests
+type memoryStore struct {
+	sync.Mutex
+	index   int
+	stores  map[string]map[string]memoryEntry
+	watches localWatches
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		stores: make(map[string]map[string]memoryEntry),
+	}
+}
+
+func (s *memoryStore) Get(store string, key string) ([]byte, int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.stores[store][key]
+	if !ok {
+		return nil, 0, false
+	}
+
+	return copyBytes(entry.value), entry.modifyIndex, true
+}
+
+func (s *memoryStore) Lookup(store string, key string) ([]byte, int, int) {
+	value, index, _ := s.Get(store, key)
+	return value, index, OK
+}
+
+func (s *memoryStore) List(store string) ([]KVPair, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	pairs := make([]KVPair, 0, len(s.stores[store]))
+
+	for key, entry := range s.stores[store] {
+		pairs = append(pairs, KVPair{key, copyBytes(entry.value), entry.modifyIndex})
+	}
+
+	// keep the same key order as consul does
+	sort.Sort(byKey(pairs))
+	return pairs, true
+}
+
+func (s *memoryStore) CAS(store string, key string, value []byte, index int) int {
+	s.Lock()
+
+	entry, ok := s.stores[store][key]
+	if (ok && entry.modifyIndex != index) || (!ok && index != 0) {
+		s.Unlock()
+		return OUTDATED
+	}
+
+	s.set(store, key, value)
+	s.Unlock()
+
+	s.watches.notify(store)
+	return OK
+}
+
+func (s *memoryStore) Delete(store string, key string) int {
+	s.Lock()
+	delete(s.stores[store], key)
+	s.Unlock()
+
+	s.watches.notify(store)
+	return OK
+}
+
+func (s *memoryStore) DeleteCAS(store string, key string, index int) int {
+	s.Lock()
+
+	entry, ok := s.stores[store][key]
+	if !ok {
+		s.Unlock()
+		return OK
+	}
+	if entry.modifyIndex != index {
+		s.Unlock()
+		return OUTDATED
+	}
+
+	delete(s.stores[store], key)
+	s.Unlock()
+
+	s.watches.notify(store)
+	return OK
+}
+
+func (s *memoryStore) Txn(ops []TxnOp) int {
+	s.Lock()
+
+	for _, op := range ops {
+		entry, ok := s.stores[op.Store][op.Key]
+		if (ok && entry.modifyIndex != op.Index) || (!ok && op.Index != 0) {
+			s.Unlock()
+			return OUTDATED
+		}
+	}
+
+	touched := make(map[string]bool)
+	for _, op := range ops {
+		if op.Delete {
+			delete(s.stores[op.Store], op.Key)
+		} else {
+			s.set(op.Store, op.Key, op.Value)
+		}
+		touched[op.Store] = true
+	}
+	s.Unlock()
+
+	for store := range touched {
+		s.watches.notify(store)
+	}
+	return OK
+}
+
+func (s *memoryStore) watchStore(store string, handler func()) {
+	s.watches.watchStore(store, handler)
+}
+
+// set writes the value with a new ModifyIndex, lock must be held
+func (s *memoryStore) set(store string, key string, value []byte) {
+	if _, ok := s.stores[store]; !ok {
+		s.stores[store] = make(map[string]memoryEntry)
+	}
+
+	s.index++
+	s.stores[store][key] = memoryEntry{copyBytes(value), s.index}
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+type byKey []KVPair
+
+func (p byKey) Len() int           { return len(p) }
+func (p byKey) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p byKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
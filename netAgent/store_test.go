@@ -0,0 +1,318 @@
+package netAgent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// run the same checks against every store that needs no consul agent,
+// the store is also installed for the package level functions
+func forEachLocalStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	defer SetStore(GetStore())
+
+	mem := NewMemoryStore()
+	SetStore(mem)
+	fn(t, mem)
+
+	dir, err := ioutil.TempDir("", "cxy-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal("Error opening bolt store", err)
+	}
+	defer s.(*boltStore).Close()
+
+	SetStore(s)
+	fn(t, s)
+}
+
+func TestStoreGetPut(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		if _, _, ok := Get("haha", "test"); ok {
+			t.Fatal("error should not have value")
+		}
+
+		if Put("haha", "test", []byte("192.168.1.1"), nil) != OK {
+			t.Fatal("Put failed")
+		}
+
+		existingVal, index, ok := Get("haha", "test")
+		if !ok || !bytes.Equal(existingVal, []byte("192.168.1.1")) {
+			t.Fatal("Value is not right in the store")
+		}
+
+		if Put("haha", "test", []byte("192.168.2.1"), []byte("10.0.0.1")) != OUTDATED {
+			t.Fatal("Put with a stale old value must be OUTDATED")
+		}
+
+		if Put("haha", "test", []byte("192.168.2.1"), existingVal) != OK {
+			t.Fatal("Put failed")
+		}
+
+		_, newIndex, _ := Get("haha", "test")
+		if newIndex <= index {
+			t.Fatal("ModifyIndex must grow on every write", index, newIndex)
+		}
+
+		if Delete("haha", "test") != OK {
+			t.Fatal("Delete failed")
+		}
+
+		if _, _, ok := Get("haha", "test"); ok {
+			t.Fatal("key should be deleted")
+		}
+	})
+}
+
+func TestStoreLookup(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		if _, index, result := Lookup("lookup", "test"); result != OK || index != 0 {
+			t.Fatal("missing key must be OK with index 0", index, result)
+		}
+
+		CAS("lookup", "test", []byte("10.0.0.1"), 0)
+		value, index, result := Lookup("lookup", "test")
+		if result != OK || index == 0 || !bytes.Equal(value, []byte("10.0.0.1")) {
+			t.Fatal("wrong lookup", string(value), index, result)
+		}
+	})
+}
+
+func TestStoreList(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		pairs, ok := s.List("empty")
+		if !ok || len(pairs) != 0 {
+			t.Fatal("List of an unknown store must be empty")
+		}
+
+		Put("list", "b", []byte("2"), nil)
+		Put("list", "1-10.0.0.0/24", []byte("1"), nil)
+		Put("other", "c", []byte("3"), nil)
+
+		pairs, ok = s.List("list")
+		if !ok || len(pairs) != 2 {
+			t.Fatal("List should return 2 pairs", pairs)
+		}
+
+		if pairs[0].Key != "1-10.0.0.0/24" || pairs[1].Key != "b" {
+			t.Fatal("List keys are wrong", pairs)
+		}
+
+		if !bytes.Equal(pairs[1].Value, []byte("2")) {
+			t.Fatal("List values are wrong", pairs)
+		}
+	})
+}
+
+func TestStoreCAS(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		if s.CAS("cas", "test", []byte("1"), 5) != OUTDATED {
+			t.Fatal("CAS on a missing key with non zero index must be OUTDATED")
+		}
+
+		if s.CAS("cas", "test", []byte("1"), 0) != OK {
+			t.Fatal("CAS with index 0 must create the key")
+		}
+
+		if s.CAS("cas", "test", []byte("2"), 0) != OUTDATED {
+			t.Fatal("CAS with index 0 must fail when the key exists")
+		}
+
+		_, index, _ := s.Get("cas", "test")
+
+		if s.CAS("cas", "test", []byte("2"), index) != OK {
+			t.Fatal("CAS with the current index failed")
+		}
+
+		// a writer still holding the old index loses, even when it
+		// writes back the same bytes it read
+		if s.CAS("cas", "test", []byte("1"), index) != OUTDATED {
+			t.Fatal("CAS with a stale index must be OUTDATED")
+		}
+
+		val, _, _ := s.Get("cas", "test")
+		if !bytes.Equal(val, []byte("2")) {
+			t.Fatal("value is not right in the store", string(val))
+		}
+	})
+}
+
+func TestStoreDeleteCAS(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		if DeleteCAS("dcas", "missing", 5) != OK {
+			t.Fatal("DeleteCAS of a missing key must be OK")
+		}
+
+		Put("dcas", "a", []byte("1"), nil)
+		_, index, _ := Get("dcas", "a")
+		Put("dcas", "a", []byte("2"), []byte("1"))
+
+		if DeleteCAS("dcas", "a", index) != OUTDATED {
+			t.Fatal("DeleteCAS with a stale index must be OUTDATED")
+		}
+		if _, _, ok := Get("dcas", "a"); !ok {
+			t.Fatal("outdated DeleteCAS must keep the key")
+		}
+
+		_, index, _ = Get("dcas", "a")
+		if DeleteCAS("dcas", "a", index) != OK {
+			t.Fatal("DeleteCAS with the current index failed")
+		}
+		if _, _, ok := Get("dcas", "a"); ok {
+			t.Fatal("a should be deleted")
+		}
+	})
+}
+
+func TestStoreTxn(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		Put("txn", "a", []byte("1"), nil)
+		_, index, _ := Get("txn", "a")
+
+		// one stale index fails the whole transaction
+		ret := Txn(
+			TxnOp{Store: "txn", Key: "a", Value: []byte("2"), Index: index},
+			TxnOp{Store: "txn2", Key: "b", Value: []byte("2"), Index: 5},
+		)
+		if ret != OUTDATED {
+			t.Fatal("Txn with a stale index must be OUTDATED", ret)
+		}
+
+		if val, _, _ := Get("txn", "a"); string(val) != "1" {
+			t.Fatal("failed Txn must not write anything", string(val))
+		}
+
+		ret = Txn(
+			TxnOp{Store: "txn", Key: "a", Index: index, Delete: true},
+			TxnOp{Store: "txn2", Key: "b", Value: []byte("2"), Index: 0},
+		)
+		if ret != OK {
+			t.Fatal("Txn failed", ret)
+		}
+
+		if _, _, ok := Get("txn", "a"); ok {
+			t.Fatal("a should be deleted")
+		}
+
+		if val, _, _ := Get("txn2", "b"); string(val) != "2" {
+			t.Fatal("b should be written", string(val))
+		}
+	})
+}
+
+type storeUpdate struct {
+	updateType NotifyUpdateType
+	key        string
+	data       map[string][]byte
+}
+
+type storeListener struct {
+	updates chan storeUpdate
+}
+
+func (l storeListener) NotifyNodeUpdate(NotifyUpdateType, string) {}
+
+func (l storeListener) NotifyKeyUpdate(NotifyUpdateType, string, []byte) {}
+
+func (l storeListener) NotifyEvent(Event) {}
+
+func (l storeListener) NotifyStoreUpdate(updateType NotifyUpdateType, key string, data map[string][]byte) {
+	l.updates <- storeUpdate{updateType, key, data}
+}
+
+func waitStoreUpdate(t *testing.T, l storeListener) storeUpdate {
+	select {
+	case u := <-l.updates:
+		return u
+	case <-time.After(2 * time.Second):
+		t.Fatal("no store update received")
+	}
+	return storeUpdate{}
+}
+
+func TestJournalChunks(t *testing.T) {
+	var journal []txnUndo
+	for i := 0; i < 200; i++ {
+		journal = append(journal, txnUndo{Key: fmt.Sprintf("ip/%d", i), Old: bytes.Repeat([]byte{1}, 4096), Existed: true})
+	}
+
+	chunks, err := journalChunks(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want the journal split", len(chunks))
+	}
+
+	// list order is by key, so chunk 10 comes before chunk 2
+	var pairs api.KVPairs
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if len(chunks[i]) > txnJournalChunk {
+			t.Errorf("chunk %d is %d bytes", i, len(chunks[i]))
+		}
+		pairs = append(pairs, &api.KVPair{Key: fmt.Sprintf("%s/%d", txnJournalKey, i), Value: chunks[i]})
+	}
+
+	decoded, err := decodeJournal(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(journal) {
+		t.Fatalf("decoded %d entries, want %d", len(decoded), len(journal))
+	}
+	for i := range journal {
+		if decoded[i].Key != journal[i].Key {
+			t.Fatalf("entry %d is %s, want %s", i, decoded[i].Key, journal[i].Key)
+		}
+	}
+}
+
+// watches are registered once per store name, use a new name every run
+var watchRun int
+
+func TestStoreWatch(t *testing.T) {
+	forEachLocalStore(t, func(t *testing.T, s Store) {
+		watchRun++
+		store := fmt.Sprintf("watch%d", watchRun)
+		l := storeListener{make(chan storeUpdate, 10)}
+
+		Put(store, "a", []byte("1"), nil)
+
+		RegisterForStoreUpdates(store, l)
+
+		// existing keys are reported as added
+		u := waitStoreUpdate(t, l)
+		if u.updateType != NOTIFY_UPDATE_ADD || u.key != store+"/a" {
+			t.Fatal("expected ADD of a, got", u)
+		}
+
+		Put(store, "b", []byte("2"), nil)
+		u = waitStoreUpdate(t, l)
+		if u.updateType != NOTIFY_UPDATE_ADD || u.key != store+"/b" || len(u.data) != 2 {
+			t.Fatal("expected ADD of b with the full store, got", u)
+		}
+
+		Put(store, "a", []byte("3"), []byte("1"))
+		u = waitStoreUpdate(t, l)
+		if u.updateType != NOTIFY_UPDATE_MODIFY || u.key != store+"/a" || string(u.data["a"]) != "3" {
+			t.Fatal("expected MODIFY of a, got", u)
+		}
+
+		Delete(store, "b")
+		u = waitStoreUpdate(t, l)
+		if u.updateType != NOTIFY_UPDATE_DELETE || u.key != store+"/b" || len(u.data) != 1 {
+			t.Fatal("expected DELETE of b, got", u)
+		}
+	})
+}
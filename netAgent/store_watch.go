@@ -0,0 +1,110 @@
+package netAgent
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Store watches
+// every snapshot of a watched store is compared with the previous one and
+// listeners get one NotifyStoreUpdate per added, modified or deleted key.
+// The key passed to the listener is absolute (store/key), the map is the
+// full content of the store after the change, keyed by relative key
+
+var storeCacheLock sync.Mutex
+var storeCache = make(map[string]map[string]KVPair)
+
+func updateStoreListeners(store string, pairs []KVPair) {
+	storeCacheLock.Lock()
+	defer storeCacheLock.Unlock()
+
+	current := make(map[string]KVPair, len(pairs))
+	data := make(map[string][]byte, len(pairs))
+
+	for _, pair := range pairs {
+		current[pair.Key] = pair
+		data[pair.Key] = pair.Value
+	}
+
+	previous := storeCache[store]
+	storeCache[store] = current
+
+	listeners := getListeners(WATCH_TYPE_STORE, store)
+	if listeners == nil {
+		return
+	}
+
+	notify := func(updateType NotifyUpdateType, key string) {
+		for _, listener := range listeners {
+			listener.NotifyStoreUpdate(updateType, store+"/"+key, data)
+		}
+	}
+
+	for _, pair := range pairs {
+		old, ok := previous[pair.Key]
+		if !ok {
+			notify(NOTIFY_UPDATE_ADD, pair.Key)
+		} else if old.ModifyIndex != pair.ModifyIndex || !bytes.Equal(old.Value, pair.Value) {
+			notify(NOTIFY_UPDATE_MODIFY, pair.Key)
+		}
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			notify(NOTIFY_UPDATE_DELETE, key)
+		}
+	}
+}
+
+// localWatcher is implemented by the backends living in this process, they
+// call the handlers themselves after every write instead of a consul watch
+type localWatcher interface {
+	Store
+	watchStore(store string, handler func())
+}
+
+type localWatches struct {
+	sync.Mutex
+	handlers map[string][]func()
+}
+
+func (w *localWatches) watchStore(store string, handler func()) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.handlers == nil {
+		w.handlers = make(map[string][]func())
+	}
+	w.handlers[store] = append(w.handlers[store], handler)
+}
+
+// notify runs the handlers of store in the background, so a slow listener
+// never blocks the writer
+func (w *localWatches) notify(store string) {
+	w.Lock()
+	handlers := w.handlers[store]
+	w.Unlock()
+
+	for _, handler := range handlers {
+		go handler()
+	}
+}
+
+// serializes list and diff, so a late handler never delivers an older
+// snapshot after a newer one
+var localSnapshotLock sync.Mutex
+
+func registerForLocalStoreUpdates(w localWatcher, store string) {
+	handler := func() {
+		localSnapshotLock.Lock()
+		defer localSnapshotLock.Unlock()
+
+		if pairs, ok := w.List(store); ok {
+			updateStoreListeners(store, pairs)
+		}
+	}
+	w.watchStore(store, handler)
+
+	// like a consul watch, deliver the current content right away
+	handler()
+}
@@ -0,0 +1,132 @@
+package netAgent
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/consul/api"
+)
+
+// Blocking query watches
+// same loop as consul's watch.WatchPlan, but the client comes from apiClient
+// so watches use the configured address, TLS and ACL token
+
+const (
+	watchRetryInterval = 5 * time.Second
+	watchMaxBackoff    = 180 * time.Second
+)
+
+// one blocking query, returns the new index and the result
+type watchFunc func(client *api.Client, index uint64) (uint64, interface{}, error)
+
+type watchHandler func(idx uint64, data interface{})
+
+type watchPlan struct {
+	name    string
+	fn      watchFunc
+	handler watchHandler
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func newWatchPlan(name string, fn watchFunc, handler watchHandler) *watchPlan {
+	return &watchPlan{name: name, fn: fn, handler: handler, stopCh: make(chan struct{})}
+}
+
+func (p *watchPlan) Stop() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+}
+
+func (p *watchPlan) shouldStop() bool {
+	select {
+	case <-p.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run blocks until the plan is stopped, handler is called with every
+// changed result
+func (p *watchPlan) Run() error {
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+
+	var lastIndex uint64
+	var lastResult interface{}
+	failures := 0
+
+	for !p.shouldStop() {
+		index, result, err := p.fn(client, lastIndex)
+
+		if p.shouldStop() {
+			break
+		}
+
+		if err != nil {
+			failures++
+			retry := watchRetryInterval * time.Duration(failures*failures)
+			if retry > watchMaxBackoff {
+				retry = watchMaxBackoff
+			}
+			glog.Errorf("Watch %s error: %v, retry in %v", p.name, err, retry)
+			select {
+			case <-time.After(retry):
+				continue
+			case <-p.stopCh:
+				return nil
+			}
+		}
+		failures = 0
+
+		if index == lastIndex {
+			continue
+		}
+
+		oldIndex := lastIndex
+		lastIndex = index
+		if oldIndex != 0 && reflect.DeepEqual(lastResult, result) {
+			continue
+		}
+
+		lastResult = result
+		p.handler(index, result)
+	}
+	return nil
+}
+
+func nodesWatch(client *api.Client, index uint64) (uint64, interface{}, error) {
+	nodes, meta, err := client.Catalog().Nodes(&api.QueryOptions{WaitIndex: index})
+	if err != nil {
+		return 0, nil, err
+	}
+	return meta.LastIndex, nodes, nil
+}
+
+func keyWatch(key string) watchFunc {
+	return func(client *api.Client, index uint64) (uint64, interface{}, error) {
+		pair, meta, err := client.KV().Get(key, &api.QueryOptions{WaitIndex: index})
+		if err != nil {
+			return 0, nil, err
+		}
+		if pair == nil {
+			return meta.LastIndex, nil, nil
+		}
+		return meta.LastIndex, pair, nil
+	}
+}
+
+func keyprefixWatch(prefix string) watchFunc {
+	return func(client *api.Client, index uint64) (uint64, interface{}, error) {
+		pairs, meta, err := client.KV().List(prefix, &api.QueryOptions{WaitIndex: index})
+		if err != nil {
+			return 0, nil, err
+		}
+		return meta.LastIndex, pairs, nil
+	}
+}
@@ -7,12 +7,16 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
 	"github.com/gorilla/mux"
 )
 
@@ -46,19 +50,23 @@ type BridgeConf struct {
 }
 
 type Connection struct {
-	ContainerID      string        `json:"containerID"`
-	ContainerName    string        `json:"containerName"`
-	ContainerPID     string        `json:"containerPID"`
-	RequestIp        string        `json:"requestIP,omitempty"`
-	Network          string        `json:"network"`
-	OvsPortID        string        `json:"ovsPortID"`
-	BandWidth        string        `json:"bandWidth,omitempty"`
-	Delay            string        `json:"delay,omitempty"`
-	RXTotal          uint64        `json:"rxKbytes"` // in KB
-	TXTotal          uint64        `json:"txKbytes"` // in KB
-	RXRate           float64       `json:"rxRate"`   // in Kb/s
-	TXRate           float64       `json:"txRate"`   // in Kb/s
-	ConnectionDetail OvsConnection `json:"ovs_connectionDetails"`
+	ContainerID   string `json:"containerID"`
+	ContainerName string `json:"containerName"`
+	ContainerPID  string `json:"containerPID"`
+	RequestIp     string `json:"requestIP,omitempty"`
+	// stable name of the container, like a pod namespace/name, addresses
+	// reserved for it are reused. The container name if empty
+	Identity         string            `json:"identity,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Network          string            `json:"network"`
+	OvsPortID        string            `json:"ovsPortID"`
+	BandWidth        string            `json:"bandWidth,omitempty"`
+	Delay            string            `json:"delay,omitempty"`
+	RXTotal          uint64            `json:"rxKbytes"` // in KB
+	TXTotal          uint64            `json:"txKbytes"` // in KB
+	RXRate           float64           `json:"rxRate"`   // in Kb/s
+	TXRate           float64           `json:"txRate"`   // in Kb/s
+	ConnectionDetail OvsConnection     `json:"ovs_connectionDetails"`
 }
 
 func ServeApi(d *Daemon) {
@@ -82,27 +90,45 @@ func createRouter(d *Daemon) *mux.Router {
 
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/version":            getVersion,
-			"/configuration":      getConf,
-			"/networks":           getNets,
-			"/network/{name:.*}":  getNet,
-			"/connections":        getConns,
-			"/connection/{id:.*}": getConn,
+			"/version":                     getVersion,
+			"/configuration":               getConf,
+			"/networks":                    getNets,
+			"/networks/status":             getNetsStatus,
+			"/network/{name}":              getNet,
+			"/network/{name}/leases":       getLeases,
+			"/network/{name}/reservations": getReservations,
+			"/network/{name}/ipam":         getNetUsage,
+			"/ipam":                        getClusterUsage,
+			"/connections":                 getConns,
+			"/connection/{id:.*}":          getConn,
+			"/cluster/nodes":               getClusterNodes,
+			"/cluster/node/{name}":         getClusterNode,
+			"/cluster/routes":              getClusterRoutes,
+			"/cluster/keyring":             getKeyring,
+			"/admin/snapshot":              getSnapshot,
 		},
 		"POST": {
-			"/configuration": setConf,
-			"/network":       createNet,
-			"/cluster/join":  joinCluster,
-			"/cluster/leave": leaveCluster,
-			"/connection":    createConn,
-			"/qos/{id:.*}":   createQos,
+			"/configuration":               setConf,
+			"/network":                     createNet,
+			"/network/{name}/reservations": createReservation,
+			"/network/{name}/subnets":      addSubnet,
+			"/cluster/join":                joinCluster,
+			"/cluster/leave":               leaveCluster,
+			"/cluster/keyring":             installKey,
+			"/admin/restore":               restore,
+			"/connection":                  createConn,
+			"/qos/{id:.*}":                 createQos,
 		},
 		"PUT": {
-			"/qos/{id:.*}": updateQos,
+			"/qos/{id:.*}":     updateQos,
+			"/network/{name}":  updateNet,
+			"/cluster/keyring": useKey,
 		},
 		"DELETE": {
-			"/network/{name:.*}":  delNet,
-			"/connection/{id:.*}": delConn,
+			"/network/{name}": delNet,
+			"/network/{name}/reservations/{identity:.*}": delReservation,
+			"/connection/{id:.*}":                        delConn,
+			"/cluster/keyring":                           removeKey,
 		},
 	}
 
@@ -152,12 +178,36 @@ func setConf(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 
 // get all the existing network
 func getNets(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
 	networks, err := GetNetworks()
 	if err != nil {
 		return &HttpErr{http.StatusInternalServerError, err.Error()}
 	}
 
-	data, err := json.Marshal(networks)
+	selected := make([]Network, 0, len(networks))
+	for _, network := range networks {
+		if selector.matches(network.Labels) {
+			selected = append(selected, network)
+		}
+	}
+
+	data, err := json.Marshal(selected)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// get the reconcile state of every network on this node
+func getNetsStatus(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	data, err := json.Marshal(d.reconciler.Status())
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(data)
@@ -188,6 +238,225 @@ func getNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 	return nil
 }
 
+// list the containers holding addresses of a network
+func getLeases(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	name := mux.Vars(r)["name"]
+
+	network, err := GetNetwork(name)
+	if err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	leases, err := GetLeases(network)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	selected := make([]Lease, 0, len(leases))
+	for _, lease := range leases {
+		if selector.matches(lease.Labels) {
+			selected = append(selected, lease)
+		}
+	}
+
+	data, err := json.Marshal(selected)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.Write(data)
+
+	return nil
+}
+
+// address counts and holders of a network
+func getNetUsage(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	network, err := GetNetwork(mux.Vars(r)["name"])
+	if err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	usage, err := GetNetworkUsage(network, true)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.Write(data)
+
+	return nil
+}
+
+// address counts of every network
+func getClusterUsage(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	usage, err := GetClusterUsage()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.Write(data)
+
+	return nil
+}
+
+// attach a secondary subnet to a network
+func addSubnet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	name := mux.Vars(r)["name"]
+	if _, err := GetNetwork(name); err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	if r.Body == nil {
+		return &HttpErr{http.StatusBadRequest, "request body is empty"}
+	}
+
+	conf := &SubnetConf{}
+	if err := json.NewDecoder(r.Body).Decode(conf); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	var gateway net.IP
+	if conf.Gateway != "" {
+		if gateway = net.ParseIP(conf.Gateway); gateway == nil || !subnet.Contains(gateway) {
+			return &HttpErr{http.StatusBadRequest, "gateway " + conf.Gateway + " not in " + subnet.String()}
+		}
+	}
+
+	network, err := AddSubnet(name, subnet, gateway)
+	switch err.(type) {
+	case *SubnetConflictError:
+		return &HttpErr{http.StatusConflict, err.Error()}
+	case *InvalidNetworkError:
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, _ := json.Marshal(network)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+
+	return nil
+}
+
+// list the IP reservations of a network
+func getReservations(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	network, err := GetNetwork(mux.Vars(r)["name"])
+	if err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	reservations, err := GetReservations(network)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(reservations)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.Write(data)
+
+	return nil
+}
+
+// reservation request, ip is optional
+type reservationRequest struct {
+	Identity string `json:"identity"`
+	IP       string `json:"ip,omitempty"`
+}
+
+// reserve addresses of a network for an identity
+func createReservation(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	network, err := GetNetwork(mux.Vars(r)["name"])
+	if err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	if r.Body == nil {
+		return &HttpErr{http.StatusBadRequest, "request body is empty"}
+	}
+
+	req := &reservationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+	if req.Identity == "" {
+		return &HttpErr{http.StatusBadRequest, "identity is empty"}
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		return &HttpErr{http.StatusBadRequest, "invalid IP " + req.IP}
+	}
+
+	reservation, err := CreateReservation(network, req.Identity, req.IP)
+	if err == errReservationExists {
+		return &HttpErr{http.StatusConflict, req.Identity + " already has a reservation"}
+	}
+	if staticErr, ok := err.(*StaticIPError); ok && !staticErr.Conflict {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+	if err != nil {
+		return &HttpErr{http.StatusConflict, err.Error()}
+	}
+
+	data, _ := json.Marshal(reservation)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+
+	return nil
+}
+
+// delete a reservation, its addresses are released
+func delReservation(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	vars := mux.Vars(r)
+
+	network, err := GetNetwork(vars["name"])
+	if err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	reservation, err := GetReservation(network, vars["identity"])
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+	if reservation == nil {
+		return &HttpErr{http.StatusNotFound, "no reservation for " + vars["identity"]}
+	}
+
+	if err := DeleteReservation(network, vars["identity"]); err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	return nil
+}
+
 // create a network
 func createNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 	if r.Body == nil {
@@ -201,14 +470,48 @@ func createNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 		return &HttpErr{http.StatusInternalServerError, err.Error()}
 	}
 
-	_, cidr, err := net.ParseCIDR(network.Subnet)
+	var cidr *net.IPNet
+	if network.Subnet == "" {
+		// carved from the subnet pool
+		cidr, err = GetAvailableSubnet()
+	} else {
+		_, cidr, err = net.ParseCIDR(network.Subnet)
+	}
 
 	if err != nil {
 		return &HttpErr{http.StatusInternalServerError, err.Error()}
 	}
 
-	newNet, err := CreateNetwork(network.Name, cidr)
+	options := NetworkOptions{
+		Ranges:   network.Ranges,
+		Exclude:  network.Exclude,
+		Reserved: network.Reserved,
+		VNI:      network.VNI,
+		Labels:   network.Labels,
+		MTU:      network.MTU,
+		NAT:      network.NAT,
+		DNS:      network.DNS,
+	}
+	if network.Subnet6 != "" {
+		if _, options.Subnet6, err = net.ParseCIDR(network.Subnet6); err != nil {
+			return &HttpErr{http.StatusBadRequest, err.Error()}
+		}
+		if isIPv6(cidr) || !isIPv6(options.Subnet6) {
+			return &HttpErr{http.StatusBadRequest, "subnet6 needs an IPv4 subnet and an IPv6 subnet6"}
+		}
+	}
+
+	network.Subnet = cidr.String()
+	if err = network.checkPools(); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
 
+	newNet, err := CreateNetworkWithOptions(network.Name, cidr, options)
+
+	switch err.(type) {
+	case *VNIConflictError, *SubnetConflictError:
+		return &HttpErr{http.StatusConflict, err.Error()}
+	}
 	if err != nil {
 		return &HttpErr{http.StatusInternalServerError, err.Error()}
 	}
@@ -221,13 +524,68 @@ func createNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 	return nil
 }
 
+// change the labels, MTU, NAT mode, name servers or allocation ranges of
+// a network, the hosts apply them on their next reconcile
+func updateNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	name := mux.Vars(r)["name"]
+	if _, err := GetNetwork(name); err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	if r.Body == nil {
+		return &HttpErr{http.StatusBadRequest, "request body is empty"}
+	}
+
+	update := &NetworkUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	network, err := UpdateNetwork(name, update)
+	switch err.(type) {
+	case *RangeConflictError:
+		return &HttpErr{http.StatusConflict, err.Error()}
+	case *InvalidNetworkError:
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, _ := json.Marshal(network)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+
+	return nil
+}
+
 // delete one specified network
 func delNet(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	err := DeleteNetwork(name)
+	if _, err := GetNetwork(name); err != nil {
+		return &HttpErr{http.StatusNotFound, err.Error()}
+	}
+
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			return &HttpErr{http.StatusBadRequest, "invalid force " + value}
+		}
+	}
+
+	err := DeleteNetwork(name, force)
 
+	if inUse, ok := err.(*NetworkInUseError); ok {
+		// the connections to detach first, or delete with force=true
+		data, _ := json.Marshal(inUse)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(data)
+		return nil
+	}
 	if err != nil {
 		return &HttpErr{http.StatusInternalServerError, err.Error()}
 	}
@@ -267,10 +625,241 @@ func leaveCluster(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 	return nil
 }
 
+// get all cluster members with role, status and tunnel state
+func getClusterNodes(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	if d.storeBackend != consulBackend {
+		return &HttpErr{http.StatusServiceUnavailable, "no cluster with the " + d.storeBackend + " store"}
+	}
+
+	nodes, err := clusterNodes()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// routes of every member node, new subnets must not overlap them
+func getClusterRoutes(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	nodeRoutes, err := GetNodeRoutes()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(nodeRoutes)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// get one cluster member by node name or address
+func getClusterNode(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	if d.storeBackend != consulBackend {
+		return &HttpErr{http.StatusServiceUnavailable, "no cluster with the " + d.storeBackend + " store"}
+	}
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	nodes, err := clusterNodes()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	for _, node := range nodes {
+		if node.Name != name && node.Address != name {
+			continue
+		}
+
+		data, err := json.Marshal(node)
+		if err != nil {
+			return &HttpErr{http.StatusInternalServerError, err.Error()}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(data)
+		return nil
+	}
+
+	return &HttpErr{http.StatusNotFound, "node " + name + " not found"}
+}
+
+type KeyringRequest struct {
+	Key string `json:"key"`
+}
+
+// decode the gossip key of a keyring request
+func decodeKeyringRequest(d *Daemon, r *http.Request) (*KeyringRequest, *HttpErr) {
+	if d.storeBackend != consulBackend {
+		return nil, &HttpErr{http.StatusServiceUnavailable, "no cluster with the " + d.storeBackend + " store"}
+	}
+
+	req := &KeyringRequest{}
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+			return nil, &HttpErr{http.StatusBadRequest, err.Error()}
+		}
+	}
+	return req, nil
+}
+
+// list the gossip keys installed on the cluster
+func getKeyring(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	if d.storeBackend != consulBackend {
+		return &HttpErr{http.StatusServiceUnavailable, "no cluster with the " + d.storeBackend + " store"}
+	}
+
+	keys, err := netAgent.ListKeys()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// install a gossip key on every node, a new key is generated when none is given
+func installKey(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	req, httpErr := decodeKeyringRequest(d, r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if req.Key == "" {
+		key, err := netAgent.GenerateKey()
+		if err != nil {
+			return &HttpErr{http.StatusInternalServerError, err.Error()}
+		}
+		req.Key = key
+	}
+
+	if err := netAgent.ValidateKey(req.Key); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	if err := netAgent.InstallKey(req.Key); err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, _ := json.Marshal(req)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// switch the cluster to an installed gossip key
+func useKey(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	req, httpErr := decodeKeyringRequest(d, r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if err := netAgent.ValidateKey(req.Key); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	if err := netAgent.UseKey(req.Key); err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+// remove a gossip key from every node
+func removeKey(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	req, httpErr := decodeKeyringRequest(d, r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if err := netAgent.ValidateKey(req.Key); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	if err := netAgent.RemoveKey(req.Key); err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+// dump all cluster state as a versioned JSON archive
+func getSnapshot(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	snap, err := TakeSnapshot()
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=cxy-sdn-snapshot.json")
+	w.Write(data)
+	return nil
+}
+
+// replace all cluster state with a snapshot, refused if it is inconsistent
+func restore(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	if r.Body == nil {
+		return &HttpErr{http.StatusBadRequest, "request body is empty"}
+	}
+
+	snap := &Snapshot{}
+	if err := json.NewDecoder(r.Body).Decode(snap); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
+	if problems := snap.Validate(); len(problems) != 0 {
+		return &HttpErr{http.StatusBadRequest, "invalid snapshot:\n" + strings.Join(problems, "\n")}
+	}
+
+	if err := RestoreSnapshot(snap); err != nil {
+		return &HttpErr{http.StatusInternalServerError, err.Error()}
+	}
+
+	log.Println("snapshot of", snap.Created, "restored")
+	d.reconciler.Trigger()
+
+	// the other nodes must catch up with the restored state too
+	if err := netAgent.Publish(reconcileEvent, ReconcileEvent{"snapshot restored"}); err != nil {
+		log.Println("Error publishing reconcile event", err)
+	}
+	return nil
+}
+
 // get all connections
 func getConns(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
+
 	d.connections.RLock()
-	data, err := json.Marshal(d.connections.rm)
+	selected := make(map[string]interface{}, len(d.connections.rm))
+	for id, con := range d.connections.rm {
+		if selector.matches(con.(*Connection).Labels) {
+			selected[id] = con
+		}
+	}
+	data, err := json.Marshal(selected)
 	d.connections.RUnlock()
 
 	if err != nil {
@@ -322,17 +911,22 @@ func createConn(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 		con.Network = defaultNetwork
 	}
 
-	ctx := &ConnectionCtx{
-		addConn,
-		con,
-		make(chan *Connection),
+	if con.RequestIp != "" && net.ParseIP(con.RequestIp) == nil {
+		return &HttpErr{http.StatusBadRequest, "invalid requestIP " + con.RequestIp}
 	}
 
-	d.connectionChan <- ctx
-
-	res := <-ctx.Result
+	if err = checkLabels(con.Labels); err != nil {
+		return &HttpErr{http.StatusBadRequest, err.Error()}
+	}
 
-	if res.OvsPortID == "-1" {
+	res, err := connect(d, con)
+	if err != nil {
+		if staticErr, ok := err.(*StaticIPError); ok {
+			if staticErr.Conflict {
+				return &HttpErr{http.StatusConflict, staticErr.Error()}
+			}
+			return &HttpErr{http.StatusBadRequest, staticErr.Error()}
+		}
 		return &HttpErr{http.StatusBadRequest, "resp body not valid"}
 	}
 
@@ -354,14 +948,7 @@ func delConn(d *Daemon, w http.ResponseWriter, r *http.Request) *HttpErr {
 		return &HttpErr{http.StatusNotFound, "container not found"}
 	}
 
-	ctx := &ConnectionCtx{
-		deleteConn,
-		con.(*Connection),
-		make(chan *Connection),
-	}
-
-	d.connectionChan <- ctx
-	<-ctx.Result
+	disconnect(d, con.(*Connection))
 
 	return nil
 }
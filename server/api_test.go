@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
 )
 
 // test get version
@@ -104,7 +108,7 @@ func TestSetConfiguration(t *testing.T) {
 
 // test network related need start backend fot kv store
 func TestGetNetworksApi(t *testing.T) {
-	t.Skip("unable to mock network store")
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	d := NewDaemon()
 	request, _ := http.NewRequest("GET", "/networks", nil)
 	response := httptest.NewRecorder()
@@ -117,16 +121,16 @@ func TestGetNetworksApi(t *testing.T) {
 }
 
 func TestGetNetworkApi(t *testing.T) {
-	t.Skip("unable to mock network store")
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	daemon := NewDaemon()
-	/* ToDo: How do we inject this network?
 	network := &Network{
-		ID:      "foo",
+		Name:    "foo",
 		Subnet:  "10.10.10.0/24",
 		Gateway: "10.10.10.1",
-		Vlan:    uint(1),
+		VNI:     uint(1),
 	}
-	*/
+	data, _ := json.Marshal(network)
+	netAgent.Put(networkStore, "foo", data, nil)
 
 	request, _ := http.NewRequest("GET", "/network/foo", nil)
 	response := httptest.NewRecorder()
@@ -136,6 +140,10 @@ func TestGetNetworkApi(t *testing.T) {
 	if response.Code != http.StatusOK {
 		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
 	}
+
+	if !bytes.Equal(response.Body.Bytes(), data) {
+		t.Fatal("body does not match")
+	}
 }
 
 func TestSetNetworksApi(t *testing.T) {
@@ -182,7 +190,7 @@ func TestDeleteNetworkApi(t *testing.T) {
 }
 
 func TestGetNetworkNonExistentApi(t *testing.T) {
-	t.Skip("unable to mock network store")
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	d := NewDaemon()
 	request, _ := http.NewRequest("GET", "/networks/abc123", nil)
 	response := httptest.NewRecorder()
@@ -195,7 +203,7 @@ func TestGetNetworkNonExistentApi(t *testing.T) {
 }
 
 func TestDeleteNetworkNonExistentApi(t *testing.T) {
-	t.Skip("unable to mock network store")
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	d := NewDaemon()
 	request, _ := http.NewRequest("DELETE", "/connections/abc123", nil)
 	response := httptest.NewRecorder()
@@ -289,6 +297,102 @@ func TestClusterLeave(t *testing.T) {
 	}
 }
 
+func TestClusterNodesApi(t *testing.T) {
+	defer netAgent.SetConfig(netAgent.DefaultConfig())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			w.Write([]byte(`[{"Node":"node1","Address":"10.0.0.1"}]`))
+		case "/v1/agent/members":
+			w.Write([]byte(`[{"Name":"node1","Addr":"10.0.0.1","Tags":{"role":"consul","port":"8300"},"Status":1}]`))
+		case "/v1/status/leader":
+			w.Write([]byte(`"10.0.0.1:8300"`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	netAgent.SetConfig(&netAgent.Config{Address: strings.TrimPrefix(ts.URL, "http://")})
+
+	d := NewDaemon()
+	request, _ := http.NewRequest("GET", "/cluster/nodes", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+
+	var nodes []ClusterNode
+	if err := json.NewDecoder(response.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 1 || nodes[0].Address != "10.0.0.1" || !nodes[0].Leader ||
+		nodes[0].Role != netAgent.NODE_ROLE_SERVER || nodes[0].Status != netAgent.NODE_STATUS_ALIVE {
+		t.Fatal("nodes are wrong", nodes)
+	}
+
+	request, _ = http.NewRequest("GET", "/cluster/node/10.0.0.1", nil)
+	response = httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+
+	request, _ = http.NewRequest("GET", "/cluster/node/node2", nil)
+	response = httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "404", response.Code)
+	}
+}
+
+func TestClusterNodesNoConsul(t *testing.T) {
+	d := NewDaemon()
+	d.storeBackend = memoryBackend
+	request, _ := http.NewRequest("GET", "/cluster/nodes", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "503", response.Code)
+	}
+}
+
+func TestKeyringBadKey(t *testing.T) {
+	d := NewDaemon()
+	request, _ := http.NewRequest("PUT", "/cluster/keyring", bytes.NewBufferString(`{"key":"foo"}`))
+	response := httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "400", response.Code)
+	}
+}
+
+func TestKeyringNoConsul(t *testing.T) {
+	d := NewDaemon()
+	d.storeBackend = memoryBackend
+	request, _ := http.NewRequest("GET", "/cluster/keyring", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "503", response.Code)
+	}
+}
+
 func TestGetConns(t *testing.T) {
 	d := NewDaemon()
 	request, _ := http.NewRequest("GET", "/connections", nil)
@@ -333,6 +437,13 @@ func TestGetConn(t *testing.T) {
 }
 
 func TestCreateConn(t *testing.T) {
+	// addresses are leased before the connection reaches connHandler
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	_, subnet, _ := net.ParseCIDR("10.61.0.0/24")
+	if _, err := createNetworkRecord("foo", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
 	d := NewDaemon()
 	connection := &Connection{
 		ContainerID:   "abc123",
@@ -378,6 +489,12 @@ func TestCreateConn(t *testing.T) {
 }
 
 func TestCreateConnNoNetwork(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	_, subnet, _ := net.ParseCIDR("10.62.0.0/24")
+	if _, err := createNetworkRecord("cxy", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
 	d := NewDaemon()
 	connection := &Connection{
 		ContainerID:   "abc123",
@@ -431,6 +548,12 @@ func TestCreateConnNoNetwork(t *testing.T) {
 }
 
 func TestCreateConnWithIP(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	_, subnet, _ := net.ParseCIDR("10.10.10.0/24")
+	if _, err := createNetworkRecord("cxy", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
 	d := NewDaemon()
 	connection := &Connection{
 		ContainerID:   "abc123",
@@ -616,3 +739,239 @@ func TestUpdateQos(t *testing.T) {
 		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
 	}
 }*/
+
+// refused static requests come back as 400 or 409
+func TestCreateConnStaticIP(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.63.0.0/24")
+	network, err := createNetworkRecord("staticapi", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+	if _, err := requestIPs(network, subnets, "10.63.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDaemon()
+	go connHandler(d)
+
+	expected := map[string]int{
+		"10.63.0.10":    http.StatusConflict,
+		network.Gateway: http.StatusBadRequest,
+		"10.64.0.10":    http.StatusBadRequest,
+		"bogus":         http.StatusBadRequest,
+	}
+	for requestIp, code := range expected {
+		body := fmt.Sprintf(`{"containerID": "c1", "network": "staticapi", "requestIP": %q}`, requestIp)
+		request, _ := http.NewRequest("POST", "/connection", strings.NewReader(body))
+		response := httptest.NewRecorder()
+		createRouter(d).ServeHTTP(response, request)
+
+		if response.Code != code {
+			t.Fatal(requestIp, "expected", code, "got", response.Code, response.Body)
+		}
+	}
+}
+
+func TestAddSubnetApi(t *testing.T) {
+	store := &brokenStore{Store: netAgent.NewMemoryStore()}
+	netAgent.SetStore(store)
+
+	_, subnet, _ := net.ParseCIDR("10.72.0.0/24")
+	if _, err := createNetworkRecord("growapi", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	router := createRouter(NewDaemon())
+
+	expected := []struct {
+		uri, body string
+		code      int
+	}{
+		{"/network/growapi/subnets", `{"subnet": "10.72.1.0/24", "gateway": "10.72.1.254"}`, http.StatusCreated},
+		{"/network/growapi/subnets", `{"subnet": "10.72.1.128/25"}`, http.StatusConflict},
+		{"/network/growapi/subnets", `{"subnet": "10.72.2.0/24", "gateway": "10.72.3.1"}`, http.StatusBadRequest},
+		{"/network/growapi/subnets", `{"subnet": "bogus"}`, http.StatusBadRequest},
+		{"/network/missing/subnets", `{"subnet": "10.72.4.0/24"}`, http.StatusNotFound},
+	}
+	for _, e := range expected {
+		request, _ := http.NewRequest("POST", e.uri, strings.NewReader(e.body))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != e.code {
+			t.Fatal(e.body, "expected", e.code, "got", response.Code, response.Body)
+		}
+	}
+
+	network, _ := GetNetwork("growapi")
+	if len(network.Secondary) != 1 || network.Secondary[0].Gateway != "10.72.1.254" {
+		t.Fatal("wrong secondary subnets", network.Secondary)
+	}
+
+	// a store failure is not the client's fault
+	store.broken, store.result = networkStore, netAgent.ERROR
+	request, _ := http.NewRequest("POST", "/network/growapi/subnets", strings.NewReader(`{"subnet": "10.72.5.0/24"}`))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatal("store failure expected 500 got", response.Code, response.Body)
+	}
+}
+
+func TestCreateNetOverlapApi(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.75.0.0/16")
+	if _, err := createNetworkRecord("overlap", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("POST", "/network", strings.NewReader(`{"name": "inside", "subnet": "10.75.3.0/24"}`))
+	response := httptest.NewRecorder()
+	createRouter(NewDaemon()).ServeHTTP(response, request)
+
+	if response.Code != http.StatusConflict {
+		t.Fatal("expected 409, got", response.Code, response.Body)
+	}
+}
+
+func TestUpdateNetApi(t *testing.T) {
+	store := &brokenStore{Store: netAgent.NewMemoryStore()}
+	netAgent.SetStore(store)
+
+	_, subnet, _ := net.ParseCIDR("10.78.0.0/24")
+	network, err := createNetworkRecord("updateapi", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+	ips, _ := requestIPs(network, subnets, "10.78.0.5")
+	putLeases(network, subnets, ips, &Connection{ContainerID: "c1"})
+
+	router := createRouter(NewDaemon())
+
+	expected := []struct {
+		uri, body string
+		code      int
+	}{
+		{"/network/updateapi", `{"mtu": 1400, "dns": ["10.0.0.53"]}`, http.StatusOK},
+		{"/network/updateapi", `{"nat": "bogus"}`, http.StatusBadRequest},
+		{"/network/updateapi", `{"ranges": [{"start": "10.78.0.100", "end": "10.78.0.200"}]}`, http.StatusConflict},
+		{"/network/missing", `{"mtu": 1400}`, http.StatusNotFound},
+	}
+	for _, e := range expected {
+		request, _ := http.NewRequest("PUT", e.uri, strings.NewReader(e.body))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != e.code {
+			t.Fatal(e.body, "expected", e.code, "got", response.Code, response.Body)
+		}
+	}
+
+	network, _ = GetNetwork("updateapi")
+	if network.MTU != 1400 || len(network.DNS) != 1 || network.Ranges != nil {
+		t.Fatal("wrong network after updates", network)
+	}
+
+	store.broken, store.result = networkStore, netAgent.ERROR
+	request, _ := http.NewRequest("PUT", "/network/updateapi", strings.NewReader(`{"mtu": 1500}`))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatal("store failure expected 500 got", response.Code, response.Body)
+	}
+}
+
+func TestLabelFilterApi(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	for i, team := range []string{"payments", "search"} {
+		_, subnet, _ := net.ParseCIDR(fmt.Sprintf("10.79.%d.0/24", i))
+		options := NetworkOptions{Labels: map[string]string{"team": team}}
+		if _, err := createNetworkRecord(team, subnet, nil, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDaemon()
+	d.connections.Set("c1", &Connection{ContainerID: "c1", Labels: map[string]string{"team": "payments"}})
+	d.connections.Set("c2", &Connection{ContainerID: "c2"})
+	router := createRouter(d)
+
+	get := func(uri string, v interface{}) int {
+		request, _ := http.NewRequest("GET", uri, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code == http.StatusOK {
+			json.NewDecoder(response.Body).Decode(v)
+		}
+		return response.Code
+	}
+
+	var networks []Network
+	if code := get("/networks?label=team=payments", &networks); code != http.StatusOK || len(networks) != 1 || networks[0].Name != "payments" {
+		t.Fatal("wrong networks", code, networks)
+	}
+
+	connections := make(map[string]*Connection)
+	if code := get("/connections?label=team", &connections); code != http.StatusOK || len(connections) != 1 || connections["c1"] == nil {
+		t.Fatal("wrong connections", code, connections)
+	}
+
+	network, _ := GetNetwork("payments")
+	subnets, _ := network.subnets()
+	for _, con := range []string{"c1", "c2"} {
+		ips, _ := requestIPs(network, subnets, "")
+		putLeases(network, subnets, ips, d.connections.Get(con).(*Connection))
+	}
+	var leases []Lease
+	if code := get("/network/payments/leases?label=team!=payments", &leases); code != http.StatusOK || len(leases) != 1 || leases[0].ContainerID != "c2" {
+		t.Fatal("wrong leases", code, leases)
+	}
+
+	if code := get("/networks?label==payments", &networks); code != http.StatusBadRequest {
+		t.Fatal("bad selector accepted", code)
+	}
+}
+
+func TestDeleteNetInUseApi(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.82.0.0/24")
+	network, err := createNetworkRecord("inuseapi", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+	ips, _ := requestIPs(network, subnets, "")
+	putLeases(network, subnets, ips, &Connection{ContainerID: "c1"})
+
+	router := createRouter(NewDaemon())
+	do := func(uri string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("DELETE", uri, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	response := do("/network/inuseapi")
+	inUse := &NetworkInUseError{}
+	if response.Code != http.StatusConflict {
+		t.Fatal("expected 409, got", response.Code, response.Body)
+	}
+	if err := json.NewDecoder(response.Body).Decode(inUse); err != nil || len(inUse.Leases) != 1 || inUse.Leases[0].IP != ips[0].String() {
+		t.Fatal("wrong connections in use", inUse, err)
+	}
+
+	if response := do("/network/inuseapi?force=maybe"); response.Code != http.StatusBadRequest {
+		t.Fatal("expected 400, got", response.Code)
+	}
+	if response := do("/network/missing"); response.Code != http.StatusNotFound {
+		t.Fatal("expected 404, got", response.Code)
+	}
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
 	"github.com/WIZARD-CXY/cxy-sdn/util"
@@ -10,17 +13,63 @@ import (
 
 const dataDir = "/tmp/cxy/"
 
+// datastore backends selectable with --store
+const (
+	consulBackend = "consul"
+	boltBackend   = "bolt"
+	memoryBackend = "memory"
+)
+
 type Listener struct{}
 
 var listener Listener
 
+// cluster event asking every node to reconcile its local state now
+const reconcileEvent = "reconcile"
+
+type ReconcileEvent struct {
+	Reason string `json:"reason"`
+}
+
 func InitAgent(d *Daemon) error {
+	switch d.storeBackend {
+	case consulBackend:
+		netAgent.SetStore(netAgent.NewConsulStore())
+	case boltBackend:
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+		store, err := netAgent.NewBoltStore(filepath.Join(dataDir, "cxy-sdn.db"))
+		if err != nil {
+			return err
+		}
+		netAgent.SetStore(store)
+	case memoryBackend:
+		netAgent.SetStore(netAgent.NewMemoryStore())
+	default:
+		return errors.New("unknown store backend " + d.storeBackend)
+	}
+
+	if d.storeBackend != consulBackend {
+		// single node setup, no cluster to wait for
+		log.Println("Using", d.storeBackend, "store without net agent")
+		go netAgent.RegisterForStoreUpdates(networkStore, listener)
+		go netAgent.RegisterForEvents(reconcileEvent, listener)
+		if !d.isReady {
+			d.isReady = true
+			d.readyChan <- true
+		}
+		return nil
+	}
+
 	// advance setup server mode
 	// ref https://www.consul.io/docs/guides/bootstrapping.html
 	err := netAgent.StartAgent(d.isServer, d.expServerNum, d.bindInterface, dataDir)
 
 	if err == nil {
 		go netAgent.RegisterForNodeUpdates(listener)
+		go netAgent.RegisterForStoreUpdates(networkStore, listener)
+		go netAgent.RegisterForEvents(reconcileEvent, listener)
 	}
 	return err
 }
@@ -62,6 +111,29 @@ func nodeHandler(d *Daemon) {
 	}
 }
 
+// a cluster member and the state of the vxlan tunnel from this node to it
+type ClusterNode struct {
+	netAgent.NodeInfo
+	Tunnel bool `json:"tunnel"`
+}
+
+func clusterNodes() ([]ClusterNode, error) {
+	infos, err := netAgent.ClusterNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]ClusterNode, 0, len(infos))
+	for _, info := range infos {
+		node := ClusterNode{NodeInfo: info}
+		if ovsClient != nil {
+			node.Tunnel, _ = portExists(ovsClient, "vxlan-"+info.Address)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
 var daemon *Daemon
 
 func (l Listener) NotifyNodeUpdate(nType netAgent.NotifyUpdateType, nodeAddr string) {
@@ -87,6 +159,36 @@ func (l Listener) NotifyKeyUpdate(nType netAgent.NotifyUpdateType, key string, d
 	// do nothing
 }
 
-func (l Listener) NotifyStoreUpdate(nType netAgent.NotifyUpdateType, store string, data map[string][]byte) {
-	// do nothing
+// key is store/key, data holds the whole store after the update
+func (l Listener) NotifyStoreUpdate(nType netAgent.NotifyUpdateType, key string, data map[string][]byte) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	switch parts[0] {
+	case networkStore:
+		switch nType {
+		case netAgent.NOTIFY_UPDATE_ADD:
+			log.Println("network", parts[1], "added to", networkStore)
+		case netAgent.NOTIFY_UPDATE_MODIFY:
+			log.Println("network", parts[1], "modified in", networkStore)
+		case netAgent.NOTIFY_UPDATE_DELETE:
+			log.Println("network", parts[1], "deleted from", networkStore)
+		}
+		daemon.reconciler.Trigger()
+	}
+}
+
+func (l Listener) NotifyEvent(event netAgent.Event) {
+	switch event.Type {
+	case reconcileEvent:
+		payload := ReconcileEvent{}
+		if err := event.Decode(&payload); err != nil {
+			log.Println("bad", event.Type, "event from", event.Origin, err)
+			return
+		}
+		log.Println("reconcile requested by", event.Origin, payload.Reason)
+		daemon.reconciler.Trigger()
+	}
 }
@@ -26,15 +26,23 @@ import (
 const mtu = 1440
 const bridgeName = "ovs-br0"
 
+// container ports are named ovs and 7 random hex digits
+const containerPortPrefix = "ovs"
+
 var ovsClient *libovsdb.OvsdbClient
 var ContextCache map[string]string
 
 type OvsConnection struct {
-	Name    string `json:"name"`
-	Ip      string `json:"ip"`
-	Subnet  string `json:"subnet"`
-	Mac     string `json:"mac"`
-	Gateway string `json:"gateway"`
+	Name     string `json:"name"`
+	Ip       string `json:"ip"`
+	Subnet   string `json:"subnet"`
+	Mac      string `json:"mac"`
+	Gateway  string `json:"gateway"`
+	Ip6      string `json:"ip6,omitempty"` // dual stack networks only
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	// name servers of the network when the container was attached
+	DNS []string `json:"dns,omitempty"`
 }
 
 const (
@@ -46,9 +54,18 @@ type ConnectionCtx struct {
 	Action     int
 	Connection *Connection
 	Result     chan *Connection
+	// why an addConn failed, set before Result is sent
+	Err error
+	// the addresses leased for an addConn
+	addrs *connectionAddrs
 }
 
 func init() {
+	ContextCache = make(map[string]string)
+}
+
+// connect to the local ovsdb-server, blocks until it is reachable
+func initOVS() {
 	var err error
 	ovsClient, err = ovs_connect()
 	if err != nil {
@@ -56,7 +73,6 @@ func init() {
 	} else {
 		ovsClient.Register(notifier{})
 	}
-	ContextCache = make(map[string]string)
 	populateContextCache()
 }
 
@@ -122,6 +138,9 @@ func DeletePeer(peerIp string) error {
 	return nil
 }
 
+// the OVS and namespace side of connections, one at a time. The store
+// work is done by connect and disconnect before and after, so a slow
+// store doesn't hold up every other container
 func connHandler(d *Daemon) {
 	for {
 		c := <-d.connectionChan
@@ -129,10 +148,11 @@ func connHandler(d *Daemon) {
 
 		switch c.Action {
 		case addConn:
-			connDetail, err := addConnection(c.Connection.ContainerPID, c.Connection.Network, c.Connection.RequestIp)
+			connDetail, err := addConnection(c.Connection, c.addrs)
 			if err != nil {
 				log.Printf("conhandler err is %+v\n", err)
 				c.Connection.OvsPortID = "-1"
+				c.Err = err
 				c.Result <- c.Connection
 				continue
 			}
@@ -146,35 +166,112 @@ func connHandler(d *Daemon) {
 			go getInterfaceInfo(d, c.Connection, 2)
 			c.Result <- c.Connection
 		case deleteConn:
-			deleteConnection(c.Connection.ConnectionDetail, c.Connection.Network)
+			deleteConnection(c.Connection)
 			d.connections.Delete(c.Connection.ContainerID)
 			c.Result <- c.Connection
 		}
 	}
 }
 
-func addConnection(nspid, networkName, requestIp string) (ovsConnection OvsConnection, err error) {
-	var (
-		bridge = bridgeName
-		prefix = "ovs"
-	)
-	ovsConnection = OvsConnection{}
-	err = nil
+// the addresses of a connection being added, leased before its port is
+// created
+type connectionAddrs struct {
+	network *Network
+	ips     []net.IP
+	// the subnet of each address
+	ipNets []networkSubnet
+}
 
-	if bridge == "" {
-		err = fmt.Errorf("bridge is not available")
-		return
+// give the addresses back, for a connection that never came up
+func (a *connectionAddrs) release(containerID string) {
+	for i, ip := range a.ips {
+		releaseConnectionIP(fmt.Sprint(a.network.VNI), ip, *a.ipNets[i].subnet, containerID)
 	}
+}
 
+// add a connection: addresses and leases from the store, then the port
+// from connHandler. Nothing stays allocated on error
+func connect(d *Daemon, con *Connection) (*Connection, error) {
+	addrs, err := leaseConnection(con)
+	if err != nil {
+		return con, err
+	}
+
+	ctx := &ConnectionCtx{addConn, con, make(chan *Connection), nil, addrs}
+	d.connectionChan <- ctx
+	res := <-ctx.Result
+
+	if res.OvsPortID == "-1" {
+		addrs.release(con.ContainerID)
+		return res, ctx.Err
+	}
+	registerConnService(d, res)
+	return res, nil
+}
+
+// remove a connection: its port from connHandler, then its addresses
+func disconnect(d *Daemon, con *Connection) {
+	ctx := &ConnectionCtx{deleteConn, con, make(chan *Connection), nil, nil}
+	d.connectionChan <- ctx
+	<-ctx.Result
+
+	if err := releaseConnection(con); err != nil {
+		log.Println("release addresses of", con.ContainerID, "error:", err)
+	}
+	deregisterConnService(d, con)
+}
+
+// pick and lease the addresses of a new connection
+func leaseConnection(con *Connection) (*connectionAddrs, error) {
+	networkName := con.Network
 	if networkName == "" {
 		networkName = defaultNetwork
 	}
-	log.Println("haha network name", networkName, nspid)
 
 	bridgeNetwork, err := GetNetwork(networkName)
 	if err != nil {
-		return ovsConnection, err
+		return nil, err
+	}
+
+	subnets, err := bridgeNetwork.subnets()
+	if err != nil {
+		return nil, err
+	}
+
+	// addresses first, a refused static request leaves no port behind
+	ips, err := connectionIPs(bridgeNetwork, subnets, con.identity(), con.RequestIp)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := &connectionAddrs{bridgeNetwork, ips, ipSubnets(subnets, ips)}
+
+	// a reserved address still held by another container is refused here
+	if err := putLeases(bridgeNetwork, subnets, ips, con); err != nil {
+		addrs.release(con.ContainerID)
+		return nil, err
 	}
+	return addrs, nil
+}
+
+func addConnection(con *Connection, addrs *connectionAddrs) (ovsConnection OvsConnection, err error) {
+	var (
+		bridge        = bridgeName
+		prefix        = containerPortPrefix
+		nspid         = con.ContainerPID
+		bridgeNetwork = addrs.network
+		ips           = addrs.ips
+		ipNets        = addrs.ipNets
+	)
+	ovsConnection = OvsConnection{}
+	err = nil
+
+	if bridge == "" {
+		err = fmt.Errorf("bridge is not available")
+		return
+	}
+
+	log.Println("haha network name", bridgeNetwork.Name, nspid)
 
 	portName, err := createOvsInternalPort(prefix, bridge, bridgeNetwork.VNI)
 	if err != nil {
@@ -184,25 +281,22 @@ func addConnection(nspid, networkName, requestIp string) (ovsConnection OvsConne
 	time.Sleep(time.Second * 1)
 	log.Println("newportName is", portName)
 
-	_, subnet, _ := net.ParseCIDR(bridgeNetwork.Subnet)
+	log.Println("newIP is", ips)
+	mac := generateMacAddr(ips[0]).String()
 
-	var ip net.IP
-	if requestIp == "" {
-		// if not request a static ip, using system auto-choose
-		ip = RequestIP(fmt.Sprint(bridgeNetwork.VNI), *subnet)
-	} else {
-		// if request ip, mark it used and use it
-		ip = net.ParseIP(requestIp)
-		MarkUsed(fmt.Sprintf("%d", bridgeNetwork.VNI), ip, *subnet)
+	ovsConnection = OvsConnection{
+		Name:    portName,
+		Ip:      ips[0].String(),
+		Subnet:  prefixLen(ipNets[0].subnet),
+		Mac:     mac,
+		Gateway: ipNets[0].gateway.String(),
+		DNS:     bridgeNetwork.DNS,
+	}
+	if len(ips) > 1 {
+		ovsConnection.Ip6 = ips[1].String()
+		ovsConnection.Subnet6 = prefixLen(ipNets[1].subnet)
+		ovsConnection.Gateway6 = ipNets[1].gateway.String()
 	}
-
-	log.Println("newIP is", ip)
-	mac := generateMacAddr(ip).String()
-
-	subnetString := subnet.String()
-	subnetPrefix := subnetString[len(subnetString)-3 : len(subnetString)]
-
-	ovsConnection = OvsConnection{portName, ip.String(), subnetPrefix, mac, bridgeNetwork.Gateway}
 
 	if err = os.Symlink(filepath.Join(os.Getenv("PROCFS"), nspid, "ns/net"),
 		filepath.Join("/var/run/netns", nspid)); err != nil {
@@ -242,14 +336,16 @@ func addConnection(nspid, networkName, requestIp string) (ovsConnection OvsConne
 	// In the end switch back to the original namespace
 	defer netns.Set(origns)
 
-	if err = util.SetMtu(portName, mtu); err != nil {
+	if err = util.SetMtu(portName, bridgeNetwork.linkMTU()); err != nil {
 		log.Println("set mtu error in addCon")
 		return
 	}
 
-	if err = util.SetInterfaceIp(portName, ip.String()+subnetPrefix); err != nil {
-		log.Println("SetInterfaceip error in addcon")
-		return
+	for i, s := range ipNets {
+		if err = util.SetInterfaceIp(portName, ips[i].String()+prefixLen(s.subnet)); err != nil {
+			log.Println("SetInterfaceip error in addcon")
+			return
+		}
 	}
 
 	if err = util.SetInterfaceMac(portName, mac); err != nil {
@@ -262,14 +358,94 @@ func addConnection(nspid, networkName, requestIp string) (ovsConnection OvsConne
 		return
 	}
 
-	if err = util.SetDefaultGateway(bridgeNetwork.Gateway, portName); err != nil {
-		log.Println("SetdefaultGateway error in addcon")
-		return
+	for _, s := range ipNets {
+		if err = util.SetDefaultGateway(s.gateway.String(), portName); err != nil {
+			log.Println("SetdefaultGateway error in addcon")
+			return
+		}
 	}
 
 	return ovsConnection, nil
 }
 
+// one IP of each family of subnets, from the first subnet of the family
+// that is not full. A static requestIp is used for its family and must be
+// free. Nothing stays allocated on error
+func requestIPs(network *Network, subnets []networkSubnet, requestIp string) ([]net.IP, error) {
+	VNI := fmt.Sprint(network.VNI)
+
+	var static net.IP
+	if requestIp != "" {
+		if static = net.ParseIP(requestIp); static == nil {
+			return nil, &StaticIPError{IP: requestIp, Reason: "is not an IP address"}
+		}
+	}
+
+	families := subnetFamilies(subnets)
+	ips := make([]net.IP, 0, len(families))
+	release := func() {
+		for i, s := range ipSubnets(subnets, ips) {
+			ReleaseIP(ips[i], *s.subnet, VNI)
+		}
+	}
+
+	staticUsed := false
+	for _, family := range families {
+		var ip net.IP
+
+		if static != nil && isIPv6(family[0].subnet) == (static.To4() == nil) {
+			// if request ip, mark it used and use it
+			s := family[0]
+			for _, candidate := range family {
+				if candidate.subnet.Contains(static) {
+					s = candidate
+				}
+			}
+
+			pool, err := networkPool(network, *s.subnet)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			if err := pool.markStatic(VNI, static, s.gateway); err != nil {
+				release()
+				return nil, err
+			}
+			ip, staticUsed = static, true
+		} else {
+			// if not request a static ip, using system auto-choose
+			for _, s := range family {
+				pool, err := networkPool(network, *s.subnet)
+				if err != nil {
+					release()
+					return nil, err
+				}
+				if ip = pool.request(VNI); ip != nil {
+					break
+				}
+			}
+		}
+
+		if ip == nil {
+			release()
+			return nil, errors.New("No IP available in " + family[0].subnet.String())
+		}
+		ips = append(ips, ip)
+	}
+
+	if static != nil && !staticUsed {
+		release()
+		return nil, &StaticIPError{IP: requestIp, Reason: "is not in a subnet of " + network.Name}
+	}
+	return ips, nil
+}
+
+// "/24" for 10.1.42.0/24
+func prefixLen(subnet *net.IPNet) string {
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("/%d", ones)
+}
+
 func UpdateConnectionContext(ovsPort string, key string, context string) error {
 	return UpdatePortContext(ovsClient, ovsPort, key, context)
 }
@@ -292,23 +468,47 @@ func populateContextCache() {
 	}
 }
 
-func deleteConnection(connection OvsConnection, networkName string) error {
+func deleteConnection(con *Connection) error {
 	if ovsClient == nil {
 		return errors.New("OVS not connected")
 	}
-	deletePort(ovsClient, bridgeName, connection.Name)
-	ip := net.ParseIP(connection.Ip)
-	_, subnet, _ := net.ParseCIDR(connection.Ip + connection.Subnet)
+	deletePort(ovsClient, bridgeName, con.ConnectionDetail.Name)
+	return nil
+}
 
-	bridgeNetwork, err := GetNetwork(networkName)
+// give back the addresses of a deleted connection
+func releaseConnection(con *Connection) error {
+	connection := con.ConnectionDetail
+
+	bridgeNetwork, err := GetNetwork(con.Network)
 	if err != nil {
 		return err
 	}
+	VNI := fmt.Sprint(bridgeNetwork.VNI)
 
-	ReleaseIP(ip, *subnet, fmt.Sprint(bridgeNetwork.VNI))
+	release := func(addr, prefix string) {
+		ip := net.ParseIP(addr)
+		_, subnet, _ := net.ParseCIDR(addr + prefix)
+		releaseConnectionIP(VNI, ip, *subnet, con.ContainerID)
+	}
+
+	release(connection.Ip, connection.Subnet)
+	if connection.Ip6 != "" {
+		release(connection.Ip6, connection.Subnet6)
+	}
 	return nil
 }
 
+// give back an address of a connection of containerID, reserved addresses
+// stay with their reservation. The lease goes first so a reservation
+// deleted meanwhile releases them
+func releaseConnectionIP(VNI string, ip net.IP, subnet net.IPNet, containerID string) {
+	deleteLease(VNI, ip, containerID)
+	if !ipReserved(VNI, ip) {
+		ReleaseIP(ip, subnet, VNI)
+	}
+}
+
 // createOvsInternalPort will generate a random name for the
 // the port and ensure that it has been created
 func createOvsInternalPort(prefix string, bridge string, tag uint) (port string, err error) {
@@ -325,6 +525,12 @@ func createOvsInternalPort(prefix string, bridge string, tag uint) (port string,
 	return
 }
 
+// whether name is one createOvsInternalPort made for a container
+func isContainerPort(name string) bool {
+	return len(name) == len(containerPortPrefix)+7 && strings.HasPrefix(name, containerPortPrefix) &&
+		strings.Trim(name[len(containerPortPrefix):], "0123456789abcdef") == ""
+}
+
 // GenerateRandomName returns a new name joined with a prefix.  This size
 // specified is used to truncate the randomly generated value
 func GenerateRandomName(prefix string, size int) (string, error) {
@@ -351,12 +557,14 @@ func generateMacAddr(ip net.IP) net.HardwareAddr {
 
 	// Insert the IP address into the last 32 bits of the MAC address.
 	// This is a simple way to guarantee the address will be consistent and unique.
-	copy(hw[2:], ip.To4())
+	// IPv6 addresses are handed out from the start of the subnet, so their
+	// last 32 bits are unique too.
+	copy(hw[2:], ip.To16()[12:])
 
 	return hw
 }
 
-func setupIPTables(bridgeName string, bridgeIP string) error {
+func setupIPTables(bridgeName string, bridgeIP string, masquerade bool) error {
 	/*
 		# Enable IP Masquerade on all ifaces that are not bridgeName
 		# TO-DO need only one trunk interface as gw for per host only masquerade on that ip
@@ -367,8 +575,20 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	*/
 
 	log.Println("Setting up iptables")
+
+	// IPv6 subnets get the same rules from ip6tables
+	cmd := "iptables"
+	if ip, _, err := net.ParseCIDR(bridgeIP); err == nil && ip.To4() == nil {
+		cmd = "ip6tables"
+	}
+
 	natArgs := []string{"-t", "nat", "-A", "POSTROUTING", "-s", bridgeIP, "!", "-o", bridgeName, "-j", "MASQUERADE"}
-	output, err := installRule(natArgs...)
+	ruleOp := ensureRule
+	if !masquerade {
+		// routed network, drop the rule of an earlier nat mode
+		ruleOp = removeRule
+	}
+	output, err := ruleOp(cmd, natArgs...)
 	if err != nil {
 		log.Println("Unable to enable network bridge NAT:", err)
 		return fmt.Errorf("Unable to enable network bridge NAT: %s", err)
@@ -385,7 +605,7 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 			continue
 		}
 		outboundArgs := []string{"-A", "FORWARD", "-i", bridgeName, "-o", network.Name, "-j", "DROP"}
-		output, err = installRule(outboundArgs...)
+		output, err = ensureRule(cmd, outboundArgs...)
 		if err != nil {
 			log.Println("Unable to disable network outbound forwarding:", err)
 			return fmt.Errorf("Unable to disable network outbound forwarding: %s", err)
@@ -400,15 +620,60 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	return nil
 }
 
-func installRule(args ...string) ([]byte, error) {
-	path, err := exec.LookPath("iptables")
+// like installRule, but appends the rule only when iptables -C can't find
+// it, so setting up a network twice doesn't duplicate rules
+func ensureRule(cmd string, args ...string) ([]byte, error) {
+	check := make([]string, len(args))
+	copy(check, args)
+
+	for i, arg := range check {
+		if arg == "-A" {
+			check[i] = "-C"
+			break
+		}
+	}
+
+	if _, err := installRule(cmd, check...); err == nil {
+		return nil, nil
+	}
+	return installRule(cmd, args...)
+}
+
+// deletes a rule ensureRule appended, if iptables -C finds it
+func removeRule(cmd string, args ...string) ([]byte, error) {
+	check := make([]string, len(args))
+	copy(check, args)
+
+	for i, arg := range check {
+		if arg == "-A" {
+			check[i] = "-C"
+			break
+		}
+	}
+
+	if _, err := installRule(cmd, check...); err != nil {
+		return nil, nil
+	}
+
+	for i, arg := range check {
+		if arg == "-C" {
+			check[i] = "-D"
+			break
+		}
+	}
+	return installRule(cmd, check...)
+}
+
+// run iptables or ip6tables
+func installRule(cmd string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(cmd)
 	if err != nil {
-		return nil, errors.New("iptables not found")
+		return nil, errors.New(cmd + " not found")
 	}
 
 	output, err := exec.Command(path, args...).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("iptables failed: iptables %v: %s (%s)", strings.Join(args, " "), output, err)
+		return nil, fmt.Errorf("%s failed: %s %v: %s (%s)", cmd, cmd, strings.Join(args, " "), output, err)
 	}
 
 	return output, err
@@ -6,8 +6,8 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
 	"github.com/codegangsta/cli"
 )
 
@@ -74,6 +74,8 @@ type Daemon struct {
 	isReady        bool
 	Gateways       map[string]struct{} //network set
 	expServerNum   string
+	storeBackend   string
+	reconciler     *networkReconciler
 }
 
 type NodeCtx struct {
@@ -98,18 +100,51 @@ func NewDaemon() *Daemon {
 		false,
 		make(map[string]struct{}, 50),
 		"1",
+		consulBackend,
+		nil,
 	}
+	daemon.reconciler = newNetworkReconciler(daemon)
 	return daemon
 }
 func (d *Daemon) Run(ctx *cli.Context) {
 	d.isServer = ctx.Bool("server")
 	d.expServerNum = ctx.String("expectedServerNum")
+	d.storeBackend = ctx.String("store")
+
+	consulConfig := &netAgent.Config{
+		Address:       ctx.String("consul-addr"),
+		Scheme:        ctx.String("consul-scheme"),
+		CAFile:        ctx.String("consul-ca"),
+		CertFile:      ctx.String("consul-cert"),
+		KeyFile:       ctx.String("consul-key"),
+		Token:         ctx.String("consul-token"),
+		ACLDatacenter: ctx.String("consul-acl-dc"),
+		Encrypt:       ctx.String("encrypt"),
+	}
+	if err := netAgent.SetConfig(consulConfig); err != nil {
+		log.Println("bad consul config", err)
+		os.Exit(1)
+	}
+
+	reserved, err := parseVNIRanges(ctx.String("vni-reserved"))
+	if err != nil {
+		log.Println("bad reserved VNIs", err)
+		os.Exit(1)
+	}
+	reservedVNIs = reserved
+
+	if subnetPool, err = parseSubnetPool(ctx.String("subnet-pool"), ctx.Int("subnet-prefix")); err != nil {
+		log.Println("bad subnet pool", err)
+		os.Exit(1)
+	}
 
 	// set up dir use for netns
 	if err := os.Mkdir("/var/run/netns", 0777); err != nil {
 		log.Println("mkdir /var/run/netns failed", err)
 	}
 
+	initOVS()
+
 	// start a goroutine to serve api
 	go ServeApi(d)
 
@@ -134,18 +169,23 @@ func (d *Daemon) Run(ctx *cli.Context) {
 
 		//wait data store backend ready
 		<-d.readyChan
-		// wait 2 seconds for raft to elect a leader
-		time.Sleep(2 * time.Second)
 		log.Println("ready to work !")
-		if d.isServer {
-			//server agent create default network
-			if _, err := CreateDefaultNetwork(); err != nil {
-				log.Println("Create cxy network error", err.Error())
-			}
-
+		if d.runsForLeader() {
+			// one server at a time runs the cluster singleton duties,
+			// like creating the default network
+			go netAgent.RunForLeader(leaderKey, nil, func(lostCh <-chan struct{}) {
+				leaderHandler(d, lostCh)
+			})
 		}
 
-		syncNetwork(d)
+		// give back the IPs of containers removed behind our back
+		go leaseGC(d)
+
+		// let the other nodes check new subnets against our routes
+		go routePublisher()
+
+		// keep the local gateways in line with the network store
+		d.reconciler.run()
 	}()
 
 	//start a goroutine to manage connection
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// IP pools
+// a pool says which addresses of a subnet may be handed out. Bit i of the
+// ip bitmap of a subnet stands for the subnet address + i + 1, the network
+// address has no bit, the broadcast address and the bits past the end of the
+// subnet are never handed out
+
+// first and last address of an allocation range, both included
+type IPRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// bitmap positions, both included
+type posRange struct {
+	start, end uint32
+}
+
+func (r posRange) contains(pos uint32) bool {
+	return pos >= r.start && pos <= r.end
+}
+
+type ipPool struct {
+	subnet net.IPNet
+	// last position of the subnet that may be handed out
+	last uint32
+	// positions automatic allocation takes addresses from, sorted
+	ranges []posRange
+	// positions never handed out
+	exclude []posRange
+	// positions only handed out on explicit request
+	reserved map[uint32]bool
+}
+
+// the pool of a whole subnet without network and broadcast address
+func newIPPool(subnet net.IPNet) *ipPool {
+	last := lastPos(subnet)
+	return &ipPool{
+		subnet:   subnet,
+		last:     last,
+		ranges:   []posRange{{0, last}},
+		reserved: make(map[uint32]bool),
+	}
+}
+
+// last position that may be handed out, the broadcast address is the last
+// address of an IPv4 subnet
+func lastPos(subnet net.IPNet) uint32 {
+	bits := uint32(ipBitmapSize(subnet) * 8)
+	count := util.IPCount(subnet)
+
+	if isIPv6(&subnet) {
+		if count > float64(bits) {
+			return bits - 1
+		}
+		return uint32(count) - 2
+	}
+	if count < 4 {
+		// networkPool refuses these
+		return 0
+	}
+	return uint32(count) - 3
+}
+
+// the pool of subnet of network, checks ranges, exclusions and reserved
+// addresses of network that fall into subnet
+func networkPool(network *Network, subnet net.IPNet) (*ipPool, error) {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("subnet " + subnet.String() + " is too small")
+	}
+
+	pool := newIPPool(subnet)
+	last := pool.last
+
+	var ranges []posRange
+	for _, r := range network.Ranges {
+		start, end := net.ParseIP(r.Start), net.ParseIP(r.End)
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("invalid range %s-%s", r.Start, r.End)
+		}
+		if !subnet.Contains(start) && !subnet.Contains(end) {
+			continue
+		}
+
+		startPos, endPos := ipPos(start, subnet), ipPos(end, subnet)
+		if !subnet.Contains(start) || !subnet.Contains(end) || startPos > last || endPos > last {
+			return nil, fmt.Errorf("range %s-%s is not in the usable part of %s", r.Start, r.End, subnet.String())
+		}
+		if startPos > endPos {
+			return nil, fmt.Errorf("range %s-%s ends before it starts", r.Start, r.End)
+		}
+		ranges = append(ranges, posRange{startPos, endPos})
+	}
+
+	if len(ranges) != 0 {
+		sort.Sort(byStart(ranges))
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].start <= ranges[i-1].end {
+				return nil, errors.New("allocation ranges overlap")
+			}
+		}
+		pool.ranges = ranges
+	}
+
+	for _, exclude := range network.Exclude {
+		r, ok, err := excludeRange(exclude, subnet)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			pool.exclude = append(pool.exclude, r)
+		}
+	}
+
+	for _, reserved := range network.Reserved {
+		ip := net.ParseIP(reserved)
+		if ip == nil {
+			return nil, errors.New("invalid reserved address " + reserved)
+		}
+		if !subnet.Contains(ip) {
+			continue
+		}
+
+		pos := ipPos(ip, subnet)
+		if pos > last {
+			return nil, fmt.Errorf("reserved address %s is not in the usable part of %s", reserved, subnet.String())
+		}
+		pool.reserved[pos] = true
+	}
+
+	return pool, nil
+}
+
+// positions of an excluded IP or CIDR inside subnet, false if it is
+// outside of subnet
+func excludeRange(exclude string, subnet net.IPNet) (posRange, bool, error) {
+	excluded := &net.IPNet{}
+	if ip := net.ParseIP(exclude); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		excluded.IP, excluded.Mask = ip, net.CIDRMask(bits, bits)
+	} else {
+		var err error
+		if _, excluded, err = net.ParseCIDR(exclude); err != nil {
+			return posRange{}, false, errors.New("invalid excluded address " + exclude)
+		}
+	}
+
+	if isIPv6(excluded) != isIPv6(&subnet) || !util.NetworkOverlaps(excluded, &subnet) {
+		return posRange{}, false, nil
+	}
+
+	first, last := util.NetworkRange(excluded)
+	start, end := ipOffset(first, subnet), ipOffset(last, subnet)
+
+	// clip to the bitmap
+	bits := big.NewInt(int64(ipBitmapSize(subnet) * 8))
+	one := big.NewInt(1)
+	if start.Cmp(one) < 0 {
+		start = one
+	}
+	if end.Cmp(bits) > 0 {
+		end = bits
+	}
+	if start.Cmp(end) > 0 {
+		return posRange{}, false, nil
+	}
+	return posRange{uint32(start.Uint64() - 1), uint32(end.Uint64() - 1)}, true, nil
+}
+
+// addr - subnet address
+func ipOffset(addr net.IP, subnet net.IPNet) *big.Int {
+	offset := new(big.Int).SetBytes(ipBytes(addr, subnet))
+	return offset.Sub(offset, new(big.Int).SetBytes(ipBytes(subnet.IP, subnet)))
+}
+
+func (p *ipPool) excluded(pos uint32) bool {
+	for _, r := range p.exclude {
+		if r.contains(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether pos may be handed out without being asked for
+func (p *ipPool) usable(pos uint32) bool {
+	return pos <= p.last && !p.excluded(pos) && !p.reserved[pos]
+}
+
+// check the ranges, exclusions and reserved addresses of network against
+// its subnets
+func (n *Network) checkPools() error {
+	subnets, err := n.subnets()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range subnets {
+		if _, err := networkPool(n, *s.subnet); err != nil {
+			return err
+		}
+	}
+
+	inSubnet := func(ip net.IP) bool {
+		for _, s := range subnets {
+			if s.subnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range n.Ranges {
+		if !inSubnet(net.ParseIP(r.Start)) {
+			return fmt.Errorf("range %s-%s is not in a subnet of %s", r.Start, r.End, n.Name)
+		}
+	}
+	for _, reserved := range n.Reserved {
+		if !inSubnet(net.ParseIP(reserved)) {
+			return fmt.Errorf("reserved address %s is not in a subnet of %s", reserved, n.Name)
+		}
+	}
+	for _, exclude := range n.Exclude {
+		found := false
+		for _, s := range subnets {
+			if _, ok, _ := excludeRange(exclude, *s.subnet); ok {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("excluded address %s is not in a subnet of %s", exclude, n.Name)
+		}
+	}
+	return nil
+}
+
+// StaticIPError is a static IP request that can't be served, Conflict is
+// true if the address is taken, else the request itself is wrong
+type StaticIPError struct {
+	IP       string
+	Reason   string
+	Conflict bool
+}
+
+func (e *StaticIPError) Error() string {
+	return "requested IP " + e.IP + " " + e.Reason
+}
+
+// check that ip may be asked for and mark it used in one write, an address
+// already marked used is refused. Reserved addresses may be asked for
+func (p *ipPool) markStatic(VNI string, ip net.IP, gateway net.IP) error {
+	badRequest := func(reason string) error {
+		return &StaticIPError{IP: ip.String(), Reason: reason}
+	}
+
+	if !p.subnet.Contains(ip) {
+		return badRequest("is not in " + p.subnet.String())
+	}
+	if gateway != nil && gateway.Equal(ip) {
+		return badRequest("is the gateway of " + p.subnet.String())
+	}
+
+	pos := ipPos(ip, p.subnet)
+	if pos > p.last {
+		return badRequest("is not a usable address of " + p.subnet.String())
+	}
+	if p.excluded(pos) {
+		return badRequest("is excluded from " + p.subnet.String())
+	}
+
+	migrateIPBitmap(VNI, p.subnet)
+
+	key := ipBlockKey(VNI, p.subnet, pos/ipBlockBits)
+	for conflicts := 0; conflicts < maxIPConflicts; conflicts++ {
+		bits, index, result := netAgent.Lookup(ipStore, key)
+		if result != netAgent.OK {
+			return errors.New("Error reading the IPs of " + p.subnet.String())
+		}
+		if index == 0 {
+			bits = make([]byte, ipBlockBytes)
+		}
+
+		if util.IsSet(bits, pos%ipBlockBits) {
+			return &StaticIPError{IP: ip.String(), Reason: "is already allocated", Conflict: true}
+		}
+		util.Set(bits, pos%ipBlockBits)
+
+		switch netAgent.CAS(ipStore, key, bits, index) {
+		case netAgent.OK:
+			return nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return errors.New("Error marking " + ip.String() + " used")
+		}
+	}
+	return errors.New("Too many conflicts marking " + ip.String() + " used")
+}
+
+type byStart []posRange
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Less(i, j int) bool { return s[i].start < s[j].start }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
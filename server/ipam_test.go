@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+// network and broadcast address are never handed out
+func TestPoolBroadcast(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.70.0.0/29")
+	for i := 1; i <= 6; i++ {
+		if addr := requestIP("1", *subnet).To4(); addr == nil || int(addr[3]) != i {
+			t.Fatal(addr, "is wrong")
+		}
+	}
+	if addr := requestIP("1", *subnet); addr != nil {
+		t.Fatal("broadcast address handed out", addr)
+	}
+
+	// no broadcast in IPv6
+	_, subnet6, _ := net.ParseCIDR("fd00:70::/125")
+	for i := 1; i <= 7; i++ {
+		if addr := requestIP("1", *subnet6); addr == nil {
+			t.Fatal("IPv6 subnet exhausted after", i-1)
+		}
+	}
+	if addr := requestIP("1", *subnet6); addr != nil {
+		t.Fatal("address past the subnet handed out", addr)
+	}
+}
+
+func TestPoolRangesExcludeReserved(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.60.0.0/24")
+	options := NetworkOptions{
+		Ranges:   []IPRange{{"10.60.0.100", "10.60.0.103"}},
+		Exclude:  []string{"10.60.0.0/30", "10.60.0.101"},
+		Reserved: []string{"10.60.0.4", "10.60.0.102"},
+	}
+
+	network, err := createNetworkRecord("pool", subnet, nil, options)
+	if err != nil || network.Gateway != "10.60.0.5" {
+		t.Fatal("gateway must skip excluded and reserved addresses", network, err)
+	}
+
+	stored, err := GetNetwork("pool")
+	if err != nil || len(stored.Ranges) != 1 || len(stored.Exclude) != 2 || len(stored.Reserved) != 2 {
+		t.Fatal("pool settings not stored", stored, err)
+	}
+
+	subnets, _ := network.subnets()
+	for _, expected := range []string{"10.60.0.100", "10.60.0.103"} {
+		ips, err := requestIPs(network, subnets, "")
+		if err != nil || ips[0].String() != expected {
+			t.Fatal("expected", expected, ips, err)
+		}
+	}
+	if ips, err := requestIPs(network, subnets, ""); err == nil {
+		t.Fatal("range must be exhausted", ips)
+	}
+
+	// reserved addresses can still be asked for
+	if ips, err := requestIPs(network, subnets, "10.60.0.102"); err != nil || ips[0].String() != "10.60.0.102" {
+		t.Fatal("static request of a reserved address failed", ips, err)
+	}
+}
+
+func TestPoolInvalid(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.80.0.0/24")
+	invalid := []NetworkOptions{
+		{Ranges: []IPRange{{"10.80.0.10", "10.80.1.10"}}},
+		{Ranges: []IPRange{{"10.80.0.20", "10.80.0.10"}}},
+		{Ranges: []IPRange{{"10.80.0.10", "10.80.0.20"}, {"10.80.0.15", "10.80.0.30"}}},
+		{Ranges: []IPRange{{"10.80.0.10", "10.80.0.255"}}},
+		{Ranges: []IPRange{{"10.90.0.10", "10.90.0.20"}}},
+		{Exclude: []string{"10.90.0.0/24"}},
+		{Exclude: []string{"bogus"}},
+		{Reserved: []string{"10.90.0.1"}},
+	}
+
+	for i, options := range invalid {
+		if _, err := createNetworkRecord("invalid", subnet, nil, options); err == nil {
+			t.Fatal("invalid pool", i, "accepted", options)
+		}
+	}
+
+	_, tiny, _ := net.ParseCIDR("10.80.1.0/31")
+	if _, err := createNetworkRecord("tiny", tiny, nil, NetworkOptions{}); err == nil {
+		t.Fatal("/31 must be rejected")
+	}
+
+	if _, _, ok := netAgent.Get(vlanStore, vniKey); ok {
+		t.Fatal("rejected networks must not allocate a VNI")
+	}
+}
+
+func TestStaticIP(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.61.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:61::/64")
+	options := NetworkOptions{
+		Subnet6: subnet6,
+		Exclude: []string{"10.61.0.240/28"},
+	}
+	network, err := createNetworkRecord("static", subnet, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+
+	invalid := []string{
+		"bogus",
+		network.Gateway,
+		"10.61.0.0",
+		"10.61.0.255",
+		"10.61.0.245",
+		"10.62.0.10",
+		network.Gateway6,
+	}
+	for _, requestIp := range invalid {
+		ips, err := requestIPs(network, subnets, requestIp)
+		if staticErr, ok := err.(*StaticIPError); !ok || staticErr.Conflict {
+			t.Fatal(requestIp, "must be refused as a bad request", ips, err)
+		}
+	}
+
+	ips, err := requestIPs(network, subnets, "10.61.0.10")
+	if err != nil || ips[0].String() != "10.61.0.10" || len(ips) != 2 {
+		t.Fatal("static request failed", ips, err)
+	}
+
+	// taken, the IPv6 address allocated meanwhile is given back
+	if _, err := requestIPs(network, subnets, "10.61.0.10"); err == nil || !err.(*StaticIPError).Conflict {
+		t.Fatal("second request of an address must conflict", err)
+	}
+	if _, err := requestIPs(network, subnets, ips[1].String()); err == nil || !err.(*StaticIPError).Conflict {
+		t.Fatal("second request of an IPv6 address must conflict", err)
+	}
+
+	next, err := requestIPs(network, subnets, "")
+	if err != nil || next[1].Equal(ips[1]) || ipPos(next[1], *subnet6) != ipPos(ips[1], *subnet6)+1 {
+		t.Fatal("addresses of refused requests not released", ips, next, err)
+	}
+}
+
+// a store that can't be read or keeps conflicting fails the allocation
+// instead of retrying forever
+func TestStaticIPStoreFailure(t *testing.T) {
+	store := &brokenStore{Store: netAgent.NewMemoryStore()}
+	netAgent.SetStore(store)
+
+	_, subnet, _ := net.ParseCIDR("10.66.0.0/24")
+	network, err := createNetworkRecord("storefail", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := networkPool(network, *subnet)
+	VNI := fmt.Sprint(network.VNI)
+
+	store.broken = ipStore
+	for _, result := range []int{netAgent.ERROR, netAgent.OUTDATED} {
+		store.result = result
+
+		err := pool.markStatic(VNI, net.ParseIP("10.66.0.10"), nil)
+		if _, static := err.(*StaticIPError); err == nil || static {
+			t.Fatal("static request with a failing store", result, err)
+		}
+		if ip := pool.request(VNI); ip != nil {
+			t.Fatal("allocated with a failing store", result, ip)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// IP blocks
+// the ip bitmap of a subnet is sharded in blocks of ipBlockBits addresses,
+// one ipStore key each, so an allocation rewrites ipBlockBytes whatever the
+// size of the subnet. A missing block is all free, blocks are created on
+// first use. Every node starts where it last allocated and moves on to the
+// next block when the block is full or another node is writing it, so
+// nodes starting containers at once spread over different keys
+
+const (
+	ipBlockBits  = 256
+	ipBlockBytes = ipBlockBits / 8
+	// write conflicts one allocation tolerates before giving up
+	maxIPConflicts = 64
+)
+
+func ipBlockKey(VNI string, subnet net.IPNet, block uint32) string {
+	return blockKey(ipKey(VNI, subnet), block)
+}
+
+func blockKey(base string, block uint32) string {
+	return base + "/b" + strconv.FormatUint(uint64(block), 10)
+}
+
+// ipKey and block of a block key, false for a whole subnet bitmap written
+// by an older release
+func splitIPBlockKey(key string) (string, uint32, bool) {
+	i := strings.LastIndex(key, "/b")
+	if i < 0 {
+		return key, 0, false
+	}
+
+	block, err := strconv.ParseUint(key[i+2:], 10, 32)
+	if err != nil {
+		return key, 0, false
+	}
+	return key[:i], uint32(block), true
+}
+
+// the non empty blocks of a whole subnet bitmap
+func splitIPBitmap(bitmap []byte) map[uint32][]byte {
+	blocks := make(map[uint32][]byte)
+
+	for start := 0; start < len(bitmap); start += ipBlockBytes {
+		end := start + ipBlockBytes
+		if end > len(bitmap) {
+			end = len(bitmap)
+		}
+
+		for _, b := range bitmap[start:end] {
+			if b != 0 {
+				bits := make([]byte, ipBlockBytes)
+				copy(bits, bitmap[start:end])
+				blocks[uint32(start/ipBlockBytes)] = bits
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// block a node allocated from last, by ipKey
+var ipCursors = struct {
+	sync.Mutex
+	m map[string]uint32
+}{m: make(map[string]uint32)}
+
+func getIPCursor(base string) (uint32, bool) {
+	ipCursors.Lock()
+	defer ipCursors.Unlock()
+
+	block, ok := ipCursors.m[base]
+	return block, ok
+}
+
+func setIPCursor(base string, block uint32) {
+	ipCursors.Lock()
+	defer ipCursors.Unlock()
+
+	ipCursors.m[base] = block
+}
+
+func clearIPCursor(base string) {
+	ipCursors.Lock()
+	defer ipCursors.Unlock()
+
+	delete(ipCursors.m, base)
+}
+
+// ipKeys already split in blocks
+var migratedIPKeys = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// split the whole subnet bitmap of an older release in blocks, once
+func migrateIPBitmap(VNI string, subnet net.IPNet) {
+	base := ipKey(VNI, subnet)
+
+	migratedIPKeys.Lock()
+	migrated := migratedIPKeys.m[base]
+	migratedIPKeys.Unlock()
+	if migrated {
+		return
+	}
+
+	for {
+		bitmap, index, ok := netAgent.Get(ipStore, base)
+		if !ok {
+			break
+		}
+
+		ops := []netAgent.TxnOp{{Store: ipStore, Key: base, Index: index, Delete: true}}
+		for block, bits := range splitIPBitmap(bitmap) {
+			key := blockKey(base, block)
+
+			// merge with what newer nodes allocated meanwhile
+			existing, blockIndex, ok := netAgent.Get(ipStore, key)
+			if ok {
+				for i := range bits {
+					if i < len(existing) {
+						bits[i] |= existing[i]
+					}
+				}
+			}
+			ops = append(ops, netAgent.TxnOp{Store: ipStore, Key: key, Value: bits, Index: blockIndex})
+		}
+
+		result := netAgent.Txn(ops...)
+		if result == netAgent.OK {
+			log.Println("ip bitmap", base, "split in blocks")
+			break
+		}
+		if result != netAgent.OUTDATED {
+			log.Println("Error splitting ip bitmap", base)
+			return
+		}
+	}
+
+	migratedIPKeys.Lock()
+	migratedIPKeys.m[base] = true
+	migratedIPKeys.Unlock()
+}
+
+// whether pos is in the allocation ranges
+func (p *ipPool) inRange(pos uint32) bool {
+	for _, r := range p.ranges {
+		if r.contains(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether block holds positions of the ranges
+func (p *ipPool) blockInRanges(block uint32) bool {
+	for _, r := range p.ranges {
+		if block >= r.start/ipBlockBits && block <= r.end/ipBlockBits {
+			return true
+		}
+	}
+	return false
+}
+
+// number of blocks holding positions of the ranges
+func (p *ipPool) rangeBlocks() int {
+	count := 0
+	next := uint32(0)
+
+	for _, r := range p.ranges {
+		first, last := r.start/ipBlockBits, r.end/ipBlockBits
+		if first < next {
+			first = next
+		}
+		if first <= last {
+			count += int(last-first) + 1
+			next = last + 1
+		}
+	}
+	return count
+}
+
+// the block after block holding positions of the ranges, wraps around
+func (p *ipPool) nextBlock(block uint32) uint32 {
+	for _, r := range p.ranges {
+		first, last := r.start/ipBlockBits, r.end/ipBlockBits
+		if block < first {
+			return first
+		}
+		if block < last {
+			return block + 1
+		}
+	}
+	return p.ranges[0].start / ipBlockBits
+}
+
+// take the first free position of block inside the ranges, full is true if
+// there is none
+func (p *ipPool) allocInBlock(base string, block uint32) (pos uint32, full bool, result int) {
+	key := blockKey(base, block)
+
+	bits, index, result := netAgent.Lookup(ipStore, key)
+	if result != netAgent.OK {
+		return 0, false, result
+	}
+	if index == 0 {
+		bits = make([]byte, ipBlockBytes)
+	}
+
+	for i := uint32(0); i < ipBlockBits; i++ {
+		pos = block*ipBlockBits + i
+		if util.IsSet(bits, i) || !p.inRange(pos) || !p.usable(pos) {
+			continue
+		}
+
+		util.Set(bits, i)
+		return pos, false, netAgent.CAS(ipStore, key, bits, index)
+	}
+	return 0, true, netAgent.OK
+}
+
+// Get an IP from the pool and mark it as used
+func (p *ipPool) request(VNI string) net.IP {
+	migrateIPBitmap(VNI, p.subnet)
+
+	base := ipKey(VNI, p.subnet)
+
+	block, ok := getIPCursor(base)
+	if !ok || !p.blockInRanges(block) {
+		block = p.ranges[0].start / ipBlockBits
+	}
+
+	total := p.rangeBlocks()
+	full := make(map[uint32]bool)
+	conflicts := 0
+
+	for len(full) < total && conflicts < maxIPConflicts {
+		pos, isFull, result := p.allocInBlock(base, block)
+
+		switch {
+		case isFull:
+			full[block] = true
+		case result == netAgent.OK:
+			setIPCursor(base, block)
+			return ipFromPos(pos+1, p.subnet)
+		case result == netAgent.OUTDATED:
+			// someone else is allocating here, try the next block
+			conflicts++
+		default:
+			log.Println("Error allocating IP in", p.subnet.String(), "of vlan", VNI)
+			return nil
+		}
+
+		block = p.nextBlock(block)
+	}
+
+	log.Println("No IP available in", p.subnet.String(), "of vlan", VNI)
+	return nil
+}
+
+// the ipStore write marking the gateway of the subnet of pool used, a nil
+// gateway takes the first usable IP, inside the ranges or not
+func gatewayOp(VNI string, pool *ipPool, gateway net.IP) (netAgent.TxnOp, net.IP, error) {
+	subnet := pool.subnet
+	base := ipKey(VNI, subnet)
+
+	getBlock := func(block uint32) ([]byte, int) {
+		bits, index, ok := netAgent.Get(ipStore, blockKey(base, block))
+		if !ok {
+			return make([]byte, ipBlockBytes), 0
+		}
+		return bits, index
+	}
+
+	if gateway != nil {
+		pos := ipPos(gateway, subnet)
+		if pos >= uint32(ipBitmapSize(subnet)*8) {
+			return netAgent.TxnOp{}, nil, errors.New("gateway " + gateway.String() + " not in " + subnet.String())
+		}
+
+		block := pos / ipBlockBits
+		bits, index := getBlock(block)
+		util.Set(bits, pos%ipBlockBits)
+		return netAgent.TxnOp{Store: ipStore, Key: blockKey(base, block), Value: bits, Index: index}, gateway, nil
+	}
+
+	for block := uint32(0); block*ipBlockBits <= pool.last; block++ {
+		bits, index := getBlock(block)
+
+		for i := uint32(0); i < ipBlockBits; i++ {
+			pos := block*ipBlockBits + i
+			if pos > pool.last {
+				break
+			}
+			if util.IsSet(bits, i) || !pool.usable(pos) {
+				continue
+			}
+
+			util.Set(bits, i)
+			op := netAgent.TxnOp{Store: ipStore, Key: blockKey(base, block), Value: bits, Index: index}
+			return op, ipFromPos(pos+1, subnet), nil
+		}
+	}
+	return netAgent.TxnOp{}, nil, errors.New("No IP available in " + subnet.String())
+}
+
+// whether pos of the subnet with ipKey base is marked used in s, blocks or
+// whole bitmap
+func ipUsed(s netAgent.Store, base string, pos uint32) bool {
+	if bits, _, ok := s.Get(ipStore, blockKey(base, pos/ipBlockBits)); ok {
+		return util.IsSet(bits, pos%ipBlockBits)
+	}
+	if bitmap, _, ok := s.Get(ipStore, base); ok {
+		return util.IsSet(bitmap, pos)
+	}
+	return false
+}
+
+// snapshot pairs of ipStore with whole subnet bitmaps split in blocks
+func splitIPPairs(pairs []SnapshotPair) []SnapshotPair {
+	blocks := make(map[string][]byte)
+	var keys []string
+
+	add := func(key string, bits []byte) {
+		existing, ok := blocks[key]
+		if !ok {
+			blocks[key] = bits
+			keys = append(keys, key)
+			return
+		}
+		for i := range bits {
+			if i < len(existing) {
+				existing[i] |= bits[i]
+			}
+		}
+	}
+
+	for _, pair := range pairs {
+		if _, _, ok := splitIPBlockKey(pair.Key); ok {
+			add(pair.Key, append([]byte(nil), pair.Value...))
+			continue
+		}
+		for block, bits := range splitIPBitmap(pair.Value) {
+			add(blockKey(pair.Key, block), bits)
+		}
+	}
+
+	split := make([]SnapshotPair, 0, len(keys))
+	for _, key := range keys {
+		split = append(split, SnapshotPair{key, blocks[key]})
+	}
+	return split
+}
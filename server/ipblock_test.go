@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+func TestIPBlocks(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.90.0.0/22")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		addr := requestIP("1", *subnet)
+		if addr == nil || seen[addr.String()] || !subnet.Contains(addr) {
+			t.Fatal("bad address", addr, "at", i)
+		}
+		seen[addr.String()] = true
+	}
+
+	for block := uint32(0); block < 2; block++ {
+		bits, _, ok := netAgent.Get(ipStore, ipBlockKey("1", *subnet, block))
+		if !ok || len(bits) != ipBlockBytes {
+			t.Fatal("block", block, "missing or of the wrong size", len(bits))
+		}
+	}
+	if _, _, ok := netAgent.Get(ipStore, ipBlockKey("1", *subnet, 2)); ok {
+		t.Fatal("block 2 must not exist yet")
+	}
+
+	if !ReleaseIP(net.ParseIP("10.90.0.10"), *subnet, "1") || newIPPool(*subnet).markStatic("1", net.ParseIP("10.90.3.200"), nil) != nil {
+		t.Fatal("ReleaseIP or markStatic failed")
+	}
+	if ReleaseIP(net.ParseIP("10.90.2.10"), *subnet, "1") {
+		t.Fatal("releasing in a missing block must fail")
+	}
+}
+
+// a range spanning two blocks is exhausted exactly
+func TestIPBlocksRangeExhausted(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.91.0.0/22")
+	network := &Network{
+		Name:   "blocks",
+		Subnet: subnet.String(),
+		Ranges: []IPRange{{"10.91.0.250", "10.91.1.5"}},
+	}
+
+	pool, err := networkPool(network, *subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 11; i++ {
+		addr := pool.request("1")
+		if addr == nil {
+			t.Fatal("range exhausted after", i)
+		}
+	}
+	if addr := pool.request("1"); addr == nil || addr.String() != "10.91.1.5" {
+		t.Fatal("last address of the range expected", addr)
+	}
+	if addr := pool.request("1"); addr != nil {
+		t.Fatal("address outside the range", addr)
+	}
+}
+
+// whole subnet bitmaps of older releases are split in blocks on first use
+func TestMigrateIPBitmap(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.92.0.0/22")
+	bitmap := make([]byte, ipBitmapSize(*subnet))
+	for i := uint32(0); i < 300; i++ {
+		util.Set(bitmap, i)
+	}
+	netAgent.Put(ipStore, ipKey("5", *subnet), bitmap, nil)
+
+	if addr := requestIP("5", *subnet); addr == nil || addr.String() != "10.92.1.45" {
+		t.Fatal("allocation must continue after the migrated addresses", addr)
+	}
+
+	if _, _, ok := netAgent.Get(ipStore, ipKey("5", *subnet)); ok {
+		t.Fatal("whole subnet bitmap must be gone")
+	}
+
+	pairs := splitIPPairs([]SnapshotPair{{ipKey("6", *subnet), bitmap}})
+	if len(pairs) != 2 {
+		t.Fatal("expected 2 blocks", pairs)
+	}
+	for _, pair := range pairs {
+		if base, _, ok := splitIPBlockKey(pair.Key); !ok || base != ipKey("6", *subnet) {
+			t.Fatal("bad block key", pair.Key)
+		}
+	}
+}
+
+// an address of the whole subnet from the allocator requestIPs uses
+func requestIP(VNI string, subnet net.IPNet) net.IP {
+	return newIPPool(subnet).request(VNI)
+}
+
+// the allocator before blocks, one bitmap per subnet scanned from the start
+func requestIPBitmap(VNI string, subnet net.IPNet) net.IP {
+	var pos uint32
+
+	ok := casUpdate(ipStore, ipKey(VNI, subnet), make([]byte, ipBitmapSize(subnet)), func(ipArray []byte) bool {
+		pos = util.TestAndSet(ipArray)
+		return pos <= uint32(len(ipArray)*8)
+	})
+	if !ok {
+		return nil
+	}
+	return ipFromPos(pos, subnet)
+}
+
+func benchmarkRequestIP(b *testing.B, cidr string, request func(string, net.IPNet) net.IP) {
+	_, subnet, _ := net.ParseCIDR(cidr)
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if request("1", *subnet) == nil {
+			b.StopTimer()
+			netAgent.SetStore(netAgent.NewMemoryStore())
+			b.StartTimer()
+		}
+	}
+}
+
+func benchmarkRequestIPParallel(b *testing.B, cidr string, request func(string, net.IPNet) net.IP) {
+	_, subnet, _ := net.ParseCIDR(cidr)
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request("1", *subnet)
+		}
+	})
+}
+
+func BenchmarkRequestIPBitmap16(b *testing.B) { benchmarkRequestIP(b, "10.0.0.0/16", requestIPBitmap) }
+func BenchmarkRequestIPBlocks16(b *testing.B) { benchmarkRequestIP(b, "10.0.0.0/16", requestIP) }
+func BenchmarkRequestIPBitmap12(b *testing.B) { benchmarkRequestIP(b, "10.0.0.0/12", requestIPBitmap) }
+func BenchmarkRequestIPBlocks12(b *testing.B) { benchmarkRequestIP(b, "10.0.0.0/12", requestIP) }
+
+func BenchmarkRequestIPBitmapParallel(b *testing.B) {
+	benchmarkRequestIPParallel(b, "10.0.0.0/12", requestIPBitmap)
+}
+
+func BenchmarkRequestIPBlocksParallel(b *testing.B) {
+	benchmarkRequestIPParallel(b, "10.0.0.0/12", requestIP)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// labels
+// networks and connections carry free form key/value labels, keys can't be
+// empty nor hold the = and ! of label selectors. List requests take
+// selectors as label query parameters, like ?label=team=payments, all of
+// them must match
+
+func checkLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" || strings.ContainsAny(key, "=!,") {
+			return errors.New("invalid label key \"" + key + "\"")
+		}
+	}
+	return nil
+}
+
+// key=value, key!=value or key, which only needs the key to exist
+type labelRequirement struct {
+	key   string
+	value string
+	op    string
+}
+
+type labelSelector []labelRequirement
+
+// parse the label query parameters, each a comma separated list of
+// requirements
+func parseLabelSelector(params []string) (labelSelector, error) {
+	var selector labelSelector
+
+	for _, param := range params {
+		for _, req := range strings.Split(param, ",") {
+			var r labelRequirement
+			switch {
+			case strings.Contains(req, "!="):
+				parts := strings.SplitN(req, "!=", 2)
+				r = labelRequirement{parts[0], parts[1], "!="}
+			case strings.Contains(req, "="):
+				parts := strings.SplitN(req, "=", 2)
+				r = labelRequirement{parts[0], parts[1], "="}
+			default:
+				r = labelRequirement{key: req}
+			}
+
+			if r.key == "" || strings.ContainsAny(r.key, "=!") {
+				return nil, errors.New("invalid label selector \"" + req + "\"")
+			}
+			selector = append(selector, r)
+		}
+	}
+	return selector, nil
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			ok = ok && value == r.value
+		case "!=":
+			ok = !ok || value != r.value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
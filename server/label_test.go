@@ -0,0 +1,41 @@
+package server
+
+import "testing"
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"team": "payments", "tier": "db"}
+
+	expected := []struct {
+		params  []string
+		matches bool
+	}{
+		{nil, true},
+		{[]string{"team=payments"}, true},
+		{[]string{"team=payments", "tier=web"}, false},
+		{[]string{"team=payments,tier=db"}, true},
+		{[]string{"tier!=web"}, true},
+		{[]string{"team!=payments"}, false},
+		{[]string{"owner!=me"}, true},
+		{[]string{"tier"}, true},
+		{[]string{"owner"}, false},
+		{[]string{"team="}, false},
+	}
+	for _, e := range expected {
+		selector, err := parseLabelSelector(e.params)
+		if err != nil {
+			t.Fatal(e.params, err)
+		}
+		if selector.matches(labels) != e.matches {
+			t.Fatal(e.params, "expected match", e.matches)
+		}
+	}
+
+	for _, bad := range []string{"=payments", "", "a,,b", "!=x"} {
+		if _, err := parseLabelSelector([]string{bad}); err == nil {
+			t.Fatal("bad selector", bad, "accepted")
+		}
+	}
+	if checkLabels(map[string]string{"a=b": ""}) == nil || checkLabels(map[string]string{"": "x"}) == nil {
+		t.Fatal("bad label keys accepted")
+	}
+}
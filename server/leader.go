@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+// the servers elect one leader for the cluster singleton duties
+const leaderKey = "cxy-sdn"
+
+const (
+	// how often the leader looks for dead nodes
+	gcInterval = time.Minute
+	// a node failed for that long is considered gone for good
+	deadNodeGrace = 10 * time.Minute
+	// how often the leader checks the store for inconsistencies
+	auditInterval = 10 * time.Minute
+	// wait between attempts to create the default network
+	leaderRetryInterval = 5 * time.Second
+)
+
+// servers campaign for the leadership. A node with a bolt or memory store
+// is a cluster of its own and leads it with or without --server, or it would
+// never get the default network
+func (d *Daemon) runsForLeader() bool {
+	return d.isServer || d.storeBackend != consulBackend
+}
+
+// leaderHandler runs the duties of the elected leader until lostCh is closed
+func leaderHandler(d *Daemon, lostCh <-chan struct{}) {
+	log.Println("elected cluster leader")
+
+	if !ensureDefaultNetwork(lostCh) {
+		return
+	}
+
+	gcTicker := time.NewTicker(gcInterval)
+	defer gcTicker.Stop()
+	auditTicker := time.NewTicker(auditInterval)
+	defer auditTicker.Stop()
+
+	// first time a node was seen failed
+	failedSince := make(map[string]time.Time)
+
+	auditStore()
+
+	for {
+		select {
+		case <-gcTicker.C:
+			if d.storeBackend == consulBackend {
+				gcDeadNodes(failedSince)
+				gcNodeLeases()
+				gcNodeRoutes()
+			}
+		case <-auditTicker.C:
+			auditStore()
+		case <-lostCh:
+			log.Println("lost cluster leadership")
+			return
+		}
+	}
+}
+
+// create the default network unless it exists, retries until it is in the
+// store, false if leadership was lost meanwhile
+func ensureDefaultNetwork(lostCh <-chan struct{}) bool {
+	for {
+		if _, err := GetNetwork(defaultNetwork); err == nil {
+			return true
+		}
+
+		_, err := CreateDefaultNetwork()
+		if err == nil {
+			return true
+		}
+		log.Println("Create cxy network error", err.Error())
+
+		select {
+		case <-time.After(leaderRetryInterval):
+		case <-lostCh:
+			return false
+		}
+	}
+}
+
+// force-leave nodes failed for longer than deadNodeGrace, the catalog then
+// drops them and every node removes its tunnel to them
+func gcDeadNodes(failedSince map[string]time.Time) {
+	nodes, err := netAgent.ClusterNodes()
+	if err != nil {
+		log.Println("gc dead nodes error:", err)
+		return
+	}
+
+	now := time.Now()
+	failed := make(map[string]bool)
+
+	for _, node := range nodes {
+		if node.Status != netAgent.NODE_STATUS_FAILED {
+			continue
+		}
+		failed[node.Name] = true
+
+		since, ok := failedSince[node.Name]
+		if !ok {
+			failedSince[node.Name] = now
+			continue
+		}
+
+		if now.Sub(since) < deadNodeGrace {
+			continue
+		}
+
+		log.Println("node", node.Name, node.Address, "failed since", since, "removing it")
+		if err := netAgent.ForceLeave(node.Name); err != nil {
+			log.Println("force leave", node.Name, "error:", err)
+			continue
+		}
+		delete(failedSince, node.Name)
+	}
+
+	// recovered or already gone
+	for name := range failedSince {
+		if !failed[name] {
+			delete(failedSince, name)
+		}
+	}
+}
+
+// auditStore checks the store in use, every problem found is logged
+func auditStore() []string {
+	problems := audit(netAgent.GetStore())
+	for _, problem := range problems {
+		log.Println("audit:", problem)
+	}
+	return problems
+}
+
+// audit checks networkStore, vlanStore, ipStore, leaseStore and
+// reservationStore of s against each other
+func audit(s netAgent.Store) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	pairs, ok := s.List(networkStore)
+	if !ok {
+		report("error listing %s", networkStore)
+		return problems
+	}
+
+	vnis, err := loadVNIs(s)
+	if err != nil {
+		report("%v", err)
+		vnis = &vniState{}
+	}
+	// network name by VNI
+	usedVNI := make(map[uint]string)
+	ipKeys := make(map[string]bool)
+	// subnets by VNI
+	vniSubnets := make(map[string][]*net.IPNet)
+
+	for _, pair := range pairs {
+		network := &Network{}
+		if err := json.Unmarshal(pair.Value, network); err != nil {
+			report("network %s: bad record: %v", pair.Key, err)
+			continue
+		}
+
+		if other, ok := usedVNI[network.VNI]; ok {
+			report("network %s: VNI %d also used by network %s", network.Name, network.VNI, other)
+		}
+		usedVNI[network.VNI] = network.Name
+		if !vnis.used.contains(network.VNI) {
+			report("network %s: VNI %d not marked used in %s", network.Name, network.VNI, vlanStore)
+		}
+
+		subnets, err := network.subnets()
+		if err != nil {
+			report("network %s: bad subnet: %v", network.Name, err)
+			continue
+		}
+
+		for _, sub := range subnets {
+			subnet, gateway := sub.subnet, sub.gateway
+
+			key := ipKey(fmt.Sprint(network.VNI), *subnet)
+			ipKeys[key] = true
+			vniSubnets[fmt.Sprint(network.VNI)] = append(vniSubnets[fmt.Sprint(network.VNI)], subnet)
+
+			if gateway == nil || !subnet.Contains(gateway) {
+				report("network %s: gateway %s not in subnet %s", network.Name, gateway, subnet)
+			} else if !ipUsed(s, key, ipPos(gateway, *subnet)) {
+				report("network %s: gateway %s not marked used", network.Name, gateway)
+			}
+		}
+	}
+
+	for _, vr := range vnis.used {
+		for VNI := vr.Start; VNI <= vr.End; VNI++ {
+			if _, ok := usedVNI[VNI]; !ok {
+				report("VNI %d marked used without network", VNI)
+			}
+		}
+	}
+
+	if ipPairs, ok := s.List(ipStore); ok {
+		for _, pair := range ipPairs {
+			if base, _, _ := splitIPBlockKey(pair.Key); !ipKeys[base] {
+				report("ip bitmap %s without network", pair.Key)
+			}
+		}
+	}
+
+	if leasePairs, ok := s.List(leaseStore); ok {
+		for _, pair := range leasePairs {
+			lease := &Lease{}
+			if err := json.Unmarshal(pair.Value, lease); err != nil {
+				report("lease %s: bad record: %v", pair.Key, err)
+				continue
+			}
+
+			ip := net.ParseIP(lease.IP)
+			_, subnet, err := net.ParseCIDR(lease.Subnet)
+			if ip == nil || err != nil {
+				report("lease %s: bad address %s/%s", pair.Key, lease.IP, lease.Subnet)
+				continue
+			}
+
+			base := ipKey(strings.TrimSuffix(pair.Key, "/"+lease.IP), *subnet)
+			if !ipKeys[base] {
+				report("lease %s without network", pair.Key)
+			} else if !ipUsed(s, base, ipPos(ip, *subnet)) {
+				report("lease %s: IP not marked used", pair.Key)
+			}
+		}
+	}
+
+	if reservationPairs, ok := s.List(reservationStore); ok {
+		for _, pair := range reservationPairs {
+			reservation := &Reservation{}
+			if err := json.Unmarshal(pair.Value, reservation); err != nil {
+				report("reservation %s: bad record: %v", pair.Key, err)
+				continue
+			}
+
+			VNI := strings.TrimSuffix(pair.Key, "/"+reservation.Identity)
+			subnets, ok := vniSubnets[VNI]
+			if !ok {
+				report("reservation %s without network", pair.Key)
+				continue
+			}
+
+			for _, addr := range reservation.IPs {
+				ip := net.ParseIP(addr)
+				used := false
+				for _, subnet := range subnets {
+					if ip != nil && subnet.Contains(ip) {
+						used = ipUsed(s, ipKey(VNI, *subnet), ipPos(ip, *subnet))
+					}
+				}
+				if !used {
+					report("reservation %s: IP %s not marked used", pair.Key, addr)
+				}
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+func TestAuditStore(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.40.0.0/24")
+
+	if _, err := createNetworkRecord("audit1", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createNetworkRecord("audit2", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := auditStore(); len(problems) != 0 {
+		t.Fatal("consistent store reported problems", problems)
+	}
+
+	// leak a VNI and unmark the gateway of audit2
+	state, err := loadVNIs(netAgent.GetStore())
+	if err != nil || netAgent.Txn(state.ops(state.used.add(3))...) != netAgent.OK {
+		t.Fatal("leaking VNI 3 failed", err)
+	}
+
+	if !ReleaseIP(net.ParseIP("10.40.0.1"), *subnet, "2") {
+		t.Fatal("ReleaseIP failed")
+	}
+
+	requestIP("7", *subnet)
+
+	problems := auditStore()
+	if len(problems) != 3 {
+		t.Fatal("expected leaked VNI, unmarked gateway and orphan bitmap, got", problems)
+	}
+}
+
+func TestRunsForLeader(t *testing.T) {
+	d := NewDaemon()
+	if d.runsForLeader() {
+		t.Error("consul client node should not run for leader")
+	}
+
+	d.isServer = true
+	if !d.runsForLeader() {
+		t.Error("consul server should run for leader")
+	}
+
+	d.isServer = false
+	d.storeBackend = boltBackend
+	if !d.runsForLeader() {
+		t.Error("single node with a local store should lead without --server")
+	}
+}
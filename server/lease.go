@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// IP leases
+// the ip bitmaps only say an address is used, every address handed to a
+// container also gets a lease in leaseStore saying which container on which
+// node holds it. A container removed without DELETE /connection leaves its
+// lease behind: every node releases the leases of its own containers that
+// are gone, the leader the leases of nodes that left the cluster
+
+const leaseStore = "leaseStore"
+
+const (
+	// how often a node looks for leases of gone containers
+	leaseGCInterval = time.Minute
+	// younger leases are left alone, their container may still be set up
+	leaseGrace = 5 * time.Minute
+)
+
+type Lease struct {
+	IP           string `json:"ip"`
+	Subnet       string `json:"subnet"`
+	Network      string `json:"network"`
+	ContainerID  string `json:"containerID"`
+	ContainerPID string `json:"containerPID"`
+	Identity     string `json:"identity,omitempty"`
+	// labels of the connection
+	Labels  map[string]string `json:"labels,omitempty"`
+	Node    string            `json:"node"`
+	Created time.Time         `json:"created"`
+}
+
+// key is the vlan/ip
+func leaseKey(VNI string, ip net.IP) string {
+	return VNI + "/" + ip.String()
+}
+
+// record that the ips allocated in subnets of network belong to con, a
+// container of this node. The lease of a gone container is replaced, the
+// lease of another live one is a conflict: a reserved address follows its
+// identity, but two containers with the same name must not share it
+func putLeases(network *Network, subnets []networkSubnet, ips []net.IP, con *Connection) error {
+	node, _ := os.Hostname()
+	VNI := fmt.Sprint(network.VNI)
+
+	for i, s := range ipSubnets(subnets, ips) {
+		ip := ips[i]
+		lease := &Lease{
+			IP:           ip.String(),
+			Subnet:       s.subnet.String(),
+			Network:      network.Name,
+			ContainerID:  con.ContainerID,
+			ContainerPID: con.ContainerPID,
+			Identity:     con.identity(),
+			Labels:       con.Labels,
+			Node:         node,
+			Created:      time.Now(),
+		}
+
+		data, err := json.Marshal(lease)
+		if err != nil {
+			return fmt.Errorf("Error encoding lease of %s: %v", lease.IP, err)
+		}
+
+		// a lease left by a previous owner is replaced
+		key := leaseKey(VNI, ip)
+		for {
+			old, index, ok := netAgent.Get(leaseStore, key)
+			if !ok {
+				index = 0
+			}
+
+			holder := &Lease{}
+			if ok && json.Unmarshal(old, holder) == nil && holder.ContainerID != con.ContainerID && leaseHeld(holder) {
+				return &StaticIPError{
+					IP:       lease.IP,
+					Reason:   "is in use by " + holder.ContainerID + " on " + holder.Node,
+					Conflict: true,
+				}
+			}
+
+			result := netAgent.CAS(leaseStore, key, data, index)
+			if result == netAgent.OUTDATED {
+				continue
+			}
+			if result != netAgent.OK {
+				return errors.New("Error writing lease of " + lease.IP)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// the lease of ip of network VNI, nil if there is none
+func getLease(VNI string, ip net.IP) *Lease {
+	data, _, ok := netAgent.Get(leaseStore, leaseKey(VNI, ip))
+	if !ok {
+		return nil
+	}
+
+	lease := &Lease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		log.Println("bad lease of", ip, err)
+		return nil
+	}
+	return lease
+}
+
+// the addresses leased to containerID in network VNI
+func leasedIPs(VNI string, containerID string) []net.IP {
+	pairs, ok := netAgent.List(leaseStore)
+	if !ok {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, VNI+"/") {
+			continue
+		}
+
+		lease := &Lease{}
+		if err := json.Unmarshal(pair.Value, lease); err == nil && lease.ContainerID == containerID {
+			ips = append(ips, net.ParseIP(lease.IP))
+		}
+	}
+	return ips
+}
+
+// drop the lease of ip unless another container holds it now, like a
+// container that moved to another node with its reserved address
+func deleteLease(VNI string, ip net.IP, containerID string) {
+	key := leaseKey(VNI, ip)
+
+	for {
+		data, index, ok := netAgent.Get(leaseStore, key)
+		if !ok {
+			return
+		}
+
+		lease := &Lease{}
+		if err := json.Unmarshal(data, lease); err == nil && lease.ContainerID != containerID {
+			return
+		}
+
+		if netAgent.DeleteCAS(leaseStore, key, index) != netAgent.OUTDATED {
+			return
+		}
+	}
+}
+
+// the leases of network sorted by IP
+func GetLeases(network *Network) ([]Lease, error) {
+	pairs, ok := netAgent.List(leaseStore)
+	if !ok {
+		return nil, errors.New("Error listing " + leaseStore)
+	}
+
+	prefix := fmt.Sprint(network.VNI) + "/"
+	leases := make([]Lease, 0)
+
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, prefix) {
+			continue
+		}
+
+		lease := Lease{}
+		if err := json.Unmarshal(pair.Value, &lease); err != nil {
+			log.Println("bad lease", pair.Key, err)
+			continue
+		}
+		leases = append(leases, lease)
+	}
+
+	sort.Sort(byLeaseIP(leases))
+	return leases, nil
+}
+
+// frees the IP of the lease read at index and drops the lease in one
+// transaction, false if the lease changed meanwhile or on error. Reserved
+// IPs stay used
+func releaseLease(key string, index int, lease *Lease) bool {
+	VNI := strings.TrimSuffix(key, "/"+lease.IP)
+
+	ip := net.ParseIP(lease.IP)
+	_, subnet, err := net.ParseCIDR(lease.Subnet)
+	if ip == nil || err != nil || ipReserved(VNI, ip) {
+		// nothing to free
+		return netAgent.DeleteCAS(leaseStore, key, index) == netAgent.OK
+	}
+
+	migrateIPBitmap(VNI, *subnet)
+	pos := ipPos(ip, *subnet)
+
+	for {
+		ops := []netAgent.TxnOp{{Store: leaseStore, Key: key, Index: index, Delete: true}}
+
+		block := ipBlockKey(VNI, *subnet, pos/ipBlockBits)
+		if bits, blockIndex, ok := netAgent.Get(ipStore, block); ok && pos < uint32(ipBitmapSize(*subnet)*8) {
+			util.Clear(bits, uint(pos%ipBlockBits))
+			ops = append(ops, netAgent.TxnOp{Store: ipStore, Key: block, Value: bits, Index: blockIndex})
+		}
+
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			return true
+		case netAgent.OUTDATED:
+			// retry if only the block changed
+			if _, current, ok := netAgent.Get(leaseStore, key); !ok || current != index {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// release the leases older than leaseGrace stale says are left behind,
+// returns the number released
+func gcLeases(stale func(*Lease) bool) int {
+	pairs, ok := netAgent.List(leaseStore)
+	if !ok {
+		log.Println("gc leases error: Error listing", leaseStore)
+		return 0
+	}
+
+	released := 0
+	for _, pair := range pairs {
+		lease := &Lease{}
+		if err := json.Unmarshal(pair.Value, lease); err != nil {
+			log.Println("bad lease", pair.Key, err)
+			continue
+		}
+
+		if time.Since(lease.Created) < leaseGrace || !stale(lease) {
+			continue
+		}
+
+		if releaseLease(pair.Key, pair.ModifyIndex, lease) {
+			log.Println("released leaked IP", lease.IP, "of", lease.Network, "held by", lease.ContainerID, "on", lease.Node)
+			released++
+		}
+	}
+	return released
+}
+
+// the docker daemon of this node, its socket is mounted into the cxy-sdn
+// container
+const dockerEndpoint = "unix:///var/run/docker.sock"
+
+// whether docker runs the container id, errNoContainer when docker does not
+// know it. Tests replace it
+var inspectContainer = func(id string) (bool, error) {
+	client, err := docker.NewClient(dockerEndpoint)
+	if err != nil {
+		return false, err
+	}
+
+	container, err := client.InspectContainer(id)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return false, errNoContainer
+	}
+	if err != nil {
+		return false, err
+	}
+	return container.State.Running, nil
+}
+
+var errNoContainer = errors.New("no such container")
+
+// whether docker of this node runs the container id. The PID of a lease
+// can be reused by another process once the container exited, so it says
+// nothing. When docker can't be asked the container counts as running
+func containerRunning(id string) bool {
+	running, err := inspectContainer(id)
+	if err == errNoContainer {
+		return false
+	}
+	if err != nil {
+		log.Println("inspect container", id, "error:", err)
+		return true
+	}
+	return running
+}
+
+// whether the container of a lease of this node is still around, either
+// connected or running
+func containerExists(d *Daemon, lease *Lease) bool {
+	return d.connections.Check(lease.ContainerID) || containerRunning(lease.ContainerID)
+}
+
+// whether the container of lease still holds its address. A container of
+// another node holds it until its lease is released or collected
+func leaseHeld(lease *Lease) bool {
+	node, _ := os.Hostname()
+	if lease.Node != node {
+		return true
+	}
+	return containerRunning(lease.ContainerID)
+}
+
+// release the leases of containers of this node that are gone
+func gcLocalLeases(d *Daemon) int {
+	node, _ := os.Hostname()
+
+	return gcLeases(func(lease *Lease) bool {
+		return lease.Node == node && !containerExists(d, lease)
+	})
+}
+
+// release the leases of nodes that are not cluster members any more
+func gcNodeLeases() int {
+	nodes, err := netAgent.ClusterNodes()
+	if err != nil {
+		log.Println("gc leases error:", err)
+		return 0
+	}
+
+	members := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Status != netAgent.NODE_STATUS_LEFT {
+			members[node.Name] = true
+		}
+	}
+
+	return gcLeases(func(lease *Lease) bool {
+		return !members[lease.Node]
+	})
+}
+
+// every node cleans up after its own containers
+func leaseGC(d *Daemon) {
+	ticker := time.NewTicker(leaseGCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		gcLocalLeases(d)
+	}
+}
+
+type byLeaseIP []Lease
+
+func (s byLeaseIP) Len() int { return len(s) }
+func (s byLeaseIP) Less(i, j int) bool {
+	return bytes.Compare(net.ParseIP(s[i].IP).To16(), net.ParseIP(s[j].IP).To16()) < 0
+}
+func (s byLeaseIP) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+// age the lease of ip so the gc looks at it
+func ageLease(t *testing.T, VNI string, ip net.IP) {
+	key := leaseKey(VNI, ip)
+	data, index, ok := netAgent.Get(leaseStore, key)
+	if !ok {
+		t.Fatal("no lease for", ip)
+	}
+
+	lease := &Lease{}
+	json.Unmarshal(data, lease)
+	lease.Created = lease.Created.Add(-2 * leaseGrace)
+	data, _ = json.Marshal(lease)
+	netAgent.CAS(leaseStore, key, data, index)
+}
+
+// let docker know the containers of running, the others don't exist, call
+// the returned func to restore the real lookup
+func stubContainers(running map[string]bool) func() {
+	inspect := inspectContainer
+	inspectContainer = func(id string) (bool, error) {
+		r, ok := running[id]
+		if !ok {
+			return false, errNoContainer
+		}
+		return r, nil
+	}
+	return func() { inspectContainer = inspect }
+}
+
+// a store whose writes to one of its stores end with result, an ERROR
+// store can't be read either
+type brokenStore struct {
+	netAgent.Store
+	broken string
+	result int
+}
+
+func (s *brokenStore) CAS(store string, key string, value []byte, index int) int {
+	if store == s.broken {
+		return s.result
+	}
+	return s.Store.CAS(store, key, value, index)
+}
+
+func (s *brokenStore) Txn(ops []netAgent.TxnOp) int {
+	for _, op := range ops {
+		if op.Store == s.broken {
+			return s.result
+		}
+	}
+	return s.Store.Txn(ops)
+}
+
+func (s *brokenStore) Lookup(store string, key string) ([]byte, int, int) {
+	if store == s.broken && s.result == netAgent.ERROR {
+		return nil, 0, netAgent.ERROR
+	}
+	return s.Store.Lookup(store, key)
+}
+
+func TestLeases(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.95.0.0/24")
+	network, err := createNetworkRecord("leases", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	VNI := fmt.Sprint(network.VNI)
+
+	subnets, _ := network.subnets()
+	var ips []net.IP
+	for _, id := range []string{"alive", "gone"} {
+		allocated, err := requestIPs(network, subnets, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		putLeases(network, subnets, allocated, &Connection{ContainerID: id})
+		ips = append(ips, allocated[0])
+	}
+
+	request, _ := http.NewRequest("GET", "/network/leases/leases", nil)
+	response := httptest.NewRecorder()
+	createRouter(NewDaemon()).ServeHTTP(response, request)
+
+	var leases []Lease
+	if err := json.NewDecoder(response.Body).Decode(&leases); err != nil || len(leases) != 2 {
+		t.Fatal("expected 2 leases", response.Code, leases, err)
+	}
+	if leases[0].ContainerID != "alive" || leases[1].IP != ips[1].String() || leases[1].Network != "leases" {
+		t.Fatal("wrong leases", leases)
+	}
+
+	stale := func(lease *Lease) bool { return lease.ContainerID == "gone" }
+
+	// too young to be collected
+	if released := gcLeases(stale); released != 0 {
+		t.Fatal("young lease released")
+	}
+
+	ageLease(t, VNI, ips[0])
+	ageLease(t, VNI, ips[1])
+	if released := gcLeases(stale); released != 1 {
+		t.Fatal("expected 1 lease released, got", released)
+	}
+
+	base := ipKey(VNI, *subnet)
+	if ipUsed(netAgent.GetStore(), base, ipPos(ips[1], *subnet)) {
+		t.Fatal("leaked IP not released")
+	}
+	if !ipUsed(netAgent.GetStore(), base, ipPos(ips[0], *subnet)) {
+		t.Fatal("IP of a live container released")
+	}
+	if problems := audit(netAgent.GetStore()); len(problems) != 0 {
+		t.Fatal("audit problems", problems)
+	}
+
+	if err := deleteNetworkRecord("leases", true); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, _ := netAgent.List(leaseStore); len(pairs) != 0 {
+		t.Fatal("leases of a deleted network left", pairs)
+	}
+}
+
+// a lease left by a crashed container is replaced by the next owner of the IP
+func TestLeaseReplaced(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	defer stubContainers(map[string]bool{"second": true})()
+
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/24")
+	network, err := createNetworkRecord("replaced", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+	ip := []net.IP{net.ParseIP("10.96.0.10")}
+
+	putLeases(network, subnets, ip, &Connection{ContainerID: "first"})
+	if err := putLeases(network, subnets, ip, &Connection{ContainerID: "second"}); err != nil {
+		t.Fatal("lease of a gone container not replaced", err)
+	}
+
+	leases, err := GetLeases(network)
+	if err != nil || len(leases) != 1 || leases[0].ContainerID != "second" {
+		t.Fatal("lease not replaced", leases, err)
+	}
+	if time.Since(leases[0].Created) > time.Minute {
+		t.Fatal("bad creation time", leases[0].Created)
+	}
+}
+
+func TestContainerExists(t *testing.T) {
+	defer stubContainers(map[string]bool{"running": true, "stopped": false})()
+
+	stubbed := inspectContainer
+	inspectContainer = func(id string) (bool, error) {
+		if id == "unreachable" {
+			return false, errors.New("docker is down")
+		}
+		return stubbed(id)
+	}
+
+	d := NewDaemon()
+	d.connections.Set("connected", &Connection{ContainerID: "connected"})
+
+	// the PID of a removed container may belong to another process now
+	self := fmt.Sprint(os.Getpid())
+
+	cases := map[string]bool{
+		"connected":   true,
+		"running":     true,
+		"stopped":     false,
+		"removed":     false,
+		"unreachable": true,
+	}
+	for id, expected := range cases {
+		lease := &Lease{ContainerID: id, ContainerPID: self}
+		if exists := containerExists(d, lease); exists != expected {
+			t.Errorf("container %s: expected exists %v, got %v", id, expected, exists)
+		}
+	}
+}
+
+// a connection connHandler fails to set up gives its addresses back
+func TestConnectFailed(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.97.0.0/24")
+	network, err := createNetworkRecord("connfail", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	VNI := fmt.Sprint(network.VNI)
+
+	d := NewDaemon()
+	leased := make(chan []net.IP, 1)
+	go func() {
+		c := <-d.connectionChan
+		leased <- c.addrs.ips
+		c.Connection.OvsPortID = "-1"
+		c.Err = errors.New("no port")
+		c.Result <- c.Connection
+	}()
+
+	if _, err := connect(d, &Connection{ContainerID: "c1", Network: "connfail"}); err == nil {
+		t.Fatal("failed connection reported as added")
+	}
+
+	ips := <-leased
+	if len(ips) != 1 || getLease(VNI, ips[0]) != nil {
+		t.Fatal("lease kept for", ips)
+	}
+
+	subnets, _ := network.subnets()
+	again, err := requestIPs(network, subnets, "")
+	if err != nil || !again[0].Equal(ips[0]) {
+		t.Fatal("address not released", ips, again, err)
+	}
+}
+
+// a lease that can't be written fails the connection and frees its address
+func TestLeaseWriteFailed(t *testing.T) {
+	netAgent.SetStore(&brokenStore{netAgent.NewMemoryStore(), leaseStore, netAgent.ERROR})
+
+	_, subnet, _ := net.ParseCIDR("10.98.0.0/24")
+	network, err := createNetworkRecord("leasefail", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaseConnection(&Connection{ContainerID: "c1", Network: "leasefail"}); err == nil {
+		t.Fatal("connection without a lease")
+	}
+
+	subnets, _ := network.subnets()
+	ips, err := requestIPs(network, subnets, "")
+	if err != nil || !ips[0].Equal(net.ParseIP("10.98.0.2")) {
+		t.Fatal("address not released", ips, err)
+	}
+}
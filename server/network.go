@@ -1,15 +1,15 @@
 package server
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"math/big"
 	"net"
-	"time"
+	"os"
+	"strings"
 
 	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
 	"github.com/WIZARD-CXY/cxy-sdn/util"
@@ -37,11 +37,145 @@ var gatewayAddrs = []string{
 
 const vlanCount = 1000000
 
+// IPv6 subnets are way too big for a bitmap, only their first addresses
+// are handed out
+const maxIPv6Bits = 1 << 16
+
+// Subnet is IPv4 or IPv6, a dual stack network has its IPv6 subnet in
+// Subnet6
 type Network struct {
-	Name    string `json:"name"`
+	Name     string `json:"name"`
+	Subnet   string `json:"subnet"`
+	Gateway  string `json:"gateway"`
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	VNI      uint   `json:"vni"`
+	// containers get addresses from these ranges only, the whole subnets
+	// if empty
+	Ranges []IPRange `json:"ranges,omitempty"`
+	// IPs or CIDRs never handed out
+	Exclude []string `json:"exclude,omitempty"`
+	// IPs kept for infrastructure, only handed out when asked for
+	Reserved []string `json:"reserved,omitempty"`
+	// subnets added later, in the family of Subnet or Subnet6. Addresses
+	// come from the next subnet of a family once the previous are full
+	Secondary []SubnetConf `json:"secondary,omitempty"`
+	// free form key/value pairs
+	Labels map[string]string `json:"labels,omitempty"`
+	// MTU of the gateway interfaces and new containers, 1440 if 0
+	MTU int `json:"mtu,omitempty"`
+	// masquerade, the default, or none for routed networks
+	NAT string `json:"nat,omitempty"`
+	// name servers handed to the containers
+	DNS []string `json:"dns,omitempty"`
+}
+
+const (
+	natMasquerade = "masquerade"
+	natNone       = "none"
+)
+
+// the MTU of the gateway interfaces and containers of the network
+func (n *Network) linkMTU() int {
+	if n.MTU == 0 {
+		return mtu
+	}
+	return n.MTU
+}
+
+// whether traffic leaving the network is masqueraded
+func (n *Network) masquerade() bool {
+	return n.NAT != natNone
+}
+
+// a secondary subnet and its gateway
+type SubnetConf struct {
 	Subnet  string `json:"subnet"`
 	Gateway string `json:"gateway"`
-	VNI     uint   `json:"vni"`
+}
+
+// NetworkOptions are the optional settings of a new network
+type NetworkOptions struct {
+	// IPv6 subnet of a dual stack network
+	Subnet6  *net.IPNet
+	Ranges   []IPRange
+	Exclude  []string
+	Reserved []string
+	// VNI asked for, the smallest free one that is not reserved if 0
+	VNI    uint
+	Labels map[string]string
+	MTU    int
+	NAT    string
+	DNS    []string
+}
+
+// one subnet of a network and its gateway
+type networkSubnet struct {
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+// the subnets of the network, Subnet first, then Subnet6 and the secondary
+// subnets
+func (n *Network) subnets() ([]networkSubnet, error) {
+	var subnets []networkSubnet
+
+	cidrs := [][2]string{{n.Subnet, n.Gateway}, {n.Subnet6, n.Gateway6}}
+	for _, secondary := range n.Secondary {
+		cidrs = append(cidrs, [2]string{secondary.Subnet, secondary.Gateway})
+	}
+
+	for _, cidr := range cidrs {
+		if cidr[0] == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr[0])
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, networkSubnet{subnet, net.ParseIP(cidr[1])})
+	}
+	return subnets, nil
+}
+
+// subnets grouped by family, the family of the first subnet first. A
+// container gets one address of each family
+func subnetFamilies(subnets []networkSubnet) [][]networkSubnet {
+	var families [][]networkSubnet
+
+	for _, s := range subnets {
+		found := false
+		for i, family := range families {
+			if isIPv6(family[0].subnet) == isIPv6(s.subnet) {
+				families[i] = append(family, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			families = append(families, []networkSubnet{s})
+		}
+	}
+	return families
+}
+
+// the subnet of subnets holding each of ips
+func ipSubnets(subnets []networkSubnet, ips []net.IP) []networkSubnet {
+	found := make([]networkSubnet, len(ips))
+
+	for i, ip := range ips {
+		for _, s := range subnets {
+			if s.subnet.Contains(ip) {
+				found[i] = s
+				break
+			}
+		}
+	}
+	return found
+}
+
+func isIPv6(subnet *net.IPNet) bool {
+	return subnet.IP.To4() == nil
 }
 
 // get the network detail of a given name
@@ -87,6 +221,14 @@ func CreateDefaultNetwork() (*Network, error) {
 }
 
 func CreateNetwork(name string, subnet *net.IPNet) (*Network, error) {
+	return CreateNetworkWithOptions(name, subnet, NetworkOptions{})
+}
+
+func CreateNetworkWithOptions(name string, subnet *net.IPNet, options NetworkOptions) (*Network, error) {
+	if options.Subnet6 != nil && (isIPv6(subnet) || !isIPv6(options.Subnet6)) {
+		return nil, errors.New("dual stack network needs an IPv4 subnet and an IPv6 subnet6")
+	}
+
 	network, err := GetNetwork(name)
 
 	if err == nil {
@@ -95,79 +237,141 @@ func CreateNetwork(name string, subnet *net.IPNet) (*Network, error) {
 		return network, errors.New("Network already exist")
 	}
 
-	// get the smallest unused vlan id from data store
-	VNI, err := allocateVNI()
+	var gateway net.IP
+
+	addr, err := util.GetIfaceAddrFamily(name, util.Family(subnet.IP))
 
+	if err == nil {
+		// even though the interface exist, keep its IP as gateway and mark
+		// it as used to let the ipam and I happy
+		ifaceAddr := addr.String()
+		log.Printf("Interface %s already exists with IP %s\n", name, ifaceAddr)
+
+		gateway, subnet, err = net.ParseCIDR(ifaceAddr)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	used, err := loadClusterSubnets()
 	if err != nil {
 		return nil, err
 	}
+	if gateway != nil {
+		// the route of the interface kept is ours, the routes of the other
+		// nodes still count
+		node, _ := os.Hostname()
+		used.dropRoute(node, subnet)
+	}
+	for _, s := range []*net.IPNet{subnet, options.Subnet6} {
+		if s == nil {
+			continue
+		}
+		if err = used.conflict(s); err != nil {
+			return nil, err
+		}
+	}
 
-	var gateway net.IP
-
-	addr, err := util.GetIfaceAddr(name)
+	network, err = createNetworkRecord(name, subnet, gateway, options)
 
 	if err != nil {
-		log.Printf("Interface with name %s does not exist, Creating it\n", name)
+		return network, err
+	}
 
-		gateway = RequestIP(fmt.Sprint(VNI), *subnet)
+	log.Printf("Network %s created with subnet %s, in %d vlan\n", name, network.Subnet, network.VNI)
 
-		network = &Network{name, subnet.String(), gateway.String(), VNI}
+	// same handler the reconciler runs on every node
+	if err = reconcileNetwork(network); err != nil {
+		return network, err
+	}
 
-		if err = AddInternalPort(ovsClient, bridgeName, name, VNI); err != nil {
-			return network, err
-		}
-		time.Sleep(1 * time.Second)
+	return network, nil
 
-		gatewayCIDR := &net.IPNet{gateway, subnet.Mask}
+}
 
-		if err = util.SetMtu(name, mtu); err != nil {
-			return network, err
-		}
+// createNetworkRecord allocates a VNI and the gateway IPs and writes the
+// network record in one transaction, so a conflict or crash never leaves
+// an allocated VNI or ip bitmap without its network.
+// A nil gateway takes the first free IP of the subnet, the gateway of
+// options.Subnet6, if any, always is its first free IP
+func createNetworkRecord(name string, subnet *net.IPNet, gateway net.IP, options NetworkOptions) (*Network, error) {
+	template := Network{
+		Name:     name,
+		Subnet:   subnet.String(),
+		Exclude:  options.Exclude,
+		Reserved: options.Reserved,
+	}
+	if options.Subnet6 != nil {
+		template.Subnet6 = options.Subnet6.String()
+	}
 
-		if err = util.SetInterfaceIp(name, gatewayCIDR.String()); err != nil {
-			return network, err
-		}
+	// the attributes that may change later are checked like an update
+	update := &NetworkUpdate{
+		Labels: &options.Labels,
+		MTU:    &options.MTU,
+		NAT:    &options.NAT,
+		DNS:    &options.DNS,
+		Ranges: &options.Ranges,
+	}
+	if err := template.apply(update); err != nil {
+		return nil, err
+	}
 
-		if err = util.InterfaceUp(name); err != nil {
-			return network, err
+	for {
+		vnis, err := loadVNIs(netAgent.GetStore())
+		if err != nil {
+			return nil, err
 		}
 
-	} else {
-		ifaceAddr := addr.String()
-		// even though the interface exist, mark its IP as used by using RequestIP to
-		// let the ipam and I happy
-		RequestIP(fmt.Sprint(VNI), *subnet)
-
-		log.Printf("Interface %s already exists with IP %s, subnet %s, in %d vlan\n", name, ifaceAddr, subnet.String(), VNI)
+		VNI, err := vnis.claim(options.VNI)
+		if err != nil {
+			return nil, err
+		}
 
-		gateway, subnet, err = net.ParseCIDR(ifaceAddr)
+		network := template
+		network.VNI = VNI
+		ops := vnis.ops(vnis.used.add(VNI))
 
+		pool, err := networkPool(&network, *subnet)
 		if err != nil {
 			return nil, err
 		}
-		network = &Network{name, subnet.String(), gateway.String(), VNI}
-	}
-
-	netBytes, _ := json.Marshal(network)
+		op, gw, err := gatewayOp(fmt.Sprint(VNI), pool, gateway)
+		if err != nil {
+			return nil, err
+		}
+		network.Gateway = gw.String()
+		ops = append(ops, op)
 
-	if err != nil {
-		return nil, err
-	}
+		if options.Subnet6 != nil {
+			if pool, err = networkPool(&network, *options.Subnet6); err != nil {
+				return nil, err
+			}
+			op, gw, err = gatewayOp(fmt.Sprint(VNI), pool, nil)
+			if err != nil {
+				return nil, err
+			}
+			network.Gateway6 = gw.String()
+			ops = append(ops, op)
+		}
 
-	err2 := netAgent.Put(networkStore, name, netBytes, nil)
+		netBytes, _ := json.Marshal(network)
 
-	if err2 == netAgent.OUTDATED {
-		releaseVNI(VNI)
-		ReleaseIP(gateway, *subnet, fmt.Sprint(VNI))
-		return CreateNetwork(name, subnet)
-	}
+		// index 0, only succeeds if no other node created the network meanwhile
+		ops = append(ops, netAgent.TxnOp{Store: networkStore, Key: name, Value: netBytes, Index: 0})
 
-	if err = setupIPTables(network.Name, network.Subnet); err != nil {
-		return network, err
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			return &network, nil
+		case netAgent.OUTDATED:
+			if existing, err := GetNetwork(name); err == nil {
+				return existing, errors.New("Network already exist")
+			}
+		default:
+			return nil, errors.New("Error creating network " + name)
+		}
 	}
-
-	return network, nil
-
 }
 
 // this function is used to create network from network datastore
@@ -227,136 +431,473 @@ func CreateNetwork(name string, subnet *net.IPNet) (*Network, error) {
 
 }*/
 
-func DeleteNetwork(name string) error {
-	network, err := GetNetwork(name)
+// InvalidNetworkError is a change to a network that can't be made whatever
+// the state of the store, like a subnet of the wrong family or a gateway
+// outside of its subnet
+type InvalidNetworkError struct {
+	Reason string
+}
+
+func (e *InvalidNetworkError) Error() string {
+	return e.Reason
+}
+
+// SubnetConflictError is a subnet overlapping one already in use
+type SubnetConflictError struct {
+	Subnet string
+	// what it overlaps
+	Conflict string
+}
+
+func (e *SubnetConflictError) Error() string {
+	return "subnet " + e.Subnet + " overlaps " + e.Conflict
+}
+
+// subnets in use in the cluster, by networks or routes of member nodes
+type clusterSubnets struct {
+	networks   []Network
+	nodeRoutes []NodeRoutes
+}
+
+func loadClusterSubnets() (*clusterSubnets, error) {
+	networks, err := GetNetworks()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	nodeRoutes, err := GetNodeRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return &clusterSubnets{networks, nodeRoutes}, nil
+}
+
+// leave the route to subnet of node out of the check
+func (c *clusterSubnets) dropRoute(node string, subnet *net.IPNet) {
+	for i, routes := range c.nodeRoutes {
+		if routes.Node != node {
+			continue
+		}
+
+		kept := make([]string, 0, len(routes.Routes))
+		for _, route := range routes.Routes {
+			if _, dst, err := net.ParseCIDR(route); err != nil || dst.String() != subnet.String() {
+				kept = append(kept, route)
+			}
+		}
+		c.nodeRoutes[i].Routes = kept
 	}
+}
 
-	errcode := netAgent.Delete(networkStore, name)
-	if errcode != netAgent.OK {
-		return errors.New("Error deleting network")
+// a SubnetConflictError if subnet overlaps a subnet of a network or a route
+// of a member node
+func (c *clusterSubnets) conflict(subnet *net.IPNet) error {
+	for _, network := range c.networks {
+		subnets, err := network.subnets()
+		if err != nil {
+			continue
+		}
+		for _, s := range subnets {
+			if util.NetworkOverlaps(subnet, s.subnet) {
+				return &SubnetConflictError{subnet.String(), s.subnet.String() + " of network " + network.Name}
+			}
+		}
 	}
-	releaseVNI(network.VNI)
 
-	if ovsClient == nil {
-		return errors.New("OVS not connected")
+	for _, routes := range c.nodeRoutes {
+		for _, route := range routes.Routes {
+			if _, dst, err := net.ParseCIDR(route); err == nil && util.NetworkOverlaps(subnet, dst) {
+				return &SubnetConflictError{subnet.String(), "route " + route + " of node " + routes.Node}
+			}
+		}
 	}
-	deletePort(ovsClient, bridgeName, name)
 	return nil
 }
 
-// used for client node to sync the network from network Store
-// ignore errors
-func syncNetwork(d *Daemon) {
-	//sync every 5 seconds
+// check that subnet overlaps no subnet of any network and no route of any
+// member node
+func checkSubnetOverlaps(subnet *net.IPNet) error {
+	used, err := loadClusterSubnets()
+	if err != nil {
+		return err
+	}
+	return used.conflict(subnet)
+}
+
+// AddSubnet attaches a secondary subnet to network name in the family of
+// its Subnet or Subnet6, a nil gateway takes the first usable address.
+// Every host adds the gateway address once the reconciler sees the change
+func AddSubnet(name string, subnet *net.IPNet, gateway net.IP) (*Network, error) {
 	for {
-		networks, err := GetNetworks()
+		netBytes, netIndex, ok := netAgent.Get(networkStore, name)
+		if !ok {
+			return nil, errors.New("Network " + name + " not exist")
+		}
+
+		network := &Network{}
+		if err := json.Unmarshal(netBytes, network); err != nil {
+			return nil, err
+		}
+
+		subnets, err := network.subnets()
+		if err != nil {
+			return nil, err
+		}
+
+		familyFound := false
+		for _, s := range subnets {
+			familyFound = familyFound || isIPv6(s.subnet) == isIPv6(subnet)
+		}
+		if !familyFound {
+			return nil, &InvalidNetworkError{"network " + name + " has no subnet in the family of " + subnet.String()}
+		}
+
+		if err := checkSubnetOverlaps(subnet); err != nil {
+			return nil, err
+		}
+
+		network.Secondary = append(network.Secondary, SubnetConf{Subnet: subnet.String()})
+		if err := network.checkPools(); err != nil {
+			return nil, &InvalidNetworkError{err.Error()}
+		}
+
+		VNI := fmt.Sprint(network.VNI)
+		pool, err := networkPool(network, *subnet)
 		if err != nil {
-			log.Println("Error in getNetworks")
-			time.Sleep(3 * time.Second)
+			return nil, err
+		}
+		op, gw, err := gatewayOp(VNI, pool, gateway)
+		if err != nil {
+			return nil, &InvalidNetworkError{err.Error()}
+		}
+		network.Secondary[len(network.Secondary)-1].Gateway = gw.String()
+
+		netBytes, _ = json.Marshal(network)
+		ops := []netAgent.TxnOp{op, {Store: networkStore, Key: name, Value: netBytes, Index: netIndex}}
+
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			return network, nil
+		case netAgent.OUTDATED:
 			continue
+		default:
+			return nil, errors.New("Error adding subnet to network " + name)
 		}
+	}
+}
 
-		// add interface
-		for _, network := range networks {
-			_, err := util.GetIfaceAddr(network.Name)
+// NetworkUpdate is the attributes of a network that may change once it is
+// created, nil ones are left alone
+type NetworkUpdate struct {
+	Labels *map[string]string `json:"labels"`
+	MTU    *int               `json:"mtu"`
+	NAT    *string            `json:"nat"`
+	DNS    *[]string          `json:"dns"`
+	Ranges *[]IPRange         `json:"ranges"`
+}
 
-			if err != nil {
-				// network not exsit create the interface from net store
-				if err = AddInternalPort(ovsClient, bridgeName, network.Name, network.VNI); err != nil {
-					log.Println("add internal port err in syncNetwork", network.Name)
-					continue
-				}
-				time.Sleep(1 * time.Second)
+// RangeConflictError is a change of the allocation ranges leaving addresses
+// handed out from the old ranges outside of the new ones
+type RangeConflictError struct {
+	IPs []string
+}
 
-				if err = util.SetMtu(network.Name, mtu); err != nil {
-					log.Println("set mtu err in syncNetwork", network.Name)
-					continue
-				}
+func (e *RangeConflictError) Error() string {
+	return "addresses in use outside of the new ranges: " + strings.Join(e.IPs, ",")
+}
 
-				_, subnet, _ := net.ParseCIDR(network.Subnet)
-				gatewayCIDR := &net.IPNet{net.ParseIP(network.Gateway), subnet.Mask}
-				if err = util.SetInterfaceIp(network.Name, gatewayCIDR.String()); err != nil {
-					log.Println("set ip err in syncNetwork", network.Name)
-					continue
-				}
+// apply update to network, without checking it against the allocations
+func (n *Network) apply(update *NetworkUpdate) error {
+	if update.Labels != nil {
+		if err := checkLabels(*update.Labels); err != nil {
+			return err
+		}
+		n.Labels = *update.Labels
+	}
 
-				if err = util.InterfaceUp(network.Name); err != nil {
-					log.Println("interface up err in syncNetwork", network.Name)
-					continue
-				}
-				d.Gateways[network.Name] = struct{}{}
+	if update.MTU != nil {
+		min := 576
+		subnets, _ := n.subnets()
+		for _, s := range subnets {
+			if isIPv6(s.subnet) {
+				min = 1280
+			}
+		}
+		if *update.MTU != 0 && (*update.MTU < min || *update.MTU > 9000) {
+			return fmt.Errorf("mtu %d is not from %d to 9000", *update.MTU, min)
+		}
+		n.MTU = *update.MTU
+	}
 
-				if err = setupIPTables(network.Name, network.Subnet); err != nil {
-					log.Println("iptable setup err in syncNetwork", network.Name)
-					continue
-				}
-				log.Println(network.Name + " network created")
+	if update.NAT != nil {
+		switch *update.NAT {
+		case "", natMasquerade, natNone:
+		default:
+			return errors.New("nat is " + natMasquerade + " or " + natNone + ", not " + *update.NAT)
+		}
+		n.NAT = *update.NAT
+	}
+
+	if update.DNS != nil {
+		for _, server := range *update.DNS {
+			if net.ParseIP(server) == nil {
+				return errors.New("invalid name server " + server)
 			}
 		}
+		n.DNS = *update.DNS
+	}
 
-		//delete unused interface
-		var found bool
-		for k, _ := range d.Gateways {
-			found = false
-			for _, network := range networks {
-				if network.Name == k {
-					//find network in the datastore
-					found = true
-					break
-				}
+	if update.Ranges != nil {
+		n.Ranges = *update.Ranges
+	}
+	return n.checkPools()
+}
+
+// the addresses of containers and reservations old handed out from its
+// ranges that updated can't hand out
+func rangeConflicts(old *Network, updated *Network) ([]string, error) {
+	leases, err := GetLeases(old)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := GetReservations(old)
+	if err != nil {
+		return nil, err
+	}
+
+	var inUse []string
+	for _, lease := range leases {
+		inUse = append(inUse, lease.IP)
+	}
+	for _, reservation := range reservations {
+		inUse = append(inUse, reservation.IPs...)
+	}
+
+	subnets, err := old.subnets()
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	for _, addr := range inUse {
+		ip := net.ParseIP(addr)
+		for _, s := range ipSubnets(subnets, []net.IP{ip}) {
+			if s.subnet == nil {
+				continue
+			}
+			oldPool, err := networkPool(old, *s.subnet)
+			if err != nil {
+				return nil, err
+			}
+			newPool, err := networkPool(updated, *s.subnet)
+			if err != nil {
+				return nil, err
 			}
 
-			// not found interface named k, delete it
-			if !found {
-				deletePort(ovsClient, bridgeName, k)
-				delete(d.Gateways, k)
-				log.Println("delete unused interface", k)
+			// static addresses outside of the old ranges stay valid
+			pos := ipPos(ip, *s.subnet)
+			if oldPool.inRange(pos) && !newPool.inRange(pos) {
+				conflicts = append(conflicts, addr)
 			}
 		}
-		time.Sleep(5 * time.Second)
 	}
+	return conflicts, nil
 }
 
-func allocateVNI() (uint, error) {
-	vlanBytes, _, ok := netAgent.Get(vlanStore, "vlan")
+// UpdateNetwork changes the mutable attributes of network name. Every host
+// applies the gateway MTU and NAT rules once the reconciler sees the change
+func UpdateNetwork(name string, update *NetworkUpdate) (*Network, error) {
+	for {
+		netBytes, netIndex, ok := netAgent.Get(networkStore, name)
+		if !ok {
+			return nil, errors.New("Network " + name + " not exist")
+		}
 
-	// not put the key already
-	if !ok {
-		vlanBytes = make([]byte, vlanCount/8)
-	}
+		old := &Network{}
+		if err := json.Unmarshal(netBytes, old); err != nil {
+			return nil, err
+		}
 
-	curVal := make([]byte, vlanCount/8)
-	copy(curVal, vlanBytes)
+		// apply replaces whole fields, the copy shares nothing it changes
+		updated := *old
+		network := &updated
+		if err := network.apply(update); err != nil {
+			return nil, &InvalidNetworkError{err.Error()}
+		}
 
-	VNI := util.TestAndSet(vlanBytes)
+		if update.Ranges != nil {
+			conflicts, err := rangeConflicts(old, network)
+			if err != nil {
+				return nil, err
+			}
+			if len(conflicts) != 0 {
+				return nil, &RangeConflictError{conflicts}
+			}
+		}
 
-	if VNI > vlanCount {
-		return uint(VNI), errors.New("All VNI have been used")
+		netBytes, _ = json.Marshal(network)
+		switch netAgent.CAS(networkStore, name, netBytes, netIndex) {
+		case netAgent.OK:
+			return network, nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return nil, errors.New("Error updating network " + name)
+		}
 	}
+}
+
+// NetworkInUseError is a network that can't be deleted because containers
+// hold addresses of it
+type NetworkInUseError struct {
+	Network string  `json:"network"`
+	Leases  []Lease `json:"connections"`
+}
 
-	netAgent.Put(vlanStore, "vlan", vlanBytes, curVal)
+func (e *NetworkInUseError) Error() string {
+	return fmt.Sprintf("network %s is in use by %d connections", e.Network, len(e.Leases))
+}
 
-	return uint(VNI), nil
+// DeleteNetwork refuses to delete a network containers of any host hold
+// leased addresses of unless force is set. Every host detaches its containers and
+// drops the gateway and iptables rules once the reconciler sees the network
+// gone
+func DeleteNetwork(name string, force bool) error {
+	if err := deleteNetworkRecord(name, force); err != nil {
+		return err
+	}
 
+	if ovsClient == nil {
+		return errors.New("OVS not connected")
+	}
+	deletePort(ovsClient, bridgeName, name)
+	return nil
 }
 
-func releaseVNI(VNI uint) {
-	oldVal, _, ok := netAgent.Get(vlanStore, "vlan")
+// deleteNetworkRecord removes the network record, releases its VNI and
+// drops its ip blocks, leases and reservations in one transaction. Without
+// force a network with leases is a NetworkInUseError. The check only knows
+// leases: a container whose lease was collected, or an address allocated
+// without one, doesn't keep the network
+func deleteNetworkRecord(name string, force bool) error {
+	for {
+		netBytes, netIndex, ok := netAgent.Get(networkStore, name)
+		if !ok {
+			return errors.New("Network " + name + " not exist")
+		}
+
+		network := &Network{}
+		if err := json.Unmarshal(netBytes, network); err != nil {
+			return err
+		}
+
+		subnets, err := network.subnets()
+		if err != nil {
+			return err
+		}
+
+		if !force {
+			leases, err := GetLeases(network)
+			if err != nil {
+				return err
+			}
+			if len(leases) != 0 {
+				return &NetworkInUseError{name, leases}
+			}
+		}
+
+		ops := []netAgent.TxnOp{
+			{Store: networkStore, Key: name, Index: netIndex, Delete: true},
+		}
+
+		vnis, err := loadVNIs(netAgent.GetStore())
+		if err != nil {
+			return err
+		}
+		ops = append(ops, vnis.ops(vnis.used.remove(network.VNI))...)
+
+		ipPairs, ok := netAgent.List(ipStore)
+		if !ok {
+			return errors.New("Error listing " + ipStore)
+		}
+
+		bases := make(map[string]bool)
+		for _, s := range subnets {
+			bases[ipKey(fmt.Sprint(network.VNI), *s.subnet)] = true
+		}
 
-	if !ok {
-		oldVal = make([]byte, vlanCount/8)
+		// the blocks, or whole bitmaps of an older release
+		for _, pair := range ipPairs {
+			if base, _, _ := splitIPBlockKey(pair.Key); bases[base] {
+				ops = append(ops, netAgent.TxnOp{Store: ipStore, Key: pair.Key, Index: pair.ModifyIndex, Delete: true})
+			}
+		}
+
+		// leases and reservations are keyed by VNI/
+		prefix := fmt.Sprint(network.VNI) + "/"
+		for _, store := range []string{leaseStore, reservationStore} {
+			storePairs, ok := netAgent.List(store)
+			if !ok {
+				return errors.New("Error listing " + store)
+			}
+
+			for _, pair := range storePairs {
+				if strings.HasPrefix(pair.Key, prefix) {
+					ops = append(ops, netAgent.TxnOp{Store: store, Key: pair.Key, Index: pair.ModifyIndex, Delete: true})
+				}
+			}
+		}
+
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			for base := range bases {
+				clearIPCursor(base)
+			}
+			return nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return errors.New("Error deleting network")
+		}
 	}
-	curVal := make([]byte, vlanCount/8)
-	copy(curVal, oldVal)
+}
+
+// casUpdate reads the value of store/key, lets update modify a copy of it
+// and writes it back with the ModifyIndex that was read, so a concurrent
+// writer on another node makes the write fail with OUTDATED instead of
+// being overwritten. On conflict it re-reads and retries.
+// initial is used when the key does not exist yet, nil means it must exist.
+// It returns false when the key is missing, update gives up or the store
+// reports an error
+func casUpdate(store string, key string, initial []byte, update func([]byte) bool) bool {
+	for {
+		oldVal, index, ok := netAgent.Get(store, key)
+
+		if !ok {
+			if initial == nil {
+				return false
+			}
+			oldVal = initial
+			index = 0
+		}
 
-	util.Clear(curVal, VNI-1)
-	err := netAgent.Put(vlanStore, "vlan", curVal, oldVal)
-	if err == netAgent.OUTDATED {
-		releaseVNI(VNI)
+		newVal := make([]byte, len(oldVal))
+		copy(newVal, oldVal)
+
+		if !update(newVal) {
+			return false
+		}
+
+		switch netAgent.CAS(store, key, newVal, index) {
+		case netAgent.OK:
+			return true
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return false
+		}
 	}
 }
+
 func GetAvailableGwAddress(bridgeIP string) (gwaddr string, err error) {
 	if len(bridgeIP) != 0 {
 		_, _, err = net.ParseCIDR(bridgeIP)
@@ -383,137 +924,174 @@ func GetAvailableGwAddress(bridgeIP string) (gwaddr string, err error) {
 	return gwaddr, nil
 }
 
-func GetAvailableSubnet() (subnet *net.IPNet, err error) {
-	for _, addr := range gatewayAddrs {
-		_, dockerNetwork, err := net.ParseCIDR(addr)
-		if err != nil {
-			return &net.IPNet{}, err
-		}
-		if err = util.CheckRouteOverlaps(dockerNetwork); err == nil {
-			return dockerNetwork, nil
-		}
-	}
-
-	return &net.IPNet{}, errors.New("No available GW address")
+// SubnetPool is the supernet the subnets of networks created without one
+// are carved from, like 10.128.0.0/9 in /24s
+type SubnetPool struct {
+	Supernet *net.IPNet
+	Prefix   int
 }
 
-// ipStore manage the cluster ip resource
-// key is the vlan/subnet, value is the available ip address bytes
-// Get an IP from the unused subnet and mark it as used
-func RequestIP(VNI string, subnet net.IPNet) net.IP {
-	ipCount := util.IPCount(subnet)
-	bc := int(ipCount / 8)
-	partial := int(math.Mod(ipCount, float64(8)))
+// nil picks from gatewayAddrs. Set from the daemon flags
+var subnetPool *SubnetPool
 
-	if partial != 0 {
-		bc += 1
+// the pool of supernet carved into subnets of prefix bits, nil if supernet
+// is empty
+func parseSubnetPool(supernet string, prefix int) (*SubnetPool, error) {
+	if supernet == "" {
+		return nil, nil
 	}
 
-	oldArray, _, ok := netAgent.Get(ipStore, VNI+"-"+subnet.String())
+	_, super, err := net.ParseCIDR(supernet)
+	if err != nil {
+		return nil, err
+	}
 
-	if !ok {
-		oldArray = make([]byte, bc)
+	ones, bits := super.Mask.Size()
+	if prefix < ones || prefix > bits-2 {
+		return nil, fmt.Errorf("subnets of %s must have a prefix from %d to %d", super, ones, bits-2)
 	}
+	return &SubnetPool{super, prefix}, nil
+}
 
-	newArray := make([]byte, len(oldArray))
+func (p *SubnetPool) String() string {
+	return fmt.Sprintf("%s/%d", p.Supernet, p.Prefix)
+}
 
-	copy(newArray, oldArray)
+// the first subnet of the pool available accepts, nil if there is none
+func (p *SubnetPool) find(available func(*net.IPNet) bool) *net.IPNet {
+	ones, bits := p.Supernet.Mask.Size()
+	base := new(big.Int).SetBytes(ipBytes(p.Supernet.IP, *p.Supernet))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(p.Prefix-ones))
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-p.Prefix))
 
-	pos := util.TestAndSet(newArray)
+	for i := new(big.Int); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		start := new(big.Int).Add(base, new(big.Int).Mul(i, size)).Bytes()
 
-	err := netAgent.Put(ipStore, VNI+"-"+subnet.String(), newArray, oldArray)
+		ip := make(net.IP, bits/8)
+		copy(ip[len(ip)-len(start):], start)
+		candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(p.Prefix, bits)}
 
-	if err == netAgent.OUTDATED {
-		return RequestIP(VNI, subnet)
+		if available(candidate) {
+			return candidate
+		}
 	}
+	return nil
+}
 
-	var num uint32
+// GetAvailableSubnet picks the first subnet of the pool that overlaps no
+// network, no route of a member node and no local route
+func GetAvailableSubnet() (subnet *net.IPNet, err error) {
+	used, err := loadClusterSubnets()
+	if err != nil {
+		return &net.IPNet{}, err
+	}
 
-	buf := bytes.NewBuffer(subnet.IP)
+	available := func(candidate *net.IPNet) bool {
+		return used.conflict(candidate) == nil && util.CheckRouteOverlaps(candidate) == nil
+	}
 
-	err2 := binary.Read(buf, binary.BigEndian, &num)
+	if subnetPool == nil {
+		for _, addr := range gatewayAddrs {
+			_, dockerNetwork, err := net.ParseCIDR(addr)
+			if err != nil {
+				return &net.IPNet{}, err
+			}
+			if available(dockerNetwork) {
+				return dockerNetwork, nil
+			}
+		}
+		return &net.IPNet{}, errors.New("No available GW address")
+	}
 
-	if err2 != nil {
-		log.Println(err)
-		return nil
+	if subnet = subnetPool.find(available); subnet != nil {
+		return subnet, nil
 	}
+	return &net.IPNet{}, errors.New("No available subnet in " + subnetPool.String())
+}
 
-	num += pos
+// ipStore manage the cluster ip resource
+// key is the vlan/subnet/block, value is the available ip address bytes of
+// the block, see ipblock.go
 
-	buf2 := new(bytes.Buffer)
-	err2 = binary.Write(buf2, binary.BigEndian, num)
+func ipKey(VNI string, subnet net.IPNet) string {
+	return VNI + "-" + subnet.String()
+}
 
-	if err2 != nil {
-		return nil
+// bytes of the bitmap holding one bit per address of subnet, at most
+// maxIPv6Bits for IPv6
+func ipBitmapSize(subnet net.IPNet) int {
+	ipCount := util.IPCount(subnet)
+	if isIPv6(&subnet) && ipCount > maxIPv6Bits {
+		ipCount = maxIPv6Bits
 	}
-	return net.IP(buf2.Bytes())
+	bc := int(ipCount / 8)
+	partial := int(math.Mod(ipCount, float64(8)))
 
+	if partial != 0 {
+		bc += 1
+	}
+	return bc
 }
 
-// Mark a specified ip as used, return true as success
-func MarkUsed(VNI string, addr net.IP, subnet net.IPNet) bool {
-	oldArray, _, ok := netAgent.Get(ipStore, VNI+"-"+subnet.String())
-
-	if !ok {
-		// the kv pair not exist yet
-		return false
+// addresses in the same family as subnet
+func ipBytes(ip net.IP, subnet net.IPNet) []byte {
+	if isIPv6(&subnet) {
+		return ip.To16()
 	}
+	return ip.To4()
+}
 
-	newArray := make([]byte, len(oldArray))
-	copy(newArray, oldArray)
-
-	var num1, num2 uint32
-
-	buf1 := bytes.NewBuffer(addr.To4())
-	binary.Read(buf1, binary.BigEndian, &num1)
-
-	buf := bytes.NewBuffer(subnet.IP)
+// bit of addr in the bitmap of subnet, math.MaxUint32 when addr is outside
+// of the bitmap
+func ipPos(addr net.IP, subnet net.IPNet) uint32 {
+	a := ipBytes(addr, subnet)
+	if a == nil {
+		return math.MaxUint32
+	}
 
-	binary.Read(buf, binary.BigEndian, &num2)
+	pos := new(big.Int).SetBytes(a)
+	pos.Sub(pos, new(big.Int).SetBytes(ipBytes(subnet.IP, subnet)))
+	pos.Sub(pos, big.NewInt(1))
 
-	pos := uint32(num1 - num2 - 1)
+	if pos.Sign() < 0 || pos.Cmp(big.NewInt(math.MaxUint32)) > 0 {
+		return math.MaxUint32
+	}
+	return uint32(pos.Uint64())
+}
 
-	util.Set(newArray, pos)
+// address for pos as returned by util.TestAndSet, nil on error
+func ipFromPos(pos uint32, subnet net.IPNet) net.IP {
+	base := ipBytes(subnet.IP, subnet)
+	if base == nil {
+		return nil
+	}
 
-	err2 := netAgent.Put(ipStore, VNI+"-"+subnet.String(), newArray, oldArray)
+	num := new(big.Int).SetBytes(base)
+	num.Add(num, big.NewInt(int64(pos)))
 
-	if err2 == netAgent.OUTDATED {
-		MarkUsed(VNI, addr, subnet)
+	b := num.Bytes()
+	if len(b) > len(base) {
+		return nil
 	}
 
-	return true
-
+	ip := make(net.IP, len(base))
+	copy(ip[len(ip)-len(b):], b)
+	return ip
 }
 
 // Release the given IP from the subnet of vlan
 func ReleaseIP(addr net.IP, subnet net.IPNet, VNI string) bool {
-	oldArray, _, ok := netAgent.Get(ipStore, VNI+"-"+subnet.String())
-
-	if !ok {
+	pos := ipPos(addr, subnet)
+	if pos >= uint32(ipBitmapSize(subnet)*8) {
 		return false
 	}
 
-	newArray := make([]byte, len(oldArray))
-	copy(newArray, oldArray)
-
-	var num1, num2 uint32
-
-	buf1 := bytes.NewBuffer(addr.To4())
-	binary.Read(buf1, binary.BigEndian, &num1)
-
-	buf := bytes.NewBuffer(subnet.IP)
-
-	binary.Read(buf, binary.BigEndian, &num2)
-
-	pos := uint(num1 - num2 - 1)
-
-	util.Clear(newArray, pos)
-
-	err2 := netAgent.Put(ipStore, VNI+"-"+subnet.String(), newArray, oldArray)
-
-	if err2 == netAgent.OUTDATED {
-		return ReleaseIP(addr, subnet, VNI)
-	}
+	migrateIPBitmap(VNI, subnet)
 
-	return true
+	// the block must exist already
+	key := ipBlockKey(VNI, subnet, pos/ipBlockBits)
+	return casUpdate(ipStore, key, nil, func(bits []byte) bool {
+		util.Clear(bits, uint(pos%ipBlockBits))
+		return true
+	})
 }
@@ -4,27 +4,60 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	_ "time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/socketplane/libovsdb"
 )
 
 var subnetArray []*net.IPNet
 var bridgeUUID string
 
+// skip the tests touching ovs-br0 when no ovsdb-server is around
+func skipUnlessOVS(t *testing.T, name string) {
+	if os.Getuid() != 0 {
+		msg := "Skipping " + name + " because it requires root privileges."
+		fmt.Println(msg)
+		t.Skip(msg)
+	}
+	if ovsClient != nil {
+		return
+	}
+	client, err := libovsdb.Connect("", 0)
+	if err != nil {
+		msg := "Skipping " + name + " because it requires a running ovsdb-server."
+		fmt.Println(msg)
+		t.Skip(msg)
+	}
+	client.Disconnect()
+	initOVS()
+}
+
 func TestStartAgent(t *testing.T) {
-	err := InitAgent("eth0", true)
+	d := NewDaemon()
+	d.storeBackend = memoryBackend
+
+	go func() {
+		<-d.readyChan
+	}()
+
+	err := InitAgent(d)
 
 	if err != nil {
 		t.Errorf("Error starting agent")
 	}
+
+	if !d.isReady {
+		t.Error("daemon should be ready with a memory store")
+	}
 }
 
 func TestNetworkInit(t *testing.T) {
-	if os.Getuid() != 0 {
-		msg := "Skipping TestNetworkInit because it requires root privileges."
-		fmt.Println(msg)
-		t.Skip(msg)
-	}
+	skipUnlessOVS(t, "TestNetworkInit")
+	netAgent.SetStore(netAgent.NewMemoryStore())
 
 	//prepare the net Array
 	_, ipNet1, _ := net.ParseCIDR("10.10.1.0/24")
@@ -43,11 +76,7 @@ func TestNetworkInit(t *testing.T) {
 }
 
 func TestGetEmptyNetworks(t *testing.T) {
-	if os.Getuid() != 0 {
-		msg := "Skipping TestNetworkInit because it requires root privileges."
-		fmt.Println(msg)
-		t.Skip(msg)
-	}
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	networks, _ := GetNetworks()
 	if networks == nil {
 		t.Error("GetNetworks must return an empty array when networks are not created ")
@@ -55,11 +84,7 @@ func TestGetEmptyNetworks(t *testing.T) {
 }
 
 func TestNetworkCreate(t *testing.T) {
-	if os.Getuid() != 0 {
-		msg := "Skipping TestNetworkCreate because it requires root privileges."
-		fmt.Println(msg)
-		t.Skip(msg)
-	}
+	skipUnlessOVS(t, "TestNetworkCreate")
 	for i := 0; i < len(subnetArray); i++ {
 		_, err := CreateNetwork(fmt.Sprintf("Network-%d", i+1), subnetArray[i])
 		if err != nil {
@@ -70,6 +95,7 @@ func TestNetworkCreate(t *testing.T) {
 }
 
 func TestGetNetwork(t *testing.T) {
+	skipUnlessOVS(t, "TestGetNetwork")
 	for i := 0; i < len(subnetArray); i++ {
 		network, _ := GetNetwork(fmt.Sprintf("Network-%d", i+1))
 		if network == nil {
@@ -82,13 +108,9 @@ func TestGetNetwork(t *testing.T) {
 }
 
 func TestNetworkCleanup(t *testing.T) {
-	if os.Getuid() != 0 {
-		msg := "Skipped TestNetworkCleanup test because it requires root privileges."
-		fmt.Println(msg)
-		t.Skip(msg)
-	}
+	skipUnlessOVS(t, "TestNetworkCleanup")
 	for i := 0; i < len(subnetArray); i++ {
-		err := DeleteNetwork(fmt.Sprintf("Network-%d", i+1))
+		err := DeleteNetwork(fmt.Sprintf("Network-%d", i+1), false)
 		if err != nil {
 			t.Error("Error Deleting Network", err)
 		}
@@ -101,32 +123,39 @@ func TestNetworkCleanup(t *testing.T) {
 }
 
 func TestAllocateandReleaseVNI(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.31.0.0/24")
+
 	for i := 1; i <= 10; i++ {
-		vni, err := allocateVNI()
+		network, err := createNetworkRecord(fmt.Sprint("vni", i), subnet, nil, NetworkOptions{})
 
-		if err != nil || vni != uint(i) {
-			t.Error("1.allocate vni wrong at", vni, i)
+		if err != nil || network.VNI != uint(i) {
+			t.Error("1.allocate vni wrong at", network, i, err)
 		}
 	}
 	for i := 1; i <= 5; i++ {
-		releaseVNI(uint(2 * i))
+		if err := deleteNetworkRecord(fmt.Sprint("vni", 2*i), false); err != nil {
+			t.Error("delete network failed", err)
+		}
 	}
 
 	for i := 1; i <= 5; i++ {
-		vni, err := allocateVNI()
-		if err != nil || vni != uint(2*i) {
-			t.Error("2.allocate vni wrong at", vni, i)
+		network, err := createNetworkRecord(fmt.Sprint("again", i), subnet, nil, NetworkOptions{})
+		if err != nil || network.VNI != uint(2*i) {
+			t.Error("2.allocate vni wrong at", network, i, err)
 		}
 	}
 }
 
 func TestRequestandReleaseIP(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
 	TestCount := 5
 
 	_, ipNet, _ := net.ParseCIDR("192.168.0.0/16")
 
 	for i := 1; i <= TestCount; i++ {
-		addr := RequestIP("1", *ipNet)
+		addr := requestIP("1", *ipNet)
 		addr = addr.To4()
 		if addr == nil || i%256 != int(addr[3]) || i/256 != int(addr[2]) {
 			t.Error(addr.String(), "is wrong")
@@ -143,22 +172,440 @@ func TestRequestandReleaseIP(t *testing.T) {
 		t.Error("Release 192.168.0.2 failed")
 	}
 
-	addr := RequestIP("1", *ipNet).To4()
+	addr := requestIP("1", *ipNet).To4()
 	if int(addr[3]) != 1 {
 		t.Error(addr.String())
 	}
 
-	MarkUsed("1", net.ParseIP("192.168.0.2"), *ipNet)
+	if err := newIPPool(*ipNet).markStatic("1", net.ParseIP("192.168.0.2"), nil); err != nil {
+		t.Error(err)
+	}
 
-	addr = RequestIP("1", *ipNet).To4()
+	addr = requestIP("1", *ipNet).To4()
 
 	if int(addr[3]) != 4 {
 		t.Error(addr.String())
 	}
 }
 
+// concurrent requests must never be given the same address or VNI
+func TestConcurrentRequestIPAndVNI(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, ipNet, _ := net.ParseCIDR("10.20.0.0/24")
+	count := 50
+
+	ips := make(chan string, count)
+	vnis := make(chan uint, count)
+	var wg sync.WaitGroup
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips <- requestIP("1", *ipNet).String()
+			network, err := createNetworkRecord(fmt.Sprint("concurrent", i), ipNet, nil, NetworkOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			vnis <- network.VNI
+		}(i)
+	}
+	wg.Wait()
+	close(ips)
+	close(vnis)
+
+	seenIP := make(map[string]bool)
+	for ip := range ips {
+		if seenIP[ip] {
+			t.Fatal(ip, "allocated twice")
+		}
+		seenIP[ip] = true
+	}
+
+	seenVNI := make(map[uint]bool)
+	for vni := range vnis {
+		if seenVNI[vni] {
+			t.Fatal("VNI", vni, "allocated twice")
+		}
+		seenVNI[vni] = true
+	}
+}
+
+// the store side of create and delete, VNI, ip bitmap and record go together
+func TestNetworkRecordTxn(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.30.0.0/24")
+
+	network, err := createNetworkRecord("txn1", subnet, nil, NetworkOptions{})
+	if err != nil || network.VNI != 1 || network.Gateway != "10.30.0.1" {
+		t.Fatal("create network record failed", network, err)
+	}
+
+	if _, err := createNetworkRecord("txn1", subnet, nil, NetworkOptions{}); err == nil {
+		t.Fatal("creating an existing network must fail")
+	}
+
+	// the failed create must not keep a VNI
+	network2, err := createNetworkRecord("txn2", subnet, net.ParseIP("10.30.0.254"), NetworkOptions{})
+	if err != nil || network2.VNI != 2 || network2.Gateway != "10.30.0.254" {
+		t.Fatal("create network record failed", network2, err)
+	}
+
+	if addr := requestIP("2", *subnet).To4(); addr == nil || addr[3] != 1 {
+		t.Fatal("address after the gateway is wrong", addr)
+	}
+
+	if err := deleteNetworkRecord("txn1", false); err != nil {
+		t.Fatal("delete network record failed", err)
+	}
+
+	if _, _, ok := netAgent.Get(ipStore, ipBlockKey("1", *subnet, 0)); ok {
+		t.Fatal("ip bitmap of a deleted network must be gone")
+	}
+
+	if _, err := GetNetwork("txn1"); err == nil {
+		t.Fatal("network record must be gone")
+	}
+
+	// VNI 1 is free again
+	network, err = createNetworkRecord("txn3", subnet, nil, NetworkOptions{})
+	if err != nil || network.VNI != 1 || network.Gateway != "10.30.0.1" {
+		t.Fatal("VNI or gateway not released", network, err)
+	}
+
+	if err := deleteNetworkRecord("nonexistent", false); err == nil {
+		t.Fatal("deleting a missing network must fail")
+	}
+}
+
+func TestRequestIPv6(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, ipNet, _ := net.ParseCIDR("fd00:42::/64")
+
+	if size := ipBitmapSize(*ipNet); size != maxIPv6Bits/8 {
+		t.Fatal("IPv6 bitmap must be capped", size)
+	}
+
+	for i := 1; i <= 3; i++ {
+		addr := requestIP("1", *ipNet)
+		if !addr.Equal(net.ParseIP(fmt.Sprintf("fd00:42::%d", i))) {
+			t.Fatal(addr, "is wrong")
+		}
+	}
+
+	if !ReleaseIP(net.ParseIP("fd00:42::2"), *ipNet, "1") {
+		t.Fatal("Release fd00:42::2 failed")
+	}
+	if addr := requestIP("1", *ipNet); !addr.Equal(net.ParseIP("fd00:42::2")) {
+		t.Fatal(addr, "is wrong")
+	}
+
+	// beyond the allocatable part of the subnet
+	pool := newIPPool(*ipNet)
+	if pool.markStatic("1", net.ParseIP("fd00:42::1:0:0"), nil) == nil {
+		t.Fatal("static address outside the bitmap must be refused")
+	}
+	if pool.markStatic("1", net.ParseIP("10.1.0.1"), nil) == nil {
+		t.Fatal("static IPv4 address must be refused")
+	}
+
+	if mac := generateMacAddr(net.ParseIP("fd00:42::1:2")).String(); mac != "02:42:00:01:00:02" {
+		t.Fatal("wrong mac", mac)
+	}
+	if mac := generateMacAddr(net.ParseIP("10.1.0.2")).String(); mac != "02:42:0a:01:00:02" {
+		t.Fatal("wrong mac", mac)
+	}
+}
+
+// a dual stack network allocates and releases both subnets together
+func TestDualStackNetworkRecord(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.50.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:50::/64")
+
+	network, err := createNetworkRecord("dual", subnet, nil, NetworkOptions{Subnet6: subnet6})
+	if err != nil || network.Gateway != "10.50.0.1" || network.Subnet6 != "fd00:50::/64" || network.Gateway6 != "fd00:50::1" {
+		t.Fatal("create dual stack network record failed", network, err)
+	}
+
+	subnets, err := network.subnets()
+	if err != nil || len(subnets) != 2 || !isIPv6(subnets[1].subnet) {
+		t.Fatal("wrong subnets", subnets, err)
+	}
+
+	ips, err := requestIPs(network, subnets, "fd00:50::10")
+	if err != nil || !ips[0].Equal(net.ParseIP("10.50.0.2")) || !ips[1].Equal(net.ParseIP("fd00:50::10")) {
+		t.Fatal("requestIPs failed", ips, err)
+	}
+
+	if problems := audit(netAgent.GetStore()); len(problems) != 0 {
+		t.Fatal("dual stack network must pass the audit", problems)
+	}
+
+	if err := deleteNetworkRecord("dual", false); err != nil {
+		t.Fatal("delete network record failed", err)
+	}
+	if _, _, ok := netAgent.Get(ipStore, ipBlockKey("1", *subnet6, 0)); ok {
+		t.Fatal("IPv6 bitmap of a deleted network must be gone")
+	}
+
+	if _, err := CreateNetworkWithOptions("bad", subnet6, NetworkOptions{Subnet6: subnet6}); err == nil {
+		t.Fatal("subnet6 with an IPv6 subnet must be rejected")
+	}
+}
+
+// a full subnet falls through to the secondary subnets of its family
+func TestAddSubnet(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.71.0.0/30")
+	if _, err := createNetworkRecord("grow", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, secondary, _ := net.ParseCIDR("10.71.1.0/29")
+	network, err := AddSubnet("grow", secondary, nil)
+	if err != nil || len(network.Secondary) != 1 || network.Secondary[0].Gateway != "10.71.1.1" {
+		t.Fatal("add subnet failed", network, err)
+	}
+
+	stored, _ := GetNetwork("grow")
+	subnets, err := stored.subnets()
+	if err != nil || len(subnets) != 2 {
+		t.Fatal("secondary subnet not stored", subnets, err)
+	}
+
+	for _, expected := range []string{"10.71.0.2", "10.71.1.2", "10.71.1.3"} {
+		ips, err := requestIPs(stored, subnets, "")
+		if err != nil || len(ips) != 1 || ips[0].String() != expected {
+			t.Fatal("expected", expected, ips, err)
+		}
+		if s := ipSubnets(subnets, ips)[0]; !s.subnet.Contains(ips[0]) || !s.subnet.Contains(s.gateway) {
+			t.Fatal("wrong subnet of", ips[0], s.subnet)
+		}
+	}
+
+	// static requests in the secondary subnet
+	if ips, err := requestIPs(stored, subnets, "10.71.1.6"); err != nil || ips[0].String() != "10.71.1.6" {
+		t.Fatal("static request in the secondary subnet failed", ips, err)
+	}
+
+	if problems := audit(netAgent.GetStore()); len(problems) != 0 {
+		t.Fatal("audit problems", problems)
+	}
+
+	_, overlapping, _ := net.ParseCIDR("10.71.0.0/23")
+	if _, err := AddSubnet("grow", overlapping, nil); err == nil {
+		t.Fatal("overlapping subnet accepted")
+	} else if _, ok := err.(*SubnetConflictError); !ok {
+		t.Fatal("overlap must be a conflict", err)
+	}
+
+	_, subnet6, _ := net.ParseCIDR("fd00:71::/64")
+	if _, err := AddSubnet("grow", subnet6, nil); err == nil {
+		t.Fatal("IPv6 subnet added to an IPv4 network")
+	}
+
+	if err := deleteNetworkRecord("grow", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := netAgent.Get(ipStore, ipBlockKey("1", *secondary, 0)); ok {
+		t.Fatal("block of the secondary subnet left")
+	}
+}
+
 func TestLeaveCluster(t *testing.T) {
+	if _, err := net.Dial("tcp", "127.0.0.1:8500"); err != nil {
+		t.Skip("Skipping TestLeaveCluster because it requires a consul agent.")
+	}
 	if err := leave(); err != nil {
 		t.Error("Error leaving the cluster")
 	}
 }
+
+func TestSubnetPool(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	invalid := []struct {
+		supernet string
+		prefix   int
+	}{{"bogus", 24}, {"10.128.0.0/9", 8}, {"10.128.0.0/9", 31}}
+	for _, bad := range invalid {
+		if _, err := parseSubnetPool(bad.supernet, bad.prefix); err == nil {
+			t.Fatal("bad pool accepted", bad)
+		}
+	}
+
+	pool, err := parseSubnetPool("10.128.0.0/9", 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetPool = pool
+	defer func() { subnetPool = nil }()
+
+	_, subnet, _ := net.ParseCIDR("10.128.0.0/24")
+	if _, err := createNetworkRecord("pool", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putNodeRoutes("node1", []string{"10.128.1.0/25", "fd00:1::/64"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if subnet, err := GetAvailableSubnet(); err != nil || subnet.String() != "10.128.2.0/24" {
+		t.Fatal("expected 10.128.2.0/24", subnet, err)
+	}
+
+	conflicts := []string{"10.128.0.128/25", "10.0.0.0/8", "10.128.1.64/26", "fd00:1::/48"}
+	for _, cidr := range conflicts {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		if _, ok := checkSubnetOverlaps(subnet).(*SubnetConflictError); !ok {
+			t.Fatal(cidr, "must conflict")
+		}
+	}
+
+	_, subnet, _ = net.ParseCIDR("10.128.1.0/24")
+	if _, err := CreateNetworkWithOptions("route", subnet, NetworkOptions{}); err == nil {
+		t.Fatal("network overlapping a route of a node created")
+	}
+	if _, err := GetNetwork("route"); err == nil {
+		t.Fatal("network record of a rejected network written")
+	}
+
+	routes, err := GetNodeRoutes()
+	if err != nil || len(routes) != 1 || routes[0].Node != "node1" {
+		t.Fatal("wrong node routes", routes, err)
+	}
+}
+
+// an interface kept as gateway only excuses its own route on this node
+func TestDropOwnRoute(t *testing.T) {
+	node, _ := os.Hostname()
+	used := &clusterSubnets{nodeRoutes: []NodeRoutes{
+		{Node: node, Routes: []string{"10.129.0.0/24", "10.130.0.0/16"}},
+		{Node: "node1", Routes: []string{"10.129.0.0/25"}},
+	}}
+
+	_, subnet, _ := net.ParseCIDR("10.129.0.0/24")
+	used.dropRoute(node, subnet)
+
+	if routes := used.nodeRoutes[0].Routes; len(routes) != 1 || routes[0] != "10.130.0.0/16" {
+		t.Fatal("only the route of the interface must be dropped", routes)
+	}
+	if err, ok := used.conflict(subnet).(*SubnetConflictError); !ok || !strings.Contains(err.Error(), "node1") {
+		t.Fatal("route of another node must still conflict", err)
+	}
+}
+
+func TestUpdateNetwork(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.76.0.0/24")
+	options := NetworkOptions{Ranges: []IPRange{{"10.76.0.10", "10.76.0.19"}}, DNS: []string{"10.0.0.53"}}
+	network, err := createNetworkRecord("update", subnet, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+
+	// one address from the ranges, one static outside of them
+	ips, _ := requestIPs(network, subnets, "")
+	putLeases(network, subnets, ips, &Connection{ContainerID: "c1"})
+	static, _ := requestIPs(network, subnets, "10.76.0.100")
+	putLeases(network, subnets, static, &Connection{ContainerID: "c2"})
+
+	mtu, nat := 9000, natNone
+	labels := map[string]string{"team": "db"}
+	network, err = UpdateNetwork("update", &NetworkUpdate{MTU: &mtu, NAT: &nat, Labels: &labels})
+	if err != nil || network.MTU != 9000 || network.masquerade() || network.Labels["team"] != "db" {
+		t.Fatal("update failed", network, err)
+	}
+	if len(network.DNS) != 1 || len(network.Ranges) != 1 {
+		t.Fatal("attributes not in the update changed", network)
+	}
+
+	invalid := []*NetworkUpdate{
+		{MTU: func() *int { m := 100; return &m }()},
+		{NAT: func() *string { n := "snat"; return &n }()},
+		{DNS: &[]string{"bogus"}},
+		{Labels: &map[string]string{"a=b": "c"}},
+		{Ranges: &[]IPRange{{"10.77.0.10", "10.77.0.20"}}},
+	}
+	for i, update := range invalid {
+		if _, err := UpdateNetwork("update", update); err == nil {
+			t.Fatal("invalid update", i, "accepted")
+		}
+	}
+
+	ranges := []IPRange{{"10.76.0.30", "10.76.0.40"}}
+	if _, err := UpdateNetwork("update", &NetworkUpdate{Ranges: &ranges}); err == nil {
+		t.Fatal("ranges moved away from an address in use")
+	} else if conflict, ok := err.(*RangeConflictError); !ok || len(conflict.IPs) != 1 || conflict.IPs[0] != ips[0].String() {
+		t.Fatal("expected a conflict on", ips[0], err)
+	}
+
+	// the static address outside of the old ranges doesn't matter
+	ranges = []IPRange{{ips[0].String(), "10.76.0.40"}}
+	if network, err = UpdateNetwork("update", &NetworkUpdate{Ranges: &ranges}); err != nil || network.Ranges[0].End != "10.76.0.40" {
+		t.Fatal("ranges update failed", network, err)
+	}
+	if network.MTU != 9000 {
+		t.Fatal("earlier update lost", network)
+	}
+
+	if _, err := UpdateNetwork("missing", &NetworkUpdate{MTU: &mtu}); err == nil {
+		t.Fatal("missing network updated")
+	}
+}
+
+func TestDeleteNetworkInUse(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.81.0.0/24")
+	network, err := createNetworkRecord("inuse", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+	ips, _ := requestIPs(network, subnets, "")
+	putLeases(network, subnets, ips, &Connection{ContainerID: "c1"})
+
+	err = deleteNetworkRecord("inuse", false)
+	if inUse, ok := err.(*NetworkInUseError); !ok || len(inUse.Leases) != 1 || inUse.Leases[0].ContainerID != "c1" {
+		t.Fatal("expected the network in use by c1", err)
+	}
+	if _, err := GetNetwork("inuse"); err != nil {
+		t.Fatal("network in use deleted")
+	}
+
+	if err := deleteNetworkRecord("inuse", true); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, _ := netAgent.List(leaseStore); len(pairs) != 0 {
+		t.Fatal("leases left", pairs)
+	}
+
+	// in use is told by the leases alone, an address without lease doesn't
+	// keep the network
+	network, err = createNetworkRecord("unleased", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ = network.subnets()
+	if _, err := requestIPs(network, subnets, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteNetworkRecord("unleased", false); err != nil {
+		t.Fatal("network without leases must be deleted without force", err)
+	}
+	if pairs, _ := netAgent.List(ipStore); len(pairs) != 0 {
+		t.Fatal("ip blocks left", pairs)
+	}
+	if problems := audit(netAgent.GetStore()); len(problems) != 0 {
+		t.Fatal("audit problems", problems)
+	}
+}
@@ -236,6 +236,50 @@ func portUuidForName(portName string) string {
 	return ""
 }
 
+// the uuids of a reference column, a set or a single uuid
+func rowUuids(value interface{}) []string {
+	switch v := value.(type) {
+	case libovsdb.UUID:
+		return []string{v.GoUuid}
+	case libovsdb.OvsSet:
+		var uuids []string
+		for _, elem := range v.GoSet {
+			if uuid, ok := elem.(libovsdb.UUID); ok {
+				uuids = append(uuids, uuid.GoUuid)
+			}
+		}
+		return uuids
+	}
+	return nil
+}
+
+// names of the internal ports of bridge but its own: network gateways and
+// container ports
+func internalPorts(bridgeName string) []string {
+	var names []string
+	for _, bridge := range cache["Bridge"] {
+		if bridge.Fields["name"] != bridgeName {
+			continue
+		}
+
+		for _, portUuid := range rowUuids(bridge.Fields["ports"]) {
+			port, ok := cache["Port"][portUuid]
+			name, _ := port.Fields["name"].(string)
+			if !ok || name == bridgeName {
+				continue
+			}
+
+			for _, intfUuid := range rowUuids(port.Fields["interfaces"]) {
+				if cache["Interface"][intfUuid].Fields["type"] == "internal" {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	return names
+}
+
 func portExists(ovsClient *libovsdb.OvsdbClient, portName string) (bool, error) {
 	condition := libovsdb.NewCondition("name", "==", portName)
 	selectOp := libovsdb.Operation{
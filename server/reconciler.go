@@ -0,0 +1,422 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// full resync of all networks, a safety net for missed watch events
+const resyncInterval = 30 * time.Second
+
+// how long to wait for a new ovs internal port to show up
+const ifaceTimeout = 3 * time.Second
+
+// reconcile state of one network on this node
+type NetworkStatus struct {
+	Network        string    `json:"network"`
+	Revision       int       `json:"revision"` // ModifyIndex of the network record last applied
+	LastReconciled time.Time `json:"lastReconciled"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// networkReconciler keeps the gateway interfaces and iptables rules of this
+// node in line with networkStore. It runs on store watch events and does a
+// full resync every resyncInterval
+type networkReconciler struct {
+	d       *Daemon
+	trigger chan struct{}
+
+	sync.RWMutex
+	status map[string]*NetworkStatus
+
+	// the networks last applied, to clean up after them once deleted.
+	// Only the reconcile loop uses it
+	applied map[string]*Network
+	// whether the gateways and rules of networks deleted while we were
+	// down are gone
+	swept bool
+}
+
+func newNetworkReconciler(d *Daemon) *networkReconciler {
+	return &networkReconciler{
+		d:       d,
+		trigger: make(chan struct{}, 1),
+		status:  make(map[string]*NetworkStatus),
+		applied: make(map[string]*Network),
+	}
+}
+
+// ask for a reconcile pass, never blocks, several triggers coalesce into one pass
+func (r *networkReconciler) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *networkReconciler) run() {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	full := true
+	for {
+		r.reconcile(full)
+
+		select {
+		case <-r.trigger:
+			full = false
+		case <-ticker.C:
+			full = true
+		}
+	}
+}
+
+// status of every network, sorted by name
+func (r *networkReconciler) Status() []NetworkStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	statuses := make([]NetworkStatus, 0, len(r.status))
+	for _, st := range r.status {
+		statuses = append(statuses, *st)
+	}
+	sort.Sort(byNetwork(statuses))
+	return statuses
+}
+
+func (r *networkReconciler) setStatus(name string, revision int, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	st := &NetworkStatus{Network: name, Revision: revision, LastReconciled: time.Now()}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	r.status[name] = st
+}
+
+func (r *networkReconciler) deleteStatus(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.status, name)
+}
+
+// revision applied last for the network, -1 if it failed or is unknown
+func (r *networkReconciler) appliedRevision(name string) int {
+	r.RLock()
+	defer r.RUnlock()
+
+	st, ok := r.status[name]
+	if !ok || st.Error != "" {
+		return -1
+	}
+	return st.Revision
+}
+
+// one pass over networkStore, only networks whose record changed are touched
+// unless full is set
+func (r *networkReconciler) reconcile(full bool) {
+	pairs, ok := netAgent.List(networkStore)
+	if !ok {
+		log.Println("Error listing", networkStore, "in reconcile")
+		return
+	}
+
+	networks := make(map[string]*Network, len(pairs))
+	revisions := make(map[string]int, len(pairs))
+	// networks whose record can't be read, left as they are, not deleted
+	keep := make(map[string]bool)
+
+	for _, pair := range pairs {
+		network := &Network{}
+		if err := json.Unmarshal(pair.Value, network); err != nil {
+			log.Println("Bad network record", pair.Key, err)
+			keep[pair.Key] = true
+			continue
+		}
+		networks[network.Name] = network
+		revisions[network.Name] = pair.ModifyIndex
+	}
+
+	// a network appeared or vanished, the isolation rules of every
+	// other network need to know about it
+	setChanged := false
+	for name := range networks {
+		if _, ok := r.d.Gateways[name]; !ok {
+			setChanged = true
+		}
+	}
+	for name := range r.d.Gateways {
+		if _, ok := networks[name]; !ok && !keep[name] {
+			setChanged = true
+		}
+	}
+
+	for name, network := range networks {
+		if !full && !setChanged && r.appliedRevision(name) == revisions[name] {
+			continue
+		}
+
+		_, exist := r.d.Gateways[name]
+		err := reconcileNetwork(network)
+		if err != nil {
+			log.Println("reconcile network", name, "error:", err)
+		} else if !exist {
+			log.Println(name, "network created")
+		}
+
+		r.d.Gateways[name] = struct{}{}
+		r.applied[name] = network
+		r.setStatus(name, revisions[name], err)
+	}
+
+	// networks deleted while this node was down were never applied, the
+	// first full pass finds their gateway ports and rules by name
+	if full && !r.swept && ovsClient != nil {
+		for _, name := range staleGateways(internalPorts(bridgeName), networks, keep) {
+			r.d.Gateways[name] = struct{}{}
+		}
+
+		known := make(map[string]*Network, len(networks)+len(keep))
+		for name, network := range networks {
+			known[name] = network
+		}
+		for name := range keep {
+			known[name] = &Network{Name: name}
+		}
+		removeStaleIPTables(known)
+		r.swept = true
+	}
+
+	//delete unused interface
+	for name := range r.d.Gateways {
+		if _, ok := networks[name]; ok || keep[name] {
+			continue
+		}
+
+		if err := removeNetwork(name); err != nil {
+			log.Println("remove network", name, "error:", err)
+			continue
+		}
+
+		detachNetwork(r.d, name)
+		if network, ok := r.applied[name]; ok {
+			removeIPTables(network, networks)
+		}
+
+		delete(r.applied, name)
+		delete(r.d.Gateways, name)
+		r.deleteStatus(name)
+		log.Println("delete unused interface", name)
+	}
+}
+
+// create or update handler, idempotent, makes sure the gateway interface of
+// the network exists with the right addresses and MTU and its iptables rules
+// are set
+func reconcileNetwork(network *Network) error {
+	if ovsClient == nil {
+		return errors.New("OVS not connected")
+	}
+
+	subnets, err := network.subnets()
+	if err != nil {
+		return err
+	}
+
+	if _, err := net.InterfaceByName(network.Name); err != nil {
+		// network not exsit create the interface from net store
+		if err = AddInternalPort(ovsClient, bridgeName, network.Name, network.VNI); err != nil {
+			return err
+		}
+	}
+
+	if err = util.WaitForInterface(network.Name, ifaceTimeout); err != nil {
+		return err
+	}
+
+	if err = util.SetMtu(network.Name, network.linkMTU()); err != nil {
+		return err
+	}
+
+	for _, s := range subnets {
+		gatewayCIDR := &net.IPNet{IP: s.gateway, Mask: s.subnet.Mask}
+
+		has, err := util.HasInterfaceIp(network.Name, gatewayCIDR.String())
+		if err != nil {
+			return err
+		}
+		if !has {
+			if err = util.SetInterfaceIp(network.Name, gatewayCIDR.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = util.InterfaceUp(network.Name); err != nil {
+		return err
+	}
+
+	for _, s := range subnets {
+		if err = setupIPTables(network.Name, s.subnet.String(), network.masquerade()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the gateway ports among the internal ports of the bridge whose network
+// is gone from the store
+func staleGateways(ports []string, networks map[string]*Network, keep map[string]bool) []string {
+	var stale []string
+	for _, name := range ports {
+		if _, ok := networks[name]; ok || keep[name] || isContainerPort(name) {
+			continue
+		}
+		stale = append(stale, name)
+	}
+	return stale
+}
+
+// delete handler, drop the gateway port of a network gone from the store
+func removeNetwork(name string) error {
+	if ovsClient == nil {
+		return errors.New("OVS not connected")
+	}
+	deletePort(ovsClient, bridgeName, name)
+	return nil
+}
+
+// disconnect the containers of this node from a deleted network, their
+// addresses went with the network record
+func detachNetwork(d *Daemon, name string) {
+	var cons []*Connection
+	d.connections.RLock()
+	for _, con := range d.connections.rm {
+		if con.(*Connection).Network == name {
+			cons = append(cons, con.(*Connection))
+		}
+	}
+	d.connections.RUnlock()
+
+	for _, con := range cons {
+		log.Println("detaching", con.ContainerID, "from deleted network", name)
+		disconnect(d, con)
+	}
+}
+
+// drop the NAT rules of a deleted network and the rules isolating it from
+// the others
+func removeIPTables(network *Network, others map[string]*Network) {
+	subnets, err := network.subnets()
+	if err != nil {
+		return
+	}
+
+	for _, s := range subnets {
+		cmd := "iptables"
+		if isIPv6(s.subnet) {
+			cmd = "ip6tables"
+		}
+
+		rules := [][]string{{"-t", "nat", "-A", "POSTROUTING", "-s", s.subnet.String(), "!", "-o", network.Name, "-j", "MASQUERADE"}}
+		for other := range others {
+			rules = append(rules,
+				[]string{"-A", "FORWARD", "-i", network.Name, "-o", other, "-j", "DROP"},
+				[]string{"-A", "FORWARD", "-i", other, "-o", network.Name, "-j", "DROP"})
+		}
+
+		for _, rule := range rules {
+			if _, err := removeRule(cmd, rule...); err != nil {
+				log.Println("Error removing iptables rule of", network.Name, err)
+			}
+		}
+	}
+}
+
+// drop the iptables rules of networks gone from the store that this node
+// never saw go
+func removeStaleIPTables(networks map[string]*Network) {
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		forward, err := installRule(cmd, "-S", "FORWARD")
+		if err != nil {
+			log.Println("Error listing", cmd, "rules", err)
+			continue
+		}
+		nat, err := installRule(cmd, "-t", "nat", "-S", "POSTROUTING")
+		if err != nil {
+			log.Println("Error listing", cmd, "nat rules", err)
+			continue
+		}
+
+		for _, rule := range staleRules(string(forward), string(nat), networks) {
+			log.Println("removing", cmd, "rule of a deleted network:", strings.Join(rule, " "))
+			if _, err := removeRule(cmd, rule...); err != nil {
+				log.Println("Error removing stale", cmd, "rule", err)
+			}
+		}
+	}
+}
+
+// the rules of deleted networks in the iptables -S output of FORWARD and
+// nat POSTROUTING. Every network drops the traffic from and to every other
+// one, so an interface in such a rule with a network of the store that is
+// no network itself is a deleted network. Its isolation rules and its
+// masquerade rule are returned, ready for removeRule
+func staleRules(forward string, nat string, networks map[string]*Network) [][]string {
+	isolation := func(fields []string) bool {
+		return len(fields) == 8 && fields[0] == "-A" && fields[1] == "FORWARD" && fields[2] == "-i" &&
+			fields[4] == "-o" && fields[6] == "-j" && fields[7] == "DROP"
+	}
+
+	deleted := make(map[string]bool)
+	var drops [][]string
+	for _, line := range strings.Split(forward, "\n") {
+		fields := strings.Fields(line)
+		if !isolation(fields) {
+			continue
+		}
+		drops = append(drops, fields)
+
+		in, out := fields[3], fields[5]
+		if _, ok := networks[in]; ok && networks[out] == nil {
+			deleted[out] = true
+		}
+		if _, ok := networks[out]; ok && networks[in] == nil {
+			deleted[in] = true
+		}
+	}
+
+	var rules [][]string
+	for _, fields := range drops {
+		in, out := fields[3], fields[5]
+		if (deleted[in] || deleted[out]) && (deleted[in] || networks[in] != nil) && (deleted[out] || networks[out] != nil) {
+			rules = append(rules, fields)
+		}
+	}
+
+	for _, line := range strings.Split(nat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 9 && fields[0] == "-A" && fields[1] == "POSTROUTING" && fields[2] == "-s" &&
+			fields[4] == "!" && fields[5] == "-o" && deleted[fields[6]] && fields[8] == "MASQUERADE" {
+			rules = append(rules, append([]string{"-t", "nat"}, fields...))
+		}
+	}
+	return rules
+}
+
+type byNetwork []NetworkStatus
+
+func (s byNetwork) Len() int           { return len(s) }
+func (s byNetwork) Less(i, j int) bool { return s[i].Network < s[j].Network }
+func (s byNetwork) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/socketplane/libovsdb"
+)
+
+func TestReconcileStatus(t *testing.T) {
+	if ovsClient != nil {
+		t.Skip("Skipping TestReconcileStatus because it would touch ovs-br0.")
+	}
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	d := NewDaemon()
+
+	network := &Network{Name: "foo", Subnet: "10.10.10.0/24", Gateway: "10.10.10.1", VNI: 1}
+	data, _ := json.Marshal(network)
+	netAgent.Put(networkStore, "foo", data, nil)
+	_, revision, _ := netAgent.Get(networkStore, "foo")
+
+	d.reconciler.reconcile(true)
+
+	statuses := d.reconciler.Status()
+	if len(statuses) != 1 || statuses[0].Network != "foo" || statuses[0].Revision != revision {
+		t.Fatal("status is wrong", statuses)
+	}
+
+	// without ovs the create handler fails and the failure is kept
+	if statuses[0].Error == "" || d.reconciler.appliedRevision("foo") != -1 {
+		t.Fatal("failed reconcile must be reported", statuses)
+	}
+
+	request, _ := http.NewRequest("GET", "/networks/status", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+
+	var got []NetworkStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &got); err != nil || len(got) != 1 {
+		t.Fatal("body is not correct", response.Body)
+	}
+}
+
+func TestReconcileTriggerCoalesce(t *testing.T) {
+	r := newNetworkReconciler(NewDaemon())
+
+	// never blocks even when nobody is reconciling
+	r.Trigger()
+	r.Trigger()
+
+	if len(r.trigger) != 1 {
+		t.Fatal("triggers must coalesce into one pending pass")
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	networks := map[string]*Network{"cxy": {Name: "cxy"}, "web": {Name: "web"}}
+
+	forward := `-P FORWARD ACCEPT
+-A FORWARD -i cxy -o web -j DROP
+-A FORWARD -i web -o cxy -j DROP
+-A FORWARD -i cxy -o gone -j DROP
+-A FORWARD -i gone -o web -j DROP
+-A FORWARD -i gone -o gone2 -j DROP
+-A FORWARD -i gone2 -o cxy -j DROP
+-A FORWARD -i docker0 -o eth0 -j DROP
+-A FORWARD -i docker0 -o docker0 -j ACCEPT
+`
+	nat := `-P POSTROUTING ACCEPT
+-A POSTROUTING -s 10.1.0.0/16 ! -o cxy -j MASQUERADE
+-A POSTROUTING -s 10.9.0.0/24 ! -o gone -j MASQUERADE
+-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+`
+
+	expected := [][]string{
+		{"-A", "FORWARD", "-i", "cxy", "-o", "gone", "-j", "DROP"},
+		{"-A", "FORWARD", "-i", "gone", "-o", "web", "-j", "DROP"},
+		{"-A", "FORWARD", "-i", "gone", "-o", "gone2", "-j", "DROP"},
+		{"-A", "FORWARD", "-i", "gone2", "-o", "cxy", "-j", "DROP"},
+		{"-t", "nat", "-A", "POSTROUTING", "-s", "10.9.0.0/24", "!", "-o", "gone", "-j", "MASQUERADE"},
+	}
+	if rules := staleRules(forward, nat, networks); !reflect.DeepEqual(rules, expected) {
+		t.Fatal("expected", expected, "got", rules)
+	}
+}
+
+// gateway ports of networks deleted while the node was down are found in
+// the ovsdb cache, container ports and unreadable networks are left alone
+func TestStaleGateways(t *testing.T) {
+	defer func(c map[string]map[string]libovsdb.Row) { cache = c }(cache)
+
+	row := func(fields map[string]interface{}) libovsdb.Row { return libovsdb.Row{Fields: fields} }
+	set := func(uuids ...string) libovsdb.OvsSet {
+		s := libovsdb.OvsSet{}
+		for _, uuid := range uuids {
+			s.GoSet = append(s.GoSet, libovsdb.UUID{GoUuid: uuid})
+		}
+		return s
+	}
+
+	cache = map[string]map[string]libovsdb.Row{
+		"Bridge": {
+			"b1": row(map[string]interface{}{"name": bridgeName, "ports": set("p1", "p2", "p3", "p4", "p5", "p6")}),
+			"b2": row(map[string]interface{}{"name": "other", "ports": set("p7")}),
+		},
+		"Port": {
+			"p1": row(map[string]interface{}{"name": bridgeName, "interfaces": libovsdb.UUID{GoUuid: "i1"}}),
+			"p2": row(map[string]interface{}{"name": "live", "interfaces": libovsdb.UUID{GoUuid: "i2"}}),
+			"p3": row(map[string]interface{}{"name": "gone", "interfaces": libovsdb.UUID{GoUuid: "i3"}}),
+			"p4": row(map[string]interface{}{"name": "ovs1a2b3c4", "interfaces": libovsdb.UUID{GoUuid: "i4"}}),
+			"p5": row(map[string]interface{}{"name": "vxlan-10.0.0.2", "interfaces": libovsdb.UUID{GoUuid: "i5"}}),
+			"p6": row(map[string]interface{}{"name": "corrupt", "interfaces": libovsdb.UUID{GoUuid: "i6"}}),
+			"p7": row(map[string]interface{}{"name": "elsewhere", "interfaces": libovsdb.UUID{GoUuid: "i7"}}),
+		},
+		"Interface": {
+			"i1": row(map[string]interface{}{"name": bridgeName, "type": "internal"}),
+			"i2": row(map[string]interface{}{"name": "live", "type": "internal"}),
+			"i3": row(map[string]interface{}{"name": "gone", "type": "internal"}),
+			"i4": row(map[string]interface{}{"name": "ovs1a2b3c4", "type": "internal"}),
+			"i5": row(map[string]interface{}{"name": "vxlan-10.0.0.2", "type": "vxlan"}),
+			"i6": row(map[string]interface{}{"name": "corrupt", "type": "internal"}),
+			"i7": row(map[string]interface{}{"name": "elsewhere", "type": "internal"}),
+		},
+	}
+
+	networks := map[string]*Network{"live": {Name: "live"}}
+	keep := map[string]bool{"corrupt": true}
+
+	stale := staleGateways(internalPorts(bridgeName), networks, keep)
+	if !reflect.DeepEqual(stale, []string{"gone"}) {
+		t.Fatal("wrong stale gateways", stale)
+	}
+}
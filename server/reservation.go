@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// IP reservations
+// a reservation binds addresses of a network to a stable identity, like a
+// container name or a pod namespace/name. The addresses stay marked used
+// while the reservation exists and every container attached with that
+// identity gets them, on whatever host, so a container keeps its IP when it
+// moves. They are released when the reservation is deleted
+
+const reservationStore = "reservationStore"
+
+var errReservationExists = errors.New("reservation exists")
+
+type Reservation struct {
+	Identity string `json:"identity"`
+	Network  string `json:"network"`
+	// one address per family of the network
+	IPs     []string  `json:"ips"`
+	Created time.Time `json:"created"`
+}
+
+// key is the vlan/identity, identities may hold slashes
+func reservationKey(VNI string, identity string) string {
+	return VNI + "/" + identity
+}
+
+// the identity reservations of con are looked up with
+func (con *Connection) identity() string {
+	if con.Identity != "" {
+		return con.Identity
+	}
+	// docker names start with a slash
+	return strings.TrimPrefix(con.ContainerName, "/")
+}
+
+// the reservation of identity in network, nil if there is none
+func GetReservation(network *Network, identity string) (*Reservation, error) {
+	data, _, ok := netAgent.Get(reservationStore, reservationKey(fmt.Sprint(network.VNI), identity))
+	if !ok {
+		return nil, nil
+	}
+
+	reservation := &Reservation{}
+	if err := json.Unmarshal(data, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// the reservations of network sorted by identity
+func GetReservations(network *Network) ([]Reservation, error) {
+	pairs, ok := netAgent.List(reservationStore)
+	if !ok {
+		return nil, errors.New("Error listing " + reservationStore)
+	}
+
+	prefix := fmt.Sprint(network.VNI) + "/"
+	reservations := make([]Reservation, 0)
+
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, prefix) {
+			continue
+		}
+
+		reservation := Reservation{}
+		if err := json.Unmarshal(pair.Value, &reservation); err != nil {
+			log.Println("bad reservation", pair.Key, err)
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	sort.Sort(byIdentity(reservations))
+	return reservations, nil
+}
+
+// reserve addresses of network for identity, requestIp picks the address of
+// its family, the others come from the pools. An address in use can only be
+// reserved for the identity of the container holding it
+func CreateReservation(network *Network, identity string, requestIp string) (*Reservation, error) {
+	if identity == "" {
+		return nil, errors.New("identity is empty")
+	}
+
+	VNI := fmt.Sprint(network.VNI)
+	key := reservationKey(VNI, identity)
+	if _, _, ok := netAgent.Get(reservationStore, key); ok {
+		return nil, errReservationExists
+	}
+
+	subnets, err := network.subnets()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(requestIp); ip != nil {
+		if lease := getLease(VNI, ip); lease != nil {
+			if lease.Identity != identity {
+				return nil, &StaticIPError{IP: requestIp, Reason: "is in use by " + lease.ContainerID, Conflict: true}
+			}
+			// the container of identity keeps the addresses it holds
+			ips = leasedIPs(VNI, lease.ContainerID)
+		}
+	}
+
+	if ips == nil {
+		if ips, err = requestIPs(network, subnets, requestIp); err != nil {
+			return nil, err
+		}
+	}
+
+	reservation := &Reservation{
+		Identity: identity,
+		Network:  network.Name,
+		Created:  time.Now(),
+	}
+	for _, ip := range ips {
+		reservation.IPs = append(reservation.IPs, ip.String())
+	}
+
+	data, err := json.Marshal(reservation)
+	if err == nil {
+		switch netAgent.CAS(reservationStore, key, data, 0) {
+		case netAgent.OK:
+			return reservation, nil
+		case netAgent.OUTDATED:
+			err = errReservationExists
+		default:
+			err = errors.New("Error writing reservation of " + identity)
+		}
+	}
+
+	// the addresses of a container already holding them stay used
+	for i, s := range ipSubnets(subnets, ips) {
+		if getLease(VNI, ips[i]) == nil {
+			ReleaseIP(ips[i], *s.subnet, VNI)
+		}
+	}
+	return nil, err
+}
+
+// drop the reservation of identity and release its addresses in one
+// transaction, addresses a container still holds are released when it is
+// disconnected
+func DeleteReservation(network *Network, identity string) error {
+	VNI := fmt.Sprint(network.VNI)
+	key := reservationKey(VNI, identity)
+
+	for {
+		data, index, ok := netAgent.Get(reservationStore, key)
+		if !ok {
+			return errors.New("Reservation " + identity + " not exist")
+		}
+
+		reservation := &Reservation{}
+		if err := json.Unmarshal(data, reservation); err != nil {
+			return err
+		}
+
+		subnets, err := network.subnets()
+		if err != nil {
+			return err
+		}
+
+		ops := []netAgent.TxnOp{{Store: reservationStore, Key: key, Index: index, Delete: true}}
+		for _, addr := range reservation.IPs {
+			ip := net.ParseIP(addr)
+			if ip == nil || getLease(VNI, ip) != nil {
+				continue
+			}
+
+			for _, s := range subnets {
+				pos := ipPos(ip, *s.subnet)
+				if !s.subnet.Contains(ip) || pos >= uint32(ipBitmapSize(*s.subnet)*8) {
+					continue
+				}
+
+				migrateIPBitmap(VNI, *s.subnet)
+				block := ipBlockKey(VNI, *s.subnet, pos/ipBlockBits)
+				if bits, blockIndex, ok := netAgent.Get(ipStore, block); ok {
+					util.Clear(bits, uint(pos%ipBlockBits))
+					ops = append(ops, netAgent.TxnOp{Store: ipStore, Key: block, Value: bits, Index: blockIndex})
+				}
+			}
+		}
+
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			return nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return errors.New("Error deleting reservation of " + identity)
+		}
+	}
+}
+
+// whether ip of network VNI belongs to a reservation
+func ipReserved(VNI string, ip net.IP) bool {
+	pairs, ok := netAgent.List(reservationStore)
+	if !ok {
+		// keep the address rather than hand it out twice
+		return true
+	}
+
+	prefix := VNI + "/"
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, prefix) {
+			continue
+		}
+
+		reservation := Reservation{}
+		if err := json.Unmarshal(pair.Value, &reservation); err != nil {
+			continue
+		}
+		for _, addr := range reservation.IPs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the addresses of a new connection of identity, the reserved ones if
+// identity has a reservation. A reserved address may still be held by an
+// older container of identity, putLeases refuses it then
+func connectionIPs(network *Network, subnets []networkSubnet, identity string, requestIp string) ([]net.IP, error) {
+	var reservation *Reservation
+	if identity != "" {
+		var err error
+		if reservation, err = GetReservation(network, identity); err != nil {
+			return nil, err
+		}
+	}
+	if reservation == nil {
+		return requestIPs(network, subnets, requestIp)
+	}
+
+	families := subnetFamilies(subnets)
+	ips := make([]net.IP, 0, len(families))
+	for _, family := range families {
+		var ip net.IP
+		for _, s := range family {
+			for _, addr := range reservation.IPs {
+				if a := net.ParseIP(addr); a != nil && s.subnet.Contains(a) {
+					ip = a
+				}
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("reservation of %s has no address in %s", identity, family[0].subnet.String())
+		}
+		ips = append(ips, ip)
+	}
+
+	if requestIp != "" {
+		found := false
+		for _, ip := range ips {
+			found = found || ip.Equal(net.ParseIP(requestIp))
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has reserved %s, not %s", identity, strings.Join(reservation.IPs, ","), requestIp)
+		}
+	}
+
+	log.Println("using the addresses reserved for", identity, reservation.IPs)
+	return ips, nil
+}
+
+type byIdentity []Reservation
+
+func (s byIdentity) Len() int           { return len(s) }
+func (s byIdentity) Less(i, j int) bool { return s[i].Identity < s[j].Identity }
+func (s byIdentity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+func TestReservations(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.97.0.0/24")
+	network, err := createNetworkRecord("reserve", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	VNI := fmt.Sprint(network.VNI)
+	base := ipKey(VNI, *subnet)
+	subnets, _ := network.subnets()
+
+	reservation, err := CreateReservation(network, "default/web", "")
+	if err != nil || len(reservation.IPs) != 1 {
+		t.Fatal("reservation failed", reservation, err)
+	}
+	reserved := net.ParseIP(reservation.IPs[0])
+
+	if _, err := CreateReservation(network, "default/web", ""); err != errReservationExists {
+		t.Fatal("second reservation of an identity must fail", err)
+	}
+
+	// the container gets the reserved address on every attach
+	con := &Connection{ContainerID: "c1", ContainerName: "/web-1", Identity: "default/web"}
+	for i := 0; i < 2; i++ {
+		ips, err := connectionIPs(network, subnets, con.identity(), "")
+		if err != nil || !ips[0].Equal(reserved) {
+			t.Fatal("reserved address expected", ips, err)
+		}
+	}
+	if _, err := connectionIPs(network, subnets, con.identity(), "10.97.0.200"); err == nil {
+		t.Fatal("static request of another address must fail")
+	}
+	putLeases(network, subnets, []net.IP{reserved}, con)
+
+	// somebody else's address can't be reserved
+	if _, err := CreateReservation(network, "default/db", reserved.String()); err == nil {
+		t.Fatal("address held by another identity reserved")
+	}
+
+	// the gc drops the lease and keeps the address
+	ageLease(t, VNI, reserved)
+	if gcLeases(func(*Lease) bool { return true }) != 1 || getLease(VNI, reserved) != nil {
+		t.Fatal("lease not collected")
+	}
+	if !ipUsed(netAgent.GetStore(), base, ipPos(reserved, *subnet)) {
+		t.Fatal("reserved address released by the gc")
+	}
+
+	// attached elsewhere, the old node must not drop the new lease
+	putLeases(network, subnets, []net.IP{reserved}, &Connection{ContainerID: "c2", Identity: "default/web"})
+	deleteLease(VNI, reserved, "c1")
+	if lease := getLease(VNI, reserved); lease == nil || lease.ContainerID != "c2" {
+		t.Fatal("lease of the moved container dropped", lease)
+	}
+
+	// deleted while in use, the address stays with the container
+	if err := DeleteReservation(network, "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	if !ipUsed(netAgent.GetStore(), base, ipPos(reserved, *subnet)) || ipReserved(VNI, reserved) {
+		t.Fatal("address in use released")
+	}
+
+	// not in use, the address is released with the reservation
+	reservation, err = CreateReservation(network, "web2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteReservation(network, "web2"); err != nil {
+		t.Fatal(err)
+	}
+	if ipUsed(netAgent.GetStore(), base, ipPos(net.ParseIP(reservation.IPs[0]), *subnet)) {
+		t.Fatal("address of a deleted reservation still used")
+	}
+}
+
+// two containers sharing an identity, like containers with the same name on
+// two hosts, never hold the reserved address at the same time
+func TestReservationSharedIdentity(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	running := map[string]bool{"first": true}
+	defer stubContainers(running)()
+
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/24")
+	network, err := createNetworkRecord("shared", subnet, nil, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	VNI := fmt.Sprint(network.VNI)
+	subnets, _ := network.subnets()
+
+	reservation, err := CreateReservation(network, "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := net.ParseIP(reservation.IPs[0])
+
+	first := &Connection{ContainerID: "first", ContainerName: "/web"}
+	second := &Connection{ContainerID: "second", ContainerName: "/web"}
+
+	ips, err := connectionIPs(network, subnets, first.identity(), "")
+	if err != nil || putLeases(network, subnets, ips, first) != nil {
+		t.Fatal("first container did not get the reserved address", ips, err)
+	}
+
+	ips, err = connectionIPs(network, subnets, second.identity(), "")
+	if err != nil || !ips[0].Equal(reserved) {
+		t.Fatal("reserved address expected", ips, err)
+	}
+	err = putLeases(network, subnets, ips, second)
+	if staticErr, ok := err.(*StaticIPError); !ok || !staticErr.Conflict {
+		t.Fatal("second container must conflict while the first runs", err)
+	}
+	if lease := getLease(VNI, reserved); lease == nil || lease.ContainerID != "first" {
+		t.Fatal("lease of the live container replaced", lease)
+	}
+
+	// the first container of another node holds the address until its
+	// lease is collected
+	lease := getLease(VNI, reserved)
+	lease.Node = "elsewhere"
+	putLeaseRecord(t, VNI, lease)
+	delete(running, "first")
+	if err := putLeases(network, subnets, ips, second); err == nil {
+		t.Fatal("lease of another node replaced")
+	}
+
+	// gone from this node, the address moves on
+	lease.Node, _ = os.Hostname()
+	putLeaseRecord(t, VNI, lease)
+	if err := putLeases(network, subnets, ips, second); err != nil {
+		t.Fatal("lease of a gone container not replaced", err)
+	}
+	if lease := getLease(VNI, reserved); lease == nil || lease.ContainerID != "second" {
+		t.Fatal("reserved address not moved", lease)
+	}
+}
+
+// overwrite the lease of lease.IP
+func putLeaseRecord(t *testing.T, VNI string, lease *Lease) {
+	key := leaseKey(VNI, net.ParseIP(lease.IP))
+	_, index, _ := netAgent.Get(leaseStore, key)
+	data, _ := json.Marshal(lease)
+	if netAgent.CAS(leaseStore, key, data, index) != netAgent.OK {
+		t.Fatal("writing lease failed")
+	}
+}
+
+func TestReservationsApi(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.98.0.0/24")
+	if _, err := createNetworkRecord("reserveapi", subnet, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	router := createRouter(NewDaemon())
+
+	do := func(method, uri, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	body := `{"identity": "default/web", "ip": "10.98.0.50"}`
+	if response := do("POST", "/network/reserveapi/reservations", body); response.Code != http.StatusCreated {
+		t.Fatal("create failed", response.Code, response.Body)
+	}
+	if response := do("POST", "/network/reserveapi/reservations", body); response.Code != http.StatusConflict {
+		t.Fatal("duplicate must conflict", response.Code)
+	}
+	if response := do("POST", "/network/reserveapi/reservations", `{"ip": "10.98.0.51"}`); response.Code != http.StatusBadRequest {
+		t.Fatal("missing identity accepted", response.Code)
+	}
+
+	response := do("GET", "/network/reserveapi/reservations", "")
+	var reservations []Reservation
+	if err := json.NewDecoder(response.Body).Decode(&reservations); err != nil || len(reservations) != 1 || reservations[0].IPs[0] != "10.98.0.50" {
+		t.Fatal("wrong reservations", reservations, err)
+	}
+
+	if response := do("DELETE", "/network/reserveapi/reservations/default/web", ""); response.Code != http.StatusOK {
+		t.Fatal("delete failed", response.Code, response.Body)
+	}
+	if response := do("DELETE", "/network/reserveapi/reservations/default/web", ""); response.Code != http.StatusNotFound {
+		t.Fatal("delete of a missing reservation", response.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+	"github.com/vishvananda/netlink"
+)
+
+// routes of the member nodes
+// every node publishes the destinations of its routing table so a new
+// subnet can be checked against the networks the hosts of the cluster
+// already reach, not only the node handling the request. The routes of the
+// gateway interfaces of our networks are left out, the networks are checked
+// on their own, and so are link-local, multicast and host routes every host
+// has
+
+const routeStore = "routeStore"
+
+// how often a node refreshes its routes
+const routeInterval = time.Minute
+
+// NodeRoutes is the routing table of a node, key is the node name
+type NodeRoutes struct {
+	Node    string    `json:"node"`
+	Routes  []string  `json:"routes"`
+	Updated time.Time `json:"updated"`
+}
+
+// the routes of this node, without those of network gateway interfaces
+func localRoutes() ([]string, error) {
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[string]bool, len(networks))
+	for _, network := range networks {
+		skip[network.Name] = true
+	}
+
+	dsts, err := util.RouteDsts(netlink.FAMILY_ALL, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]string, 0, len(dsts))
+	for _, dst := range dsts {
+		routes = append(routes, dst.String())
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// write the routes of node, only when they changed
+func putNodeRoutes(node string, routes []string) error {
+	for {
+		data, index, ok := netAgent.Get(routeStore, node)
+		if ok {
+			old := &NodeRoutes{}
+			if json.Unmarshal(data, old) == nil && reflect.DeepEqual(old.Routes, routes) {
+				return nil
+			}
+		}
+
+		data, _ = json.Marshal(&NodeRoutes{Node: node, Routes: routes, Updated: time.Now()})
+		switch netAgent.CAS(routeStore, node, data, index) {
+		case netAgent.OK:
+			return nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return errors.New("Error writing routes of " + node)
+		}
+	}
+}
+
+// the routes of every member node
+func GetNodeRoutes() ([]NodeRoutes, error) {
+	pairs, ok := netAgent.List(routeStore)
+	if !ok {
+		return nil, errors.New("Error listing " + routeStore)
+	}
+
+	nodeRoutes := make([]NodeRoutes, 0, len(pairs))
+	for _, pair := range pairs {
+		routes := NodeRoutes{}
+		if err := json.Unmarshal(pair.Value, &routes); err != nil {
+			log.Println("bad routes of node", pair.Key, err)
+			continue
+		}
+		nodeRoutes = append(nodeRoutes, routes)
+	}
+
+	sort.Sort(byNode(nodeRoutes))
+	return nodeRoutes, nil
+}
+
+func publishRoutes() {
+	node, _ := os.Hostname()
+
+	routes, err := localRoutes()
+	if err == nil {
+		err = putNodeRoutes(node, routes)
+	}
+	if err != nil {
+		log.Println("publish routes error:", err)
+	}
+}
+
+// every node keeps its routes up to date
+func routePublisher() {
+	ticker := time.NewTicker(routeInterval)
+	defer ticker.Stop()
+
+	for {
+		publishRoutes()
+		<-ticker.C
+	}
+}
+
+// drop the routes of nodes not in the cluster anymore, the leader does
+func gcNodeRoutes() {
+	nodes, err := netAgent.ClusterNodes()
+	if err != nil {
+		log.Println("gc routes error:", err)
+		return
+	}
+
+	members := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Status != netAgent.NODE_STATUS_LEFT {
+			members[node.Name] = true
+		}
+	}
+
+	pairs, ok := netAgent.List(routeStore)
+	if !ok {
+		return
+	}
+	for _, pair := range pairs {
+		if !members[pair.Key] {
+			if netAgent.DeleteCAS(routeStore, pair.Key, pair.ModifyIndex) == netAgent.OK {
+				log.Println("dropped routes of node", pair.Key)
+			}
+		}
+	}
+}
+
+type byNode []NodeRoutes
+
+func (s byNode) Len() int           { return len(s) }
+func (s byNode) Less(i, j int) bool { return s[i].Node < s[j].Node }
+func (s byNode) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+// consul service name for a container name, docker names start with a
+// slash and may hold characters not allowed in a DNS label
+func serviceName(con *Connection) string {
+	name := strings.ToLower(strings.TrimPrefix(con.ContainerName, "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	name = strings.Trim(name, "-")
+
+	if name == "" {
+		// unnamed container, fall back to the short container id
+		name = con.ContainerID
+		if len(name) > 12 {
+			name = name[:12]
+		}
+	}
+	return name
+}
+
+// the network is a plain tag so name lookups can be scoped with
+// network.name.service.consul, ip, ip6 and node are key=value tags
+func serviceTags(con *Connection) []string {
+	node, _ := os.Hostname()
+	tags := []string{con.Network, "ip=" + con.ConnectionDetail.Ip}
+	if con.ConnectionDetail.Ip6 != "" {
+		tags = append(tags, "ip6="+con.ConnectionDetail.Ip6)
+	}
+	return append(tags, "node="+node)
+}
+
+// a service has a single address, the IPv6 address of a dual stack
+// connection is a second instance of the service so name lookups get both
+// an A and an AAAA record
+func serviceID6(con *Connection) string {
+	return con.ContainerID + "-ip6"
+}
+
+// register the connection in the consul catalog, the container id is the
+// service id
+func registerConnService(d *Daemon, con *Connection) {
+	if d.storeBackend != consulBackend {
+		return
+	}
+
+	name := serviceName(con)
+	tags := serviceTags(con)
+	if err := netAgent.RegisterService(con.ContainerID, name, con.ConnectionDetail.Ip, tags); err != nil {
+		log.Println("register service", name, "for", con.ContainerID, "error:", err)
+	}
+
+	if con.ConnectionDetail.Ip6 != "" {
+		if err := netAgent.RegisterService(serviceID6(con), name, con.ConnectionDetail.Ip6, tags); err != nil {
+			log.Println("register IPv6 service", name, "for", con.ContainerID, "error:", err)
+		}
+	}
+}
+
+func deregisterConnService(d *Daemon, con *Connection) {
+	if d.storeBackend != consulBackend {
+		return
+	}
+
+	if err := netAgent.DeregisterService(con.ContainerID); err != nil {
+		log.Println("deregister service of", con.ContainerID, "error:", err)
+	}
+
+	if con.ConnectionDetail.Ip6 != "" {
+		if err := netAgent.DeregisterService(serviceID6(con)); err != nil {
+			log.Println("deregister IPv6 service of", con.ContainerID, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestServiceName(t *testing.T) {
+	cases := map[string]string{
+		"/web":      "web",
+		"/My_App.1": "my-app-1",
+		"db-master": "db-master",
+		"/__":       "0123456789ab",
+		"":          "0123456789ab",
+	}
+
+	for containerName, expected := range cases {
+		con := &Connection{ContainerID: "0123456789abcdef", ContainerName: containerName}
+		if name := serviceName(con); name != expected {
+			t.Errorf("service name of %q: expected %q, got %q", containerName, expected, name)
+		}
+	}
+}
+
+func TestConnServiceRegistration(t *testing.T) {
+	defer netAgent.SetConfig(netAgent.DefaultConfig())
+
+	var registered api.AgentServiceRegistration
+	var deregistered string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&registered)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			deregistered = strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	netAgent.SetConfig(&netAgent.Config{Address: strings.TrimPrefix(ts.URL, "http://")})
+
+	d := NewDaemon()
+	con := &Connection{
+		ContainerID:      "abc123",
+		ContainerName:    "/web",
+		Network:          "cxy",
+		ConnectionDetail: OvsConnection{Ip: "10.1.42.2"},
+	}
+
+	registerConnService(d, con)
+
+	if registered.ID != "abc123" || registered.Name != "web" || registered.Address != "10.1.42.2" {
+		t.Fatal("wrong service registration", registered)
+	}
+
+	if len(registered.Tags) != 3 || registered.Tags[0] != "cxy" || registered.Tags[1] != "ip=10.1.42.2" ||
+		!strings.HasPrefix(registered.Tags[2], "node=") {
+		t.Fatal("wrong service tags", registered.Tags)
+	}
+
+	deregisterConnService(d, con)
+
+	if deregistered != "abc123" {
+		t.Fatal("service not deregistered", deregistered)
+	}
+}
+
+func TestDualStackServiceRegistration(t *testing.T) {
+	defer netAgent.SetConfig(netAgent.DefaultConfig())
+
+	registered := make(map[string]api.AgentServiceRegistration)
+	var deregistered []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			var reg api.AgentServiceRegistration
+			json.NewDecoder(r.Body).Decode(&reg)
+			registered[reg.ID] = reg
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			deregistered = append(deregistered, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	netAgent.SetConfig(&netAgent.Config{Address: strings.TrimPrefix(ts.URL, "http://")})
+
+	d := NewDaemon()
+	con := &Connection{
+		ContainerID:      "abc123",
+		ContainerName:    "/web",
+		Network:          "cxy",
+		ConnectionDetail: OvsConnection{Ip: "10.1.42.2", Ip6: "fd00::2"},
+	}
+
+	registerConnService(d, con)
+
+	if len(registered) != 2 || registered["abc123"].Address != "10.1.42.2" ||
+		registered["abc123-ip6"].Address != "fd00::2" || registered["abc123-ip6"].Name != "web" {
+		t.Fatal("expected an IPv4 and an IPv6 instance of web, got", registered)
+	}
+
+	if tags := registered["abc123"].Tags; len(tags) != 4 || tags[2] != "ip6=fd00::2" {
+		t.Fatal("wrong service tags", tags)
+	}
+
+	deregisterConnService(d, con)
+
+	if len(deregistered) != 2 || deregistered[0] != "abc123" || deregistered[1] != "abc123-ip6" {
+		t.Fatal("both instances should be deregistered, got", deregistered)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+// version of the snapshot archive format, bump on incompatible changes
+const snapshotVersion = 1
+
+// the stores holding the cluster state
+var snapshotStores = []string{networkStore, vlanStore, ipStore, leaseStore, reservationStore}
+
+// Snapshot is a dump of every cxy-sdn key, values are base64 in JSON
+type Snapshot struct {
+	Version int                       `json:"version"`
+	Created time.Time                 `json:"created"`
+	Stores  map[string][]SnapshotPair `json:"stores"`
+}
+
+type SnapshotPair struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// take a snapshot of all snapshotStores
+func TakeSnapshot() (*Snapshot, error) {
+	snap := &Snapshot{
+		Version: snapshotVersion,
+		Created: time.Now().UTC(),
+		Stores:  make(map[string][]SnapshotPair),
+	}
+
+	for _, store := range snapshotStores {
+		pairs, ok := netAgent.List(store)
+		if !ok {
+			return nil, errors.New("Error listing " + store)
+		}
+
+		snapPairs := make([]SnapshotPair, 0, len(pairs))
+		for _, pair := range pairs {
+			snapPairs = append(snapPairs, SnapshotPair{pair.Key, pair.Value})
+		}
+		snap.Stores[store] = snapPairs
+	}
+	return snap, nil
+}
+
+// validate the snapshot on its own, nil if it is consistent
+func (snap *Snapshot) Validate() []string {
+	if snap.Version != snapshotVersion {
+		return []string{fmt.Sprintf("unsupported snapshot version %d, expected %d", snap.Version, snapshotVersion)}
+	}
+
+	var problems []string
+	for store := range snap.Stores {
+		if !isSnapshotStore(store) {
+			problems = append(problems, "unknown store "+store)
+		}
+	}
+
+	// load it in a scratch store and audit it like the live one
+	scratch := netAgent.NewMemoryStore()
+	for store, pairs := range snap.Stores {
+		for _, pair := range pairs {
+			if scratch.CAS(store, pair.Key, pair.Value, 0) != netAgent.OK {
+				problems = append(problems, "duplicate key "+store+"/"+pair.Key)
+			}
+		}
+	}
+
+	return append(problems, audit(scratch)...)
+}
+
+func isSnapshotStore(store string) bool {
+	for _, s := range snapshotStores {
+		if s == store {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreSnapshot replaces the content of snapshotStores with snap in one
+// transaction, keys missing from snap are deleted
+func RestoreSnapshot(snap *Snapshot) error {
+	for {
+		var ops []netAgent.TxnOp
+
+		for _, store := range snapshotStores {
+			pairs, ok := netAgent.List(store)
+			if !ok {
+				return errors.New("Error listing " + store)
+			}
+
+			existing := make(map[string]int, len(pairs))
+			for _, pair := range pairs {
+				existing[pair.Key] = pair.ModifyIndex
+			}
+
+			snapPairs := snap.Stores[store]
+			if store == ipStore {
+				// snapshots of older releases hold whole subnet bitmaps
+				snapPairs = splitIPPairs(snapPairs)
+			}
+
+			for _, pair := range snapPairs {
+				ops = append(ops, netAgent.TxnOp{Store: store, Key: pair.Key, Value: pair.Value, Index: existing[pair.Key]})
+				delete(existing, pair.Key)
+			}
+
+			for key, index := range existing {
+				ops = append(ops, netAgent.TxnOp{Store: store, Key: key, Index: index, Delete: true})
+			}
+		}
+
+		switch netAgent.Txn(ops...) {
+		case netAgent.OK:
+			return nil
+		case netAgent.OUTDATED:
+			continue
+		default:
+			return errors.New("Error restoring snapshot")
+		}
+	}
+}
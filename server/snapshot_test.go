@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	d := NewDaemon()
+
+	_, subnet, _ := net.ParseCIDR("10.50.0.0/24")
+	createNetworkRecord("snap1", subnet, nil, NetworkOptions{})
+	createNetworkRecord("snap2", subnet, nil, NetworkOptions{})
+	requestIP("1", *subnet)
+
+	request, _ := http.NewRequest("GET", "/admin/snapshot", nil)
+	response := httptest.NewRecorder()
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	archive := response.Body.Bytes()
+
+	// the cluster lost everything, and someone created another network
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	createNetworkRecord("other", subnet, nil, NetworkOptions{})
+
+	request, _ = http.NewRequest("POST", "/admin/restore", bytes.NewReader(archive))
+	response = httptest.NewRecorder()
+	createRouter(d).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v %s", "200", response.Code, response.Body.String())
+	}
+
+	networks, _ := GetNetworks()
+	if len(networks) != 2 || networks[0].Name != "snap1" || networks[1].Name != "snap2" {
+		t.Fatal("restored networks are wrong", networks)
+	}
+
+	if problems := auditStore(); len(problems) != 0 {
+		t.Fatal("restored store is inconsistent", problems)
+	}
+
+	// gateway and the requested IP are still taken
+	if addr := requestIP("1", *subnet).To4(); addr == nil || addr[3] != 3 {
+		t.Fatal("ip bitmap not restored", addr)
+	}
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	d := NewDaemon()
+
+	_, subnet, _ := net.ParseCIDR("10.51.0.0/24")
+	createNetworkRecord("snap1", subnet, nil, NetworkOptions{})
+
+	snap, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gateway no longer marked used
+	for i, pair := range snap.Stores[ipStore] {
+		util.Clear(pair.Value, 0)
+		snap.Stores[ipStore][i] = pair
+	}
+
+	restoreExpect := func(snap *Snapshot, code int) {
+		data, _ := json.Marshal(snap)
+		request, _ := http.NewRequest("POST", "/admin/restore", bytes.NewReader(data))
+		response := httptest.NewRecorder()
+		createRouter(d).ServeHTTP(response, request)
+
+		if response.Code != code {
+			t.Fatalf("Expected %v:\n\tReceived: %v %s", code, response.Code, response.Body.String())
+		}
+	}
+
+	restoreExpect(snap, http.StatusBadRequest)
+
+	snap, _ = TakeSnapshot()
+	snap.Version = snapshotVersion + 1
+	restoreExpect(snap, http.StatusBadRequest)
+
+	snap.Version = snapshotVersion
+	restoreExpect(snap, http.StatusOK)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// IPAM usage
+// counts are over the addresses of a network that may be handed out, so the
+// network, broadcast and excluded addresses are left out. Allocated
+// addresses are held by containers or are gateways, reserved ones are kept
+// for infrastructure or by reservations no container uses. Of the rest the
+// ones in the allocation ranges are free, the others out of range: only a
+// static request gets them
+
+// AllocatedIP is an address in use and who holds it
+type AllocatedIP struct {
+	IP string `json:"ip"`
+	// container, gateway, reservation or unknown for addresses allocated
+	// before leases existed
+	Kind        string `json:"kind"`
+	ContainerID string `json:"containerID,omitempty"`
+	Identity    string `json:"identity,omitempty"`
+	Node        string `json:"node,omitempty"`
+}
+
+type IPUsage struct {
+	Total     uint64 `json:"total"`
+	Allocated uint64 `json:"allocated"`
+	Reserved  uint64 `json:"reserved"`
+	Free      uint64 `json:"free"`
+	// unused addresses outside the allocation ranges
+	OutOfRange uint64 `json:"outOfRange"`
+	// percentage of the addresses that are not free, out of range ones
+	// left out
+	Utilization float64 `json:"utilization"`
+}
+
+type SubnetUsage struct {
+	Subnet string `json:"subnet"`
+	IPUsage
+	// longest run of free addresses
+	LargestFree     *IPRange `json:"largestFree,omitempty"`
+	LargestFreeSize uint64   `json:"largestFreeSize"`
+}
+
+type NetworkUsage struct {
+	Network string `json:"network"`
+	VNI     uint   `json:"vni"`
+	IPUsage
+	Subnets []SubnetUsage `json:"subnets"`
+	// only in the usage of a single network, by subnet and address
+	IPs []AllocatedIP `json:"ips,omitempty"`
+}
+
+type ClusterUsage struct {
+	IPUsage
+	Networks []NetworkUsage `json:"networks"`
+}
+
+func (u *IPUsage) add(o IPUsage) {
+	u.Total += o.Total
+	u.Allocated += o.Allocated
+	u.Reserved += o.Reserved
+	u.Free += o.Free
+	u.OutOfRange += o.OutOfRange
+	u.setUtilization()
+}
+
+func (u *IPUsage) setUtilization() {
+	u.Utilization = 0
+	if total := u.Total - u.OutOfRange; total != 0 {
+		u.Utilization = float64(total-u.Free) * 100 / float64(total)
+	}
+}
+
+// the used bits of the subnet with ipKey base in the ipStore pairs, blocks
+// or whole bitmap of an older release
+func usedBits(pairs []netAgent.KVPair, base string) func(pos uint32) bool {
+	blocks := make(map[uint32][]byte)
+	var legacy []byte
+
+	for _, pair := range pairs {
+		if key, block, ok := splitIPBlockKey(pair.Key); key == base {
+			if ok {
+				blocks[block] = pair.Value
+			} else {
+				legacy = pair.Value
+			}
+		}
+	}
+
+	return func(pos uint32) bool {
+		if bits, ok := blocks[pos/ipBlockBits]; ok {
+			return util.IsSet(bits, pos%ipBlockBits)
+		}
+		return legacy != nil && util.IsSet(legacy, pos)
+	}
+}
+
+// GetNetworkUsage counts the addresses of network, withIPs lists the
+// allocated ones with their holders
+func GetNetworkUsage(network *Network, withIPs bool) (*NetworkUsage, error) {
+	ipPairs, ok := netAgent.List(ipStore)
+	if !ok {
+		return nil, fmt.Errorf("Error listing %s", ipStore)
+	}
+	return networkUsage(network, ipPairs, withIPs)
+}
+
+func networkUsage(network *Network, ipPairs []netAgent.KVPair, withIPs bool) (*NetworkUsage, error) {
+	subnets, err := network.subnets()
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := GetLeases(network)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := GetReservations(network)
+	if err != nil {
+		return nil, err
+	}
+
+	VNI := fmt.Sprint(network.VNI)
+	usage := &NetworkUsage{
+		Network: network.Name,
+		VNI:     network.VNI,
+		Subnets: make([]SubnetUsage, 0, len(subnets)),
+	}
+
+	for _, s := range subnets {
+		pool, err := networkPool(network, *s.subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		// holders by position, addresses are only built for the positions
+		// reported
+		leased := make(map[uint32]Lease)
+		for _, lease := range leases {
+			if ip := net.ParseIP(lease.IP); ip != nil && s.subnet.Contains(ip) {
+				leased[ipPos(ip, *s.subnet)] = lease
+			}
+		}
+		reserved := make(map[uint32]string)
+		for _, reservation := range reservations {
+			for _, addr := range reservation.IPs {
+				if ip := net.ParseIP(addr); ip != nil && s.subnet.Contains(ip) {
+					reserved[ipPos(ip, *s.subnet)] = reservation.Identity
+				}
+			}
+		}
+		gateway := uint32(math.MaxUint32)
+		if s.gateway != nil && s.subnet.Contains(s.gateway) {
+			gateway = ipPos(s.gateway, *s.subnet)
+		}
+
+		used := usedBits(ipPairs, ipKey(VNI, *s.subnet))
+		subnetUsage := SubnetUsage{Subnet: s.subnet.String()}
+
+		var runStart, runLen, largestStart uint32
+		for pos := uint32(0); pos <= pool.last; pos++ {
+			free := false
+
+			switch {
+			case pool.excluded(pos):
+				runLen = 0
+				continue
+			case used(pos):
+				allocated := AllocatedIP{Kind: "unknown"}
+				lease, isLeased := leased[pos]
+				identity, isReserved := reserved[pos]
+
+				switch {
+				case isLeased:
+					allocated.Kind, allocated.ContainerID = "container", lease.ContainerID
+					allocated.Identity, allocated.Node = lease.Identity, lease.Node
+				case isReserved:
+					allocated.Kind, allocated.Identity = "reservation", identity
+				case pos == gateway:
+					allocated.Kind = "gateway"
+				}
+
+				if allocated.Kind == "reservation" {
+					subnetUsage.Reserved++
+				} else {
+					subnetUsage.Allocated++
+				}
+				if withIPs {
+					allocated.IP = ipFromPos(pos+1, *s.subnet).String()
+					usage.IPs = append(usage.IPs, allocated)
+				}
+			case pool.reserved[pos]:
+				subnetUsage.Reserved++
+			case !pool.inRange(pos):
+				subnetUsage.OutOfRange++
+			default:
+				subnetUsage.Free++
+				free = true
+			}
+			subnetUsage.Total++
+
+			if !free {
+				runLen = 0
+				continue
+			}
+			if runLen == 0 {
+				runStart = pos
+			}
+			runLen++
+			if uint64(runLen) > subnetUsage.LargestFreeSize {
+				subnetUsage.LargestFreeSize = uint64(runLen)
+				largestStart = runStart
+			}
+		}
+
+		if size := subnetUsage.LargestFreeSize; size != 0 {
+			subnetUsage.LargestFree = &IPRange{
+				Start: ipFromPos(largestStart+1, *s.subnet).String(),
+				End:   ipFromPos(largestStart+uint32(size), *s.subnet).String(),
+			}
+		}
+
+		subnetUsage.setUtilization()
+		usage.IPUsage.add(subnetUsage.IPUsage)
+		usage.Subnets = append(usage.Subnets, subnetUsage)
+	}
+
+	return usage, nil
+}
+
+// GetClusterUsage counts the addresses of every network
+func GetClusterUsage() (*ClusterUsage, error) {
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	ipPairs, ok := netAgent.List(ipStore)
+	if !ok {
+		return nil, fmt.Errorf("Error listing %s", ipStore)
+	}
+
+	usage := &ClusterUsage{Networks: make([]NetworkUsage, 0, len(networks))}
+	for i := range networks {
+		netUsage, err := networkUsage(&networks[i], ipPairs, false)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", networks[i].Name, err)
+		}
+		usage.IPUsage.add(netUsage.IPUsage)
+		usage.Networks = append(usage.Networks, *netUsage)
+	}
+
+	sort.Sort(byUsageNetwork(usage.Networks))
+	return usage, nil
+}
+
+type byUsageNetwork []NetworkUsage
+
+func (s byUsageNetwork) Len() int           { return len(s) }
+func (s byUsageNetwork) Less(i, j int) bool { return s[i].Network < s[j].Network }
+func (s byUsageNetwork) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+)
+
+func TestNetworkUsage(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/28")
+	options := NetworkOptions{
+		Exclude:  []string{"10.99.0.14"},
+		Reserved: []string{"10.99.0.13"},
+	}
+	network, err := createNetworkRecord("usage", subnet, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+
+	// a container, an address of an older release without lease and a
+	// reservation
+	ips, _ := requestIPs(network, subnets, "")
+	putLeases(network, subnets, ips, &Connection{ContainerID: "c1"})
+	requestIPs(network, subnets, "")
+	if _, err := CreateReservation(network, "db", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, other, _ := net.ParseCIDR("10.99.1.0/29")
+	if _, err := createNetworkRecord("other", other, nil, NetworkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := createRouter(NewDaemon())
+	request, _ := http.NewRequest("GET", "/network/usage/ipam", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	usage := &NetworkUsage{}
+	if err := json.NewDecoder(response.Body).Decode(usage); err != nil {
+		t.Fatal(response.Code, err)
+	}
+
+	expected := IPUsage{Total: 13, Allocated: 3, Reserved: 2, Free: 8}
+	expected.setUtilization()
+	if usage.IPUsage != expected {
+		t.Fatal("expected", expected, "got", usage.IPUsage)
+	}
+
+	largest := usage.Subnets[0].LargestFree
+	if largest == nil || largest.Start != "10.99.0.5" || largest.End != "10.99.0.12" || usage.Subnets[0].LargestFreeSize != 8 {
+		t.Fatal("wrong largest free block", largest, usage.Subnets[0].LargestFreeSize)
+	}
+
+	kinds := []string{"gateway", "container", "unknown", "reservation"}
+	if len(usage.IPs) != len(kinds) {
+		t.Fatal("wrong allocated IPs", usage.IPs)
+	}
+	for i, kind := range kinds {
+		if usage.IPs[i].Kind != kind {
+			t.Fatal("expected", kind, "got", usage.IPs[i])
+		}
+	}
+	if usage.IPs[1].ContainerID != "c1" || usage.IPs[3].Identity != "db" {
+		t.Fatal("wrong owners", usage.IPs)
+	}
+
+	request, _ = http.NewRequest("GET", "/ipam", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	cluster := &ClusterUsage{}
+	if err := json.NewDecoder(response.Body).Decode(cluster); err != nil {
+		t.Fatal(response.Code, err)
+	}
+	// 5 free addresses and the gateway in other
+	if len(cluster.Networks) != 2 || cluster.Total != 19 || cluster.Free != 13 || cluster.Networks[1].IPs != nil {
+		t.Fatal("wrong cluster usage", cluster)
+	}
+}
+
+// addresses outside the allocation ranges are only handed out on request,
+// they are not free
+func TestNetworkUsageRanges(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+
+	_, subnet, _ := net.ParseCIDR("10.100.0.0/27")
+	options := NetworkOptions{Ranges: []IPRange{{Start: "10.100.0.10", End: "10.100.0.19"}}}
+	network, err := createNetworkRecord("ranges", subnet, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, _ := network.subnets()
+
+	// a static address out of the range
+	if _, err := requestIPs(network, subnets, "10.100.0.25"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := GetNetworkUsage(network, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := IPUsage{Total: 30, Allocated: 2, Free: 10, OutOfRange: 18}
+	expected.setUtilization()
+	if usage.IPUsage != expected {
+		t.Fatal("expected", expected, "got", usage.IPUsage)
+	}
+	if usage.Utilization < 16 || usage.Utilization > 17 {
+		t.Fatal("utilization should only count the range and the used addresses", usage.Utilization)
+	}
+
+	largest := usage.Subnets[0].LargestFree
+	if largest == nil || largest.Start != "10.100.0.10" || largest.End != "10.100.0.19" || usage.Subnets[0].LargestFreeSize != 10 {
+		t.Fatal("wrong largest free block", largest, usage.Subnets[0].LargestFreeSize)
+	}
+	if usage.IPs != nil {
+		t.Fatal("addresses listed without withIPs", usage.IPs)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+// VNI allocation
+// vlanStore keeps the VNIs in use as sorted ranges under vniKey, a few bytes
+// for a cluster of consecutive networks. It is written with the ModifyIndex
+// it was read with, in the transaction creating or deleting the network, so
+// two nodes never hand out the same VNI; the loser of a race retries
+
+const vniKey = "vnis"
+
+// the bitmap of every VNI older releases kept in vlanStore
+const vniBitmapKey = "vlan"
+
+// VNIRange is the VNIs from Start to End included
+type VNIRange struct {
+	Start uint `json:"start"`
+	End   uint `json:"end"`
+}
+
+type vniRanges []VNIRange
+
+// VNIs only given to networks asking for them, like the ones of a physical
+// VXLAN fabric. Set from the daemon flags, the same on every node
+var reservedVNIs vniRanges
+
+// VNIConflictError is a VNI asked for that another network uses
+type VNIConflictError struct {
+	VNI uint
+}
+
+func (e *VNIConflictError) Error() string {
+	return fmt.Sprintf("VNI %d is in use", e.VNI)
+}
+
+// parse ranges like 1000-1999,4000
+func parseVNIRanges(s string) (vniRanges, error) {
+	var ranges vniRanges
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(field, "-", 2)
+		if len(bounds) == 1 {
+			bounds = append(bounds, bounds[0])
+		}
+
+		var vr [2]uint
+		for i, bound := range bounds {
+			VNI, err := strconv.ParseUint(strings.TrimSpace(bound), 10, 32)
+			if err != nil || VNI < 1 || VNI > vlanCount {
+				return nil, fmt.Errorf("bad VNI range %s, VNIs are 1 to %d", field, vlanCount)
+			}
+			vr[i] = uint(VNI)
+		}
+		if vr[0] > vr[1] {
+			return nil, errors.New("bad VNI range " + field + ", start after end")
+		}
+		ranges = append(ranges, VNIRange{vr[0], vr[1]})
+	}
+	return ranges.normalize(), nil
+}
+
+// sorted with overlapping and adjacent ranges merged
+func (r vniRanges) normalize() vniRanges {
+	sorted := append(vniRanges{}, r...)
+	sort.Sort(byVNIStart(sorted))
+
+	merged := make(vniRanges, 0, len(sorted))
+	for _, vr := range sorted {
+		if last := len(merged) - 1; last >= 0 && vr.Start <= merged[last].End+1 {
+			if vr.End > merged[last].End {
+				merged[last].End = vr.End
+			}
+			continue
+		}
+		merged = append(merged, vr)
+	}
+	return merged
+}
+
+func (r vniRanges) contains(VNI uint) bool {
+	i := sort.Search(len(r), func(i int) bool { return r[i].End >= VNI })
+	return i < len(r) && r[i].Start <= VNI
+}
+
+func (r vniRanges) add(VNI uint) vniRanges {
+	return append(append(vniRanges{}, r...), VNIRange{VNI, VNI}).normalize()
+}
+
+func (r vniRanges) remove(VNI uint) vniRanges {
+	removed := make(vniRanges, 0, len(r)+1)
+
+	for _, vr := range r {
+		if VNI < vr.Start || VNI > vr.End {
+			removed = append(removed, vr)
+			continue
+		}
+		if vr.Start < VNI {
+			removed = append(removed, VNIRange{vr.Start, VNI - 1})
+		}
+		if VNI < vr.End {
+			removed = append(removed, VNIRange{VNI + 1, vr.End})
+		}
+	}
+	return removed
+}
+
+// the smallest VNI in neither r nor reserved, 0 once all are taken
+func (r vniRanges) next(reserved vniRanges) uint {
+	VNI := uint(1)
+	for _, vr := range append(append(vniRanges{}, r...), reserved...).normalize() {
+		if VNI < vr.Start {
+			break
+		}
+		if vr.End >= VNI {
+			VNI = vr.End + 1
+		}
+	}
+
+	if VNI > vlanCount {
+		return 0
+	}
+	return VNI
+}
+
+// the VNIs in use as read from vlanStore
+type vniState struct {
+	used  vniRanges
+	index int
+	// ModifyIndex of the bitmap of an older release, 0 if there is none
+	bitmapIndex int
+}
+
+// read the VNIs in use from s, those of the bitmap of an older release are
+// merged in and the bitmap is dropped by the next write
+func loadVNIs(s netAgent.Store) (*vniState, error) {
+	state := &vniState{}
+
+	if data, index, ok := s.Get(vlanStore, vniKey); ok {
+		if err := json.Unmarshal(data, &state.used); err != nil {
+			return nil, errors.New("bad " + vniKey + " in " + vlanStore + ": " + err.Error())
+		}
+		state.index = index
+	}
+
+	if bitmap, index, ok := s.Get(vlanStore, vniBitmapKey); ok {
+		used := state.used
+		for i := uint32(0); i < uint32(len(bitmap)*8) && i < vlanCount; i++ {
+			if util.IsSet(bitmap, i) {
+				used = append(used, VNIRange{uint(i + 1), uint(i + 1)})
+			}
+		}
+		state.used = used.normalize()
+		state.bitmapIndex = index
+	}
+
+	return state, nil
+}
+
+// the transaction ops writing used in place of the state that was read
+func (state *vniState) ops(used vniRanges) []netAgent.TxnOp {
+	data, _ := json.Marshal(used)
+	ops := []netAgent.TxnOp{{Store: vlanStore, Key: vniKey, Value: data, Index: state.index}}
+
+	if state.bitmapIndex != 0 {
+		ops = append(ops, netAgent.TxnOp{Store: vlanStore, Key: vniBitmapKey, Index: state.bitmapIndex, Delete: true})
+	}
+	return ops
+}
+
+// pick the VNI of a new network, requested if not 0, reserved ones are only
+// given when requested
+func (state *vniState) claim(requested uint) (uint, error) {
+	if requested == 0 {
+		if VNI := state.used.next(reservedVNIs); VNI != 0 {
+			return VNI, nil
+		}
+		return 0, errors.New("All VNI have been used")
+	}
+
+	if requested > vlanCount {
+		return 0, fmt.Errorf("VNI %d out of range, VNIs are 1 to %d", requested, vlanCount)
+	}
+	if state.used.contains(requested) {
+		return 0, &VNIConflictError{requested}
+	}
+	return requested, nil
+}
+
+type byVNIStart vniRanges
+
+func (s byVNIStart) Len() int           { return len(s) }
+func (s byVNIStart) Less(i, j int) bool { return s[i].Start < s[j].Start }
+func (s byVNIStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/WIZARD-CXY/cxy-sdn/netAgent"
+	"github.com/WIZARD-CXY/cxy-sdn/util"
+)
+
+func TestVNIRanges(t *testing.T) {
+	ranges, err := parseVNIRanges("4000, 1000-1999,2000-2001,3")
+	expected := vniRanges{{3, 3}, {1000, 2001}, {4000, 4000}}
+	if err != nil || !reflect.DeepEqual(ranges, expected) {
+		t.Fatal("expected", expected, "got", ranges, err)
+	}
+
+	for _, bad := range []string{"0", "5-4", "1-x", "1000001"} {
+		if _, err := parseVNIRanges(bad); err == nil {
+			t.Fatal(bad, "accepted")
+		}
+	}
+
+	used := vniRanges{}.add(1).add(2).add(4)
+	if !reflect.DeepEqual(used, vniRanges{{1, 2}, {4, 4}}) || !used.contains(4) || used.contains(3) {
+		t.Fatal("wrong ranges", used)
+	}
+	if used = used.add(3).remove(2); !reflect.DeepEqual(used, vniRanges{{1, 1}, {3, 4}}) {
+		t.Fatal("wrong ranges", used)
+	}
+
+	if VNI := used.next(vniRanges{{2, 2}, {5, 9}}); VNI != 10 {
+		t.Fatal("expected VNI 10, got", VNI)
+	}
+	if VNI := (vniRanges{{1, vlanCount}}).next(nil); VNI != 0 {
+		t.Fatal("VNI given while all are used", VNI)
+	}
+}
+
+func TestCreateNetworkVNI(t *testing.T) {
+	netAgent.SetStore(netAgent.NewMemoryStore())
+	reservedVNIs = vniRanges{{2, 3}}
+	defer func() { reservedVNIs = nil }()
+
+	// VNIs 1 and 5 of an older release
+	bitmap := make([]byte, vlanCount/8)
+	util.Set(bitmap, 0)
+	util.Set(bitmap, 4)
+	netAgent.CAS(vlanStore, vniBitmapKey, bitmap, 0)
+
+	_, subnet, _ := net.ParseCIDR("10.71.0.0/24")
+	network, err := createNetworkRecord("auto", subnet, nil, NetworkOptions{})
+	if err != nil || network.VNI != 4 {
+		t.Fatal("expected VNI 4", network, err)
+	}
+	if _, _, ok := netAgent.Get(vlanStore, vniBitmapKey); ok {
+		t.Fatal("VNI bitmap not converted")
+	}
+
+	// a reserved VNI is given when asked for
+	_, subnet, _ = net.ParseCIDR("10.72.0.0/24")
+	network, err = createNetworkRecord("fabric", subnet, nil, NetworkOptions{VNI: 3})
+	if err != nil || network.VNI != 3 {
+		t.Fatal("expected VNI 3", network, err)
+	}
+
+	_, subnet, _ = net.ParseCIDR("10.73.0.0/24")
+	if _, err := createNetworkRecord("taken", subnet, nil, NetworkOptions{VNI: 3}); err == nil {
+		t.Fatal("VNI in use given twice")
+	} else if _, ok := err.(*VNIConflictError); !ok {
+		t.Fatal("expected a conflict", err)
+	}
+	if _, err := createNetworkRecord("taken", subnet, nil, NetworkOptions{VNI: vlanCount + 1}); err == nil {
+		t.Fatal("VNI out of range accepted")
+	}
+
+	if err := deleteNetworkRecord("fabric", false); err != nil {
+		t.Fatal(err)
+	}
+	vnis, _ := loadVNIs(netAgent.GetStore())
+	if !reflect.DeepEqual(vnis.used, vniRanges{{1, 1}, {4, 5}}) {
+		t.Fatal("wrong VNIs in use", vnis.used)
+	}
+
+	// VNI 1 is in use by a network of the older release
+	data, _ := json.Marshal(&Network{Name: "api", Subnet: "10.74.0.0/24", VNI: 1})
+	request, _ := http.NewRequest("POST", "/network", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+	createRouter(NewDaemon()).ServeHTTP(response, request)
+	if response.Code != http.StatusConflict {
+		t.Fatal("expected 409, got", response.Code, response.Body)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 
 	"math"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
@@ -18,8 +19,16 @@ var (
 	ErrNetworkOverlaps                = errors.New("requested network overlaps with existing network")
 )
 
+// the netlink address family of ip
+func Family(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
 func CheckRouteOverlaps(toCheck *net.IPNet) error {
-	networks, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	networks, err := netlink.RouteList(nil, Family(toCheck.IP))
 	if err != nil {
 		return err
 	}
@@ -33,6 +42,37 @@ func CheckRouteOverlaps(toCheck *net.IPNet) error {
 	return nil
 }
 
+// RouteDsts lists the destinations of the routes of family, except the
+// routes of the interfaces in skip and those only meaningful on this host
+func RouteDsts(family int, skip map[string]bool) ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsts []*net.IPNet
+	for _, route := range routes {
+		if route.Dst == nil || hostOnlyRoute(route) {
+			continue
+		}
+		if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil && skip[link.Attrs().Name] {
+			continue
+		}
+		dsts = append(dsts, route.Dst)
+	}
+	return dsts, nil
+}
+
+// host scope, link-local and multicast routes exist on every host, they say
+// nothing about the networks a host reaches
+func hostOnlyRoute(route netlink.Route) bool {
+	if route.Scope == netlink.SCOPE_HOST {
+		return true
+	}
+	ip := route.Dst.IP
+	return ip.IsLinkLocalUnicast() || ip.IsMulticast()
+}
+
 // Detects overlap between one IPNet and another
 func NetworkOverlaps(netX *net.IPNet, netY *net.IPNet) bool {
 	if firstIP, _ := NetworkRange(netX); netY.Contains(firstIP) {
@@ -44,13 +84,15 @@ func NetworkOverlaps(netX *net.IPNet, netY *net.IPNet) bool {
 	return false
 }
 
-// Calculates the first and last IP addresses in an IPNet
+// Calculates the first and last IP addresses in an IPNet, IPv4 or IPv6
 func NetworkRange(network *net.IPNet) (net.IP, net.IP) {
-	var (
-		netIP   = network.IP.To4()
-		firstIP = netIP.Mask(network.Mask)
-		lastIP  = net.IPv4(0, 0, 0, 0).To4()
-	)
+	netIP := network.IP.To4()
+	if netIP == nil || len(network.Mask) == net.IPv6len {
+		netIP = network.IP.To16()
+	}
+
+	firstIP := netIP.Mask(network.Mask)
+	lastIP := make(net.IP, len(netIP))
 
 	for i := 0; i < len(lastIP); i++ {
 		lastIP[i] = netIP[i] | ^network.Mask[i]
@@ -60,25 +102,29 @@ func NetworkRange(network *net.IPNet) (net.IP, net.IP) {
 
 // Return the IPv4 address of a network interface
 func GetIfaceAddr(name string) (*net.IPNet, error) {
+	return GetIfaceAddrFamily(name, netlink.FAMILY_V4)
+}
+
+// Return the first address of family of a network interface, IPv6 link
+// local addresses are skipped
+func GetIfaceAddrFamily(name string, family int) (*net.IPNet, error) {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	addrs, err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	addrs, err := netlink.AddrList(iface, family)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(addrs) == 0 {
-		return nil, fmt.Errorf("Interface %v has no IP addresses", name)
-	}
-
-	if len(addrs) > 1 {
-		// log.Info("Interface %v has more than 1 IPv4 address. Defaulting to using %v\n", name, addrs[0].IP)
+	for _, addr := range addrs {
+		if family == netlink.FAMILY_V6 && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return addr.IPNet, nil
 	}
-
-	return addrs[0].IPNet, nil
+	return nil, fmt.Errorf("Interface %v has no IP addresses", name)
 }
 
 func GetDefaultRouteIface() (int, error) {
@@ -93,6 +139,45 @@ func GetDefaultRouteIface() (int, error) {
 	return -1, ErrNoDefaultRoute
 }
 
+// wait until the link named name shows up, polling netlink
+func WaitForInterface(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := netlink.LinkByName(name); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Interface %v did not show up in %v", name, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// check whether the interface already carries the given ip/mask
+func HasInterfaceIp(name string, rawIp string) (bool, error) {
+	iface, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, err
+	}
+
+	ipNet, err := netlink.ParseIPNet(rawIp)
+	if err != nil {
+		return false, err
+	}
+
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipNet.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func InterfaceUp(name string) error {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
@@ -144,7 +229,12 @@ func SetDefaultGateway(ip, ifaceName string) error {
 		return errors.New("Invalid gateway address")
 	}
 
-	_, dst, err := net.ParseCIDR("0.0.0.0/0")
+	defaultDst := "0.0.0.0/0"
+	if Family(gw) == netlink.FAMILY_V6 {
+		defaultDst = "::/0"
+	}
+
+	_, dst, err := net.ParseCIDR(defaultDst)
 	if err != nil {
 		return err
 	}
@@ -224,6 +314,14 @@ func test(a []byte, k uint32) bool {
 	return ((a[k/8] & (1 << (k % 8))) != 0)
 }
 
+// IsSet reports whether the given bit is 1, 0 index based, false when out of range
+func IsSet(a []byte, k uint32) bool {
+	if k/8 >= uint32(len(a)) {
+		return false
+	}
+	return test(a, k)
+}
+
 // get the smallest 0 bit index and set it
 // return its index, 1 based
 // return len(a)*8+1 as all bits are set
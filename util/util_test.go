@@ -9,6 +9,7 @@ import (
 	"os"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -69,6 +70,30 @@ func TestCheckRouteOverlaps(t *testing.T) {
 	}
 }
 
+func TestHostOnlyRoute(t *testing.T) {
+	cases := map[string]bool{
+		"169.254.0.0/16": true,
+		"fe80::/64":      true,
+		"224.0.0.0/4":    true,
+		"ff00::/8":       true,
+		"10.1.0.0/16":    false,
+		"fd00:1::/64":    false,
+	}
+
+	for cidr, expected := range cases {
+		_, dst, _ := net.ParseCIDR(cidr)
+		route := netlink.Route{Dst: dst, Scope: netlink.SCOPE_LINK}
+		if hostOnly := hostOnlyRoute(route); hostOnly != expected {
+			t.Errorf("route to %s: expected host only %v, got %v", cidr, expected, hostOnly)
+		}
+	}
+
+	_, dst, _ := net.ParseCIDR("10.2.0.1/32")
+	if !hostOnlyRoute(netlink.Route{Dst: dst, Scope: netlink.SCOPE_HOST}) {
+		t.Error("host scope route must be left out")
+	}
+}
+
 func TestNetworkOverlaps(t *testing.T) {
 	_, netA, _ := net.ParseCIDR("10.1.0.0/22")
 	_, netB, _ := net.ParseCIDR("10.1.1.0/24")
@@ -97,6 +122,26 @@ func TestNetworkRange(t *testing.T) {
 
 }
 
+func TestNetworkRange6(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("fd00:42::/64")
+	addrA, addrB := NetworkRange(netA)
+
+	if !addrA.Equal(net.ParseIP("fd00:42::")) || !addrB.Equal(net.ParseIP("fd00:42::ffff:ffff:ffff:ffff")) {
+		t.Fatalf("got: %v - %v\n", addrA, addrB)
+	}
+
+	_, netB, _ := net.ParseCIDR("fd00:42::8000:0:0:0/65")
+	_, netC, _ := net.ParseCIDR("fd00:43::/64")
+	_, netD, _ := net.ParseCIDR("10.1.0.0/16")
+
+	if !NetworkOverlaps(netA, netB) {
+		t.Fatal("netA and netB overlap")
+	}
+	if NetworkOverlaps(netA, netC) || NetworkOverlaps(netA, netD) {
+		t.Fatal("netA overlaps neither netC nor an IPv4 network")
+	}
+}
+
 func TestGetDefaultRouteIface(t *testing.T) {
 	result, err := GetDefaultRouteIface()
 	if err != nil {
@@ -122,6 +167,16 @@ func TestInterfaceUpDown(t *testing.T) {
 	}
 }
 
+func TestWaitForInterface(t *testing.T) {
+	if err := WaitForInterface("nonexist0", 100*time.Millisecond); err == nil {
+		t.Fatal("waiting for a missing interface must time out")
+	}
+
+	if err := WaitForInterface("lo", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestChangeInterfaceName(t *testing.T) {
 	teardown := setUp(t)
 	defer teardown()